@@ -0,0 +1,125 @@
+// Package audit records the mutations of any osin-storage implementation as structured events.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// Action of an event
+type Action string
+
+// actions
+const (
+	ClientCreate  Action = "client.create"
+	ClientUpdate  Action = "client.update"
+	ClientRemove  Action = "client.remove"
+	CodeIssue     Action = "code.issue"
+	CodeRemove    Action = "code.remove"
+	CodeConsume   Action = "code.consume"
+	TokenIssue    Action = "token.issue"
+	TokenRevoke   Action = "token.revoke"
+	RefreshRevoke Action = "refresh.revoke"
+)
+
+// Event is a mutation of the storage.
+// Target is the client id, or TokenTarget of a code or token.
+// Before and After are JSON states of clients and tokens, secrets are never recorded.
+type Event struct {
+	ID       int64           `json:"id,omitempty"`
+	Action   Action          `json:"action"`
+	Target   string          `json:"target"`
+	ClientID string          `json:"client_id,omitempty"`
+	Actor    string          `json:"actor,omitempty"`
+	IP       string          `json:"ip,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	Time     time.Time       `json:"time"`
+}
+
+// Filter of events, zero fields match all
+type Filter struct {
+	Target   string
+	ClientID string
+	Since    time.Time // inclusive
+	Until    time.Time // exclusive
+	Limit    int
+}
+
+// Match reports whether ev passes the filter, the limit is not considered
+func (f Filter) Match(ev *Event) bool {
+	return (f.Target == "" || ev.Target == f.Target) &&
+		(f.ClientID == "" || ev.ClientID == f.ClientID) &&
+		(f.Since.IsZero() || !ev.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || ev.Time.Before(f.Until))
+}
+
+// Sink writes events
+type Sink interface {
+	WriteEvent(ev *Event) error
+}
+
+// Querier finds events in time order
+type Querier interface {
+	QueryEvents(f Filter) ([]Event, error)
+}
+
+// Actor is who mutates the storage
+type Actor struct {
+	Name string
+	IP   string
+}
+
+type actorKey struct{}
+
+// NewContext returns a context carrying the actor
+func NewContext(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// FromContext returns the actor of the context
+func FromContext(ctx context.Context) (Actor, bool) {
+	a, ok := ctx.Value(actorKey{}).(Actor)
+	return a, ok
+}
+
+// TokenTarget returns the target of a code or token, which are not recorded in clear, see storage.TokenHash.
+// A long token and its storage.TokenKey, which the storages save and revoke, have the same target.
+func TokenTarget(token string) string {
+	return storage.TokenHash(token)
+}
+
+// ClientState is the recorded state of a client, without the secret and the meta, which may hold
+// keys and contacts in clear. The version of a storage.Versioned client refers to its sealed revision.
+type ClientState struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	RedirectURI string `json:"redirect_uri"`
+	Version     int    `json:"version,omitempty"`
+}
+
+// NewClientState returns the state of c
+func NewClientState(c osin.Client) ClientState {
+	st := ClientState{ID: c.GetId(), RedirectURI: c.GetRedirectUri()}
+	if sc, ok := c.(storage.Client); ok {
+		st.Name = sc.GetName()
+	}
+	if v, ok := c.(storage.Versioned); ok {
+		st.Version = v.GetVersion()
+	}
+	return st
+}
+
+// TokenState is the recorded state of a token
+type TokenState struct {
+	Scope     string `json:"scope,omitempty"`
+	ExpiresIn int32  `json:"expires_in"`
+	Refresh   string `json:"refresh,omitempty"`
+	Previous  string `json:"previous,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
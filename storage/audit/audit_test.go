@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/bolt"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+func newTestStore(t *testing.T) storage.Storage {
+	bs, err := bolt.Open(filepath.Join(t.TempDir(), "oauth.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { bs.DB().Close() })
+	return oauth.AsStorage(bs)
+}
+
+func TestClientEvents(t *testing.T) {
+	sink := NewMemorySink()
+	ctx := NewContext(context.Background(), Actor{Name: "admin", IP: "10.0.0.1"})
+	store := New(newTestStore(t), sink).WithContext(ctx)
+
+	client := oauth.NewClient("1", "secret", "http://localhost/")
+	client.Meta.JWKSURI = "https://rp.example.com/jwks"
+	require.Nil(t, store.SaveClient(client))
+	client.RedirectURI = "http://example.com/"
+	require.Nil(t, store.SaveClient(client))
+	require.Nil(t, store.RemoveClient("1"))
+
+	events, err := sink.QueryEvents(Filter{Target: "1"})
+	require.Nil(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, ClientCreate, events[0].Action)
+	assert.Nil(t, events[0].Before)
+	assert.Equal(t, ClientUpdate, events[1].Action)
+	assert.Equal(t, ClientRemove, events[2].Action)
+	assert.Nil(t, events[2].After)
+	for _, ev := range events {
+		assert.Equal(t, "admin", ev.Actor)
+		assert.Equal(t, "10.0.0.1", ev.IP)
+		assert.NotContains(t, string(ev.Before)+string(ev.After), "secret")
+		assert.NotContains(t, string(ev.Before)+string(ev.After), client.Meta.JWKSURI)
+	}
+
+	var before, after ClientState
+	require.Nil(t, json.Unmarshal(events[1].Before, &before))
+	require.Nil(t, json.Unmarshal(events[1].After, &after))
+	assert.Equal(t, "http://localhost/", before.RedirectURI)
+	assert.Equal(t, "http://example.com/", after.RedirectURI)
+
+	// failed mutations are not recorded
+	assert.NotNil(t, store.SaveClient(oauth.NewClient("", "secret", "http://localhost/")))
+	events, err = sink.QueryEvents(Filter{})
+	require.Nil(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	sink := NewMemorySink()
+	store := New(newTestStore(t), sink)
+	// the bolt storage updates clients by version, but consumes no code and saves no jti
+	_, ok := store.(storage.AuthorizeConsumer)
+	assert.False(t, ok)
+	_, ok = store.(storage.ReplayCache)
+	assert.False(t, ok)
+	_, ok = store.WithContext(context.Background()).(storage.ReplayCache)
+	assert.False(t, ok)
+	u, ok := store.WithContext(context.Background()).(storage.ClientUpdater)
+	require.True(t, ok)
+	_, ok = store.Clone().(storage.ClientUpdater)
+	assert.True(t, ok)
+
+	client := oauth.NewClient("2", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	client.RedirectURI = "http://example.com/"
+	assert.ErrorIs(t, u.UpdateClient(client, 0), storage.ErrConflict)
+	require.Nil(t, u.UpdateClient(client, 1))
+
+	events, err := sink.QueryEvents(Filter{Target: "2"})
+	require.Nil(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, ClientUpdate, events[1].Action)
+	var before, after ClientState
+	require.Nil(t, json.Unmarshal(events[1].Before, &before))
+	require.Nil(t, json.Unmarshal(events[1].After, &after))
+	assert.Equal(t, "http://localhost/", before.RedirectURI)
+	assert.Equal(t, "http://example.com/", after.RedirectURI)
+}
+
+func TestTokenEvents(t *testing.T) {
+	sink := NewMemorySink()
+	store := New(newTestStore(t), sink)
+	client := oauth.NewClient("2", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+
+	authorize := &osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 60, CreatedAt: time.Now(),
+		UserData: oauth.JSONKV{}}
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: "access", RefreshToken: "refresh",
+		ExpiresIn: 60, Scope: "basic", CreatedAt: time.Now(), UserData: oauth.JSONKV{}}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	require.Nil(t, store.SaveAccess(access))
+	require.Nil(t, store.RemoveAuthorize("code"))
+	require.Nil(t, store.RemoveRefresh("refresh"))
+	require.Nil(t, store.RemoveAccess("access"))
+
+	events, err := sink.QueryEvents(Filter{ClientID: "2"})
+	require.Nil(t, err)
+	var actions []Action
+	for _, ev := range events {
+		actions = append(actions, ev.Action)
+		assert.NotContains(t, ev.Target, "access")
+		assert.NotContains(t, string(ev.After), `:"refresh"`)
+	}
+	assert.Equal(t, []Action{ClientCreate, CodeIssue, TokenIssue, CodeRemove, RefreshRevoke, TokenRevoke}, actions)
+
+	events, err = sink.QueryEvents(Filter{Target: TokenTarget("access")})
+	require.Nil(t, err)
+	require.Len(t, events, 2)
+	var st TokenState
+	require.Nil(t, json.Unmarshal(events[0].After, &st))
+	assert.Equal(t, "basic", st.Scope)
+	assert.Equal(t, TokenTarget("code"), st.Code)
+	assert.Equal(t, TokenTarget("refresh"), st.Refresh)
+
+	// a long token and the key it is saved by are the same target
+	long := strings.Repeat("a", storage.MaxTokenLen+1)
+	assert.Equal(t, TokenTarget(long), TokenTarget(storage.TokenKey(long)))
+	assert.NotEqual(t, TokenTarget(long), TokenTarget(long+"b"))
+
+	events, err = sink.QueryEvents(Filter{Until: events[0].Time})
+	require.Nil(t, err)
+	assert.Len(t, events, 2)
+	events, err = sink.QueryEvents(Filter{Since: time.Now().Add(time.Minute)})
+	require.Nil(t, err)
+	assert.Empty(t, events)
+}
+
+type failingSink struct{}
+
+func (failingSink) WriteEvent(*Event) error { return errors.New("sink down") }
+
+func TestSinkFailure(t *testing.T) {
+	var buf bytes.Buffer
+	store := New(newTestStore(t), failingSink{}, WithLogger(slog.NewTextHandler(&buf, nil)))
+	assert.Nil(t, store.SaveClient(oauth.NewClient("3", "secret", "http://localhost/")))
+	_, err := store.GetClient("3")
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "write audit event failed")
+	assert.Contains(t, buf.String(), "store=audit")
+	assert.Contains(t, buf.String(), "sink down")
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"sync"
+)
+
+var (
+	_ Sink    = (*MemorySink)(nil)
+	_ Querier = (*MemorySink)(nil)
+)
+
+// MemorySink keeps events in memory, for tests and development
+type MemorySink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewMemorySink returns an empty MemorySink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// WriteEvent appends the event and sets its ID
+func (m *MemorySink) WriteEvent(ev *Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ev.ID = int64(len(m.events) + 1)
+	m.events = append(m.events, *ev)
+	return nil
+}
+
+// QueryEvents returns the events matching f in time order
+func (m *MemorySink) QueryEvents(f Filter) (events []Event, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.events {
+		if f.Limit > 0 && len(events) >= f.Limit {
+			break
+		}
+		if f.Match(&m.events[i]) {
+			events = append(events, m.events[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,317 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/logging"
+)
+
+var (
+	_ Storage                   = (*auditedStore)(nil)
+	_ storage.ClientUpdater     = (*auditedStore)(nil)
+	_ storage.AuthorizeConsumer = (*auditedStore)(nil)
+	_ storage.ReplayCache       = (*auditedStore)(nil)
+)
+
+// Storage is a storage.Storage recording its mutations
+type Storage interface {
+	storage.Storage
+	// WithContext returns a storage recording the actor of ctx, see NewContext
+	WithContext(ctx context.Context) Storage
+}
+
+type auditedStore struct {
+	next  storage.Storage
+	sink  Sink
+	actor Actor
+	log   *slog.Logger
+}
+
+// Option of the audited storage
+type Option func(s *auditedStore)
+
+// WithLogger logs the failed writes to the handler h, default is the handler of slog.Default().
+// Codes and tokens are logged as hashes, and secrets are never logged.
+func WithLogger(h slog.Handler) Option {
+	return func(s *auditedStore) {
+		s.log = logging.New(h, "audit")
+	}
+}
+
+// New wraps next, successful mutations are written to sink.
+// A failed write is logged and does not fail the mutation.
+// The storage implements the optional interfaces of next only, see storage.Decorate.
+func New(next storage.Storage, sink Sink, opts ...Option) Storage {
+	s := &auditedStore{next: next, sink: sink}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.log == nil {
+		s.log = logging.New(nil, "audit")
+	}
+	return decorate(s)
+}
+
+// decorate returns s with the optional interfaces of its storage only, see storage.Decorate
+func decorate(s *auditedStore) Storage {
+	o := storage.OptionalOf(s).Of(s.next)
+	u, c, r := o.ClientUpdater, o.AuthorizeConsumer, o.ReplayCache
+	switch {
+	case u != nil && c != nil && r != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.AuthorizeConsumer
+			storage.ReplayCache
+		}{s, u, c, r}
+	case u != nil && c != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.AuthorizeConsumer
+		}{s, u, c}
+	case u != nil && r != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.ReplayCache
+		}{s, u, r}
+	case c != nil && r != nil:
+		return struct {
+			Storage
+			storage.AuthorizeConsumer
+			storage.ReplayCache
+		}{s, c, r}
+	case u != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+		}{s, u}
+	case c != nil:
+		return struct {
+			Storage
+			storage.AuthorizeConsumer
+		}{s, c}
+	case r != nil:
+		return struct {
+			Storage
+			storage.ReplayCache
+		}{s, r}
+	}
+	return struct{ Storage }{s}
+}
+
+// WithContext returns a storage recording the actor of ctx
+func (s *auditedStore) WithContext(ctx context.Context) Storage {
+	c := *s
+	c.actor, _ = FromContext(ctx)
+	return decorate(&c)
+}
+
+// Clone clones the underlying storage, the actor is kept.
+func (s *auditedStore) Clone() osin.Storage {
+	next, ok := s.next.Clone().(storage.Storage)
+	if !ok {
+		next = s.next
+	}
+	return decorate(&auditedStore{next: next, sink: s.sink, actor: s.actor, log: s.log})
+}
+
+// Close closes the underlying storage
+func (s *auditedStore) Close() {
+	s.next.Close()
+}
+
+// GetClient loads the client by id
+func (s *auditedStore) GetClient(id string) (osin.Client, error) {
+	return s.next.GetClient(id)
+}
+
+// SaveClient saves the client and records its creation or update
+func (s *auditedStore) SaveClient(c storage.Client) error {
+	action, before := ClientCreate, json.RawMessage(nil)
+	if old, err := s.next.GetClient(c.GetId()); err == nil && old != nil {
+		action, before = ClientUpdate, s.clientState(old)
+	}
+	if err := s.next.SaveClient(c); err != nil {
+		return err
+	}
+	s.record(&Event{Action: action, Target: c.GetId(), ClientID: c.GetId(), Before: before, After: s.clientState(c)})
+	return nil
+}
+
+// UpdateClient updates the client of version and records the update
+func (s *auditedStore) UpdateClient(c storage.Client, version int) error {
+	u, ok := s.next.(storage.ClientUpdater)
+	if !ok {
+		return fmt.Errorf("%w: %T updates no client by version", storage.ErrInvalidValue, s.next)
+	}
+	var before json.RawMessage
+	if old, err := s.next.GetClient(c.GetId()); err == nil && old != nil {
+		before = s.clientState(old)
+	}
+	if err := u.UpdateClient(c, version); err != nil {
+		return err
+	}
+	s.record(&Event{Action: ClientUpdate, Target: c.GetId(), ClientID: c.GetId(), Before: before, After: s.clientState(c)})
+	return nil
+}
+
+// RemoveClient removes the client and records its last state
+func (s *auditedStore) RemoveClient(id string) error {
+	var before json.RawMessage
+	if old, err := s.next.GetClient(id); err == nil && old != nil {
+		before = s.clientState(old)
+	}
+	if err := s.next.RemoveClient(id); err != nil {
+		return err
+	}
+	s.record(&Event{Action: ClientRemove, Target: id, ClientID: id, Before: before})
+	return nil
+}
+
+// SaveAuthorize saves authorize data and records the code issued
+func (s *auditedStore) SaveAuthorize(data *osin.AuthorizeData) error {
+	if err := s.next.SaveAuthorize(data); err != nil {
+		return err
+	}
+	s.record(&Event{Action: CodeIssue, Target: TokenTarget(data.Code), ClientID: clientID(data.Client),
+		After: s.marshal(TokenState{Scope: data.Scope, ExpiresIn: data.ExpiresIn})})
+	return nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *auditedStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	return s.next.LoadAuthorize(code)
+}
+
+// RemoveAuthorize removes the code and records it
+func (s *auditedStore) RemoveAuthorize(code string) error {
+	var cid string
+	if a, err := s.next.LoadAuthorize(code); err == nil && a != nil {
+		cid = clientID(a.Client)
+	}
+	if err := s.next.RemoveAuthorize(code); err != nil {
+		return err
+	}
+	s.record(&Event{Action: CodeRemove, Target: TokenTarget(code), ClientID: cid})
+	return nil
+}
+
+// ConsumeAuthorize consumes the code and records it, see storage.AuthorizeConsumer
+func (s *auditedStore) ConsumeAuthorize(code string) (*osin.AuthorizeData, error) {
+	c, ok := s.next.(storage.AuthorizeConsumer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T consumes no code", storage.ErrInvalidValue, s.next)
+	}
+	a, err := c.ConsumeAuthorize(code)
+	if err != nil {
+		return nil, err
+	}
+	s.record(&Event{Action: CodeConsume, Target: TokenTarget(code), ClientID: clientID(a.Client)})
+	return a, nil
+}
+
+// SaveAccess writes AccessData and records the token issued
+func (s *auditedStore) SaveAccess(data *osin.AccessData) error {
+	if err := s.next.SaveAccess(data); err != nil {
+		return err
+	}
+	s.record(&Event{Action: TokenIssue, Target: TokenTarget(data.AccessToken), ClientID: clientID(data.Client),
+		After: s.marshal(tokenState(data))})
+	return nil
+}
+
+// LoadAccess retrieves access data by token
+func (s *auditedStore) LoadAccess(token string) (*osin.AccessData, error) {
+	return s.next.LoadAccess(token)
+}
+
+// RemoveAccess revokes the token and records it
+func (s *auditedStore) RemoveAccess(token string) error {
+	var (
+		cid    string
+		before json.RawMessage
+	)
+	if a, err := s.next.LoadAccess(token); err == nil && a != nil {
+		cid, before = clientID(a.Client), s.marshal(tokenState(a))
+	}
+	if err := s.next.RemoveAccess(token); err != nil {
+		return err
+	}
+	s.record(&Event{Action: TokenRevoke, Target: TokenTarget(token), ClientID: cid, Before: before})
+	return nil
+}
+
+// LoadRefresh retrieves refresh AccessData
+func (s *auditedStore) LoadRefresh(token string) (*osin.AccessData, error) {
+	return s.next.LoadRefresh(token)
+}
+
+// RemoveRefresh revokes the refresh token and records it
+func (s *auditedStore) RemoveRefresh(token string) error {
+	var cid string
+	if a, err := s.next.LoadRefresh(token); err == nil && a != nil {
+		cid = clientID(a.Client)
+	}
+	if err := s.next.RemoveRefresh(token); err != nil {
+		return err
+	}
+	s.record(&Event{Action: RefreshRevoke, Target: TokenTarget(token), ClientID: cid})
+	return nil
+}
+
+// SaveJTI records the jti in the storage, not in the sink, see storage.ReplayCache
+func (s *auditedStore) SaveJTI(issuer, jti string, exp time.Time) error {
+	r, ok := s.next.(storage.ReplayCache)
+	if !ok {
+		return fmt.Errorf("%w: %T saves no jti", storage.ErrInvalidValue, s.next)
+	}
+	return r.SaveJTI(issuer, jti, exp)
+}
+
+func (s *auditedStore) record(ev *Event) {
+	ev.Actor, ev.IP = s.actor.Name, s.actor.IP
+	ev.Time = time.Now()
+	if err := s.sink.WriteEvent(ev); err != nil {
+		s.log.Error("write audit event failed", "action", ev.Action, "target", ev.Target, "err", err)
+	}
+}
+
+func clientID(c osin.Client) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetId()
+}
+
+func (s *auditedStore) clientState(c osin.Client) json.RawMessage {
+	return s.marshal(NewClientState(c))
+}
+
+func tokenState(a *osin.AccessData) TokenState {
+	st := TokenState{Scope: a.Scope, ExpiresIn: a.ExpiresIn, Refresh: TokenTarget(a.RefreshToken)}
+	if a.AccessData != nil {
+		st.Previous = TokenTarget(a.AccessData.AccessToken)
+	}
+	if a.AuthorizeData != nil {
+		st.Code = TokenTarget(a.AuthorizeData.Code)
+	}
+	return st
+}
+
+func (s *auditedStore) marshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.log.Error("marshal audit state failed", "type", fmt.Sprintf("%T", v), "err", err)
+		return nil
+	}
+	return b
+}
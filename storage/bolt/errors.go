@@ -0,0 +1,22 @@
+package bolt
+
+import (
+	"github.com/liut/osin-storage/storage"
+)
+
+// errors, the methods return a storage.Error of the kinds of package storage
+var (
+	ErrNotFound     = storage.ErrNotFound
+	ErrExists       = storage.ErrConflict
+	ErrInvalidValue = storage.ErrInvalidValue
+)
+
+// errKind classifies an error of bbolt
+func errKind(error) error {
+	return storage.ErrDatabase
+}
+
+// wrap sets *err to a storage.Error of the method op
+func wrap(op string, err *error) {
+	*err = storage.AsError(op, *err, errKind)
+}
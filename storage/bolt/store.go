@@ -0,0 +1,690 @@
+// Package bolt is a osin storage implementation on a bbolt file, for deployments without a database server.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/openshift/osin"
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/logging"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var (
+	_ oauth.Store           = (*Store)(nil)
+	_ storage.ClientUpdater = (*Store)(nil)
+	_ storage.ActiveCounter = (*Store)(nil)
+)
+
+// buckets
+var (
+	bucketClients  = []byte("clients")
+	bucketCodes    = []byte("codes")
+	bucketTokens   = []byte("tokens")
+	bucketRefresh  = []byte("refresh")
+	bucketConsents = []byte("consents")
+	bucketScopes   = []byte("scopes")
+
+	buckets = [][]byte{bucketClients, bucketCodes, bucketTokens, bucketRefresh, bucketConsents, bucketScopes}
+)
+
+// Options of the Store
+type Options struct {
+	// Expiry is the policy on load, Cleanup keeps a token with refresh until its refresh token expires by Expiry.Refresh
+	Expiry storage.Expiry
+	// Logger is the handler of the logs, default is the handler of slog.Default().
+	// Codes and tokens are logged as hashes, and user data is never logged.
+	Logger slog.Handler
+}
+
+// Store implements oauth.Store on bbolt.
+// Use oauth.AsStorage for a storage.Storage.
+type Store struct {
+	db  *bbolt.DB
+	opt Options
+	log *slog.Logger
+}
+
+// New returns a new bolt storage instance, the buckets are created if they do not exist.
+// The db is owned by the caller.
+func New(db *bbolt.DB, opts ...Options) (*Store, error) {
+	s := &Store{db: db}
+	if len(opts) > 0 {
+		s.opt = opts[0]
+	}
+	s.log = logging.New(s.opt.Logger, "bolt")
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open opens or creates the bbolt file at path and returns a storage on it
+func Open(path string, opts ...Options) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s, err := New(db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// DB returns the underlying bbolt database
+func (s *Store) DB() *bbolt.DB {
+	return s.db
+}
+
+type authorizeRecord struct {
+	ClientID            string       `json:"client_id"`
+	Code                string       `json:"code"`
+	ExpiresIn           int32        `json:"expires_in"`
+	Scope               string       `json:"scopes,omitempty"`
+	RedirectURI         string       `json:"redirect_uri,omitempty"`
+	State               string       `json:"state,omitempty"`
+	Extra               oauth.JSONKV `json:"extra,omitempty"`
+	CodeChallenge       string       `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string       `json:"code_challenge_method,omitempty"`
+	CreatedAt           time.Time    `json:"created"`
+}
+
+func (r *authorizeRecord) expireAt() time.Time {
+	return r.CreatedAt.Add(time.Duration(r.ExpiresIn) * time.Second)
+}
+
+type accessRecord struct {
+	ClientID      string       `json:"client_id"`
+	AuthorizeCode string       `json:"authorize_code,omitempty"`
+	Previous      string       `json:"previous,omitempty"`
+	AccessToken   string       `json:"access_token"`
+	RefreshToken  string       `json:"refresh_token,omitempty"`
+	ExpiresIn     int32        `json:"expires_in"`
+	Scope         string       `json:"scopes,omitempty"`
+	RedirectURI   string       `json:"redirect_uri,omitempty"`
+	Extra         oauth.JSONKV `json:"extra,omitempty"`
+	CreatedAt     time.Time    `json:"created"`
+
+	Refresh *storage.RefreshToken `json:"refresh,omitempty"` // the lifetime of RefreshToken
+}
+
+// expireAt of the record in Cleanup, zero means never. A token with refresh expires with its refresh token,
+// or refreshTTL after it is created if it is saved without the lifetime of its refresh token.
+func (r *accessRecord) expireAt(refreshTTL time.Duration) time.Time {
+	at := r.CreatedAt.Add(time.Duration(r.ExpiresIn) * time.Second)
+	if r.RefreshToken != "" {
+		var rat time.Time
+		if r.Refresh != nil {
+			rat = r.Refresh.ExpiresAt
+		} else if refreshTTL > 0 {
+			rat = r.CreatedAt.Add(refreshTTL)
+		}
+		if rat.IsZero() || rat.After(at) {
+			return rat
+		}
+	}
+	return at
+}
+
+func getJSON(tx *bbolt.Tx, bucket []byte, key string, v interface{}) error {
+	b := tx.Bucket(bucket).Get([]byte(key))
+	if b == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+func putJSON(tx *bbolt.Tx, bucket []byte, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), b)
+}
+
+// Clone the storage
+func (s *Store) Clone() osin.Storage {
+	return s
+}
+
+// Close the storage, the db is owned by the caller
+func (s *Store) Close() {
+}
+
+// GetClient loads the client by id
+func (s *Store) GetClient(id string) (_ osin.Client, err error) {
+	defer wrap("GetClient", &err)
+	c, err := s.LoadClient(id)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadClient loads the client by id
+func (s *Store) LoadClient(id string) (c *oauth.Client, err error) {
+	defer wrap("LoadClient", &err)
+	c = new(oauth.Client)
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return getJSON(tx, bucketClients, id, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// LoadClients returns clients ordered by id, paged by spec
+func (s *Store) LoadClients(spec *oauth.ClientSpec) (clients []oauth.Client, err error) {
+	defer wrap("LoadClients", &err)
+	if spec == nil {
+		spec = &oauth.ClientSpec{}
+	}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketClients)
+		spec.Total = b.Stats().KeyN
+		if spec.CountOnly {
+			return nil
+		}
+		skip := 0
+		if spec.Limit > 0 && spec.Page > 1 {
+			skip = (spec.Page - 1) * spec.Limit
+		}
+		clients = make([]oauth.Client, 0)
+		cur := b.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if spec.Limit > 0 && len(clients) >= spec.Limit {
+				break
+			}
+			var c oauth.Client
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			clients = append(clients, c)
+		}
+		return nil
+	})
+	return
+}
+
+// CountClients returns the number of clients
+func (s *Store) CountClients() (n uint) {
+	s.db.View(func(tx *bbolt.Tx) error {
+		n = uint(tx.Bucket(bucketClients).Stats().KeyN)
+		return nil
+	})
+	return
+}
+
+// SaveClient creates or updates the client, an update increments its version
+func (s *Store) SaveClient(c *oauth.Client) (err error) {
+	defer wrap("SaveClient", &err)
+	return s.saveClient(c, -1)
+}
+
+// UpdateClient updates the client if its stored version is version, and increments the version.
+// It returns a storage.ErrConflict if the client is updated since.
+func (s *Store) UpdateClient(client storage.Client, version int) (err error) {
+	defer wrap("UpdateClient", &err)
+	c := oauth.ClientOf(client)
+	return s.saveClient(c, version)
+}
+
+// saveClient updates the client of the version, or saves it with any version with -1
+func (s *Store) saveClient(c *oauth.Client, version int) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var old oauth.Client
+		err := getJSON(tx, bucketClients, c.ID, &old)
+		if err != nil && (!errors.Is(err, ErrNotFound) || version >= 0) {
+			return err
+		}
+		if version >= 0 && old.Version != version {
+			return fmt.Errorf("%w: client %s of version %d, not %d", storage.ErrConflict, c.ID, old.Version, version)
+		}
+		c.UpdatedAt = time.Now()
+		c.Version = old.Version + 1
+		if err == nil {
+			c.CreatedAt = old.CreatedAt
+		}
+		if c.CreatedAt.IsZero() {
+			c.CreatedAt = c.UpdatedAt
+		}
+		return putJSON(tx, bucketClients, c.ID, c)
+	})
+}
+
+// RemoveClient removes the client by id
+func (s *Store) RemoveClient(id string) (err error) {
+	defer wrap("RemoveClient", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketClients).Delete([]byte(id))
+	})
+}
+
+// SaveAuthorize saves authorize data
+func (s *Store) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	defer wrap("SaveAuthorize", &err)
+	extra, err := toExtra(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid authorize userdata", "code", data.Code, "err", err)
+		return err
+	}
+	if data.Client == nil || data.Code == "" {
+		return ErrInvalidValue
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketCodes).Get([]byte(data.Code)) != nil {
+			return ErrExists
+		}
+		return putJSON(tx, bucketCodes, data.Code, &authorizeRecord{
+			ClientID:            data.Client.GetId(),
+			Code:                data.Code,
+			ExpiresIn:           data.ExpiresIn,
+			Scope:               data.Scope,
+			RedirectURI:         data.RedirectUri,
+			State:               data.State,
+			Extra:               extra,
+			CodeChallenge:       data.CodeChallenge,
+			CodeChallengeMethod: data.CodeChallengeMethod,
+			CreatedAt:           data.CreatedAt,
+		})
+	})
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *Store) LoadAuthorize(code string) (_ *osin.AuthorizeData, err error) {
+	defer wrap("LoadAuthorize", &err)
+	a, err := s.loadAuthorize(code)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAuthorize(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *Store) loadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var r authorizeRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return getJSON(tx, bucketCodes, code, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &osin.AuthorizeData{
+		Client:              c,
+		Code:                r.Code,
+		ExpiresIn:           r.ExpiresIn,
+		Scope:               r.Scope,
+		RedirectUri:         r.RedirectURI,
+		State:               r.State,
+		CreatedAt:           r.CreatedAt,
+		UserData:            r.Extra,
+		CodeChallenge:       r.CodeChallenge,
+		CodeChallengeMethod: r.CodeChallengeMethod,
+	}, nil
+}
+
+// RemoveAuthorize revokes the authorization code
+func (s *Store) RemoveAuthorize(code string) (err error) {
+	defer wrap("RemoveAuthorize", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCodes).Delete([]byte(code))
+	})
+}
+
+// SaveAccess writes AccessData and its refresh token in one transaction
+func (s *Store) SaveAccess(data *osin.AccessData) (err error) {
+	defer wrap("SaveAccess", &err)
+	if data.AccessToken == "" || data.Client == nil {
+		return ErrInvalidValue
+	}
+	extra, err := toExtra(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid access userdata", "token", data.AccessToken, "err", err)
+		return err
+	}
+	r := &accessRecord{
+		ClientID:     data.Client.GetId(),
+		AccessToken:  data.AccessToken,
+		RefreshToken: data.RefreshToken,
+		ExpiresIn:    data.ExpiresIn,
+		Scope:        data.Scope,
+		RedirectURI:  data.RedirectUri,
+		Extra:        extra,
+		CreatedAt:    data.CreatedAt,
+	}
+	if data.AuthorizeData != nil {
+		r.AuthorizeCode = data.AuthorizeData.Code
+	}
+	if data.AccessData != nil {
+		r.Previous = data.AccessData.AccessToken
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketTokens).Get([]byte(r.AccessToken)) != nil {
+			return nil
+		}
+		if r.RefreshToken != "" {
+			var (
+				started time.Time
+				prev    accessRecord
+			)
+			if r.Previous != "" {
+				// the chain starts with the previous token, whether its record is removed or not
+				started = data.AccessData.CreatedAt
+				if getJSON(tx, bucketTokens, r.Previous, &prev) == nil && prev.Refresh != nil {
+					started = prev.Refresh.Started
+				}
+			}
+			rt := s.opt.Expiry.NewRefreshToken(data, started)
+			if storage.RefreshReused(data) && prev.Refresh != nil {
+				// kept on refresh, with the lifetime of its first issue
+				rt = s.opt.Expiry.ReuseRefreshToken(*prev.Refresh)
+			}
+			r.Refresh = &rt
+		}
+		if err := putJSON(tx, bucketTokens, r.AccessToken, r); err != nil {
+			return err
+		}
+		if r.RefreshToken != "" {
+			return tx.Bucket(bucketRefresh).Put([]byte(r.RefreshToken), []byte(r.AccessToken))
+		}
+		return nil
+	})
+}
+
+// LoadAccess retrieves access data by token, with client, authorize data and previous access.
+func (s *Store) LoadAccess(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadAccess", &err)
+	a, err := s.loadAccess(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAccess(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadAccess loads the token, with its code and previous token whether they are expired or not
+func (s *Store) loadAccess(token string) (*osin.AccessData, error) {
+	var r accessRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return getJSON(tx, bucketTokens, token, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	a := &osin.AccessData{
+		Client:       c,
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+		ExpiresIn:    r.ExpiresIn,
+		Scope:        r.Scope,
+		RedirectUri:  r.RedirectURI,
+		CreatedAt:    r.CreatedAt,
+		UserData:     r.Extra,
+	}
+	if r.AuthorizeCode != "" {
+		a.AuthorizeData, _ = s.loadAuthorize(r.AuthorizeCode)
+	}
+	if r.Previous != "" {
+		a.AccessData, _ = s.loadAccess(r.Previous)
+	}
+	return a, nil
+}
+
+// RemoveAccess revokes the access token
+func (s *Store) RemoveAccess(token string) (err error) {
+	defer wrap("RemoveAccess", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketTokens).Delete([]byte(token))
+	})
+}
+
+// LoadRefresh retrieves the access data of a refresh token
+func (s *Store) LoadRefresh(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadRefresh", &err)
+	var (
+		access string
+		r      accessRecord
+	)
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		access = string(tx.Bucket(bucketRefresh).Get([]byte(token)))
+		if access == "" {
+			return ErrNotFound
+		}
+		return getJSON(tx, bucketTokens, access, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.loadAccess(access)
+	if err != nil {
+		return nil, err
+	}
+	// the records saved before have no lifetime
+	if r.Refresh == nil {
+		err = s.opt.Expiry.CheckRefresh(a)
+	} else {
+		err = s.opt.Expiry.CheckRefreshToken(a, *r.Refresh)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// RemoveRefresh revokes the refresh token
+func (s *Store) RemoveRefresh(token string) (err error) {
+	defer wrap("RemoveRefresh", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRefresh).Delete([]byte(token))
+	})
+}
+
+// LoadScopes returns all scopes
+func (s *Store) LoadScopes() (scopes []oauth.Scope, err error) {
+	defer wrap("LoadScopes", &err)
+	scopes = make([]oauth.Scope, 0)
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketScopes).ForEach(func(k, v []byte) error {
+			var scope oauth.Scope
+			if err := json.Unmarshal(v, &scope); err != nil {
+				return err
+			}
+			scopes = append(scopes, scope)
+			return nil
+		})
+	})
+	return
+}
+
+// SaveScope creates or updates a scope by name
+func (s *Store) SaveScope(scope *oauth.Scope) (err error) {
+	defer wrap("SaveScope", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx, bucketScopes, scope.Name, scope)
+	})
+}
+
+func consentKey(clientID, username string) []byte {
+	return []byte(clientID + "\x00" + username)
+}
+
+// IsAuthorized returns true if the user has authorized the client
+func (s *Store) IsAuthorized(clientID, username string) (ok bool) {
+	s.db.View(func(tx *bbolt.Tx) error {
+		ok = tx.Bucket(bucketConsents).Get(consentKey(clientID, username)) != nil
+		return nil
+	})
+	return
+}
+
+// SaveAuthorized remembers the authorization of the user to the client
+func (s *Store) SaveAuthorized(clientID, username string) (err error) {
+	defer wrap("SaveAuthorized", &err)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		created, _ := time.Now().MarshalText()
+		return tx.Bucket(bucketConsents).Put(consentKey(clientID, username), created)
+	})
+}
+
+// CountActive counts the clients, the codes and tokens not expired, and the refresh tokens
+func (s *Store) CountActive() (c storage.Counts, err error) {
+	defer wrap("CountActive", &err)
+	now := time.Now()
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		c.Clients = int64(tx.Bucket(bucketClients).Stats().KeyN)
+		c.Refreshes = int64(tx.Bucket(bucketRefresh).Stats().KeyN)
+		err := tx.Bucket(bucketCodes).ForEach(func(k, v []byte) error {
+			var r authorizeRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.expireAt().After(now) {
+				c.Codes++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			var r accessRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.CreatedAt.Add(time.Duration(r.ExpiresIn) * time.Second).After(now) {
+				c.Tokens++
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// Cleanup removes the expired codes and tokens, with the refresh tokens of removed tokens.
+// It returns the number of removed codes and tokens.
+func (s *Store) Cleanup() (n int, err error) {
+	defer wrap("Cleanup", &err)
+	now := time.Now()
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		n = 0
+		var expired [][]byte
+		err := tx.Bucket(bucketCodes).ForEach(func(k, v []byte) error {
+			var r authorizeRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.ExpiresIn > 0 && r.expireAt().Before(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = tx.Bucket(bucketCodes).Delete(k); err != nil {
+				return err
+			}
+		}
+		n += len(expired)
+
+		expired = expired[:0]
+		refresh := make(map[string][]byte)
+		err = tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+			var r accessRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if at := r.expireAt(s.opt.Expiry.Refresh.TTL); r.ExpiresIn > 0 && !at.IsZero() && at.Before(now) {
+				expired = append(expired, append([]byte(nil), k...))
+				if r.RefreshToken != "" {
+					refresh[r.RefreshToken] = []byte(r.AccessToken)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = tx.Bucket(bucketTokens).Delete(k); err != nil {
+				return err
+			}
+		}
+		n += len(expired)
+		rb := tx.Bucket(bucketRefresh)
+		for k, access := range refresh {
+			// the refresh token may point to a newer token already
+			if bytes.Equal(rb.Get([]byte(k)), access) {
+				if err = rb.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// RunCleanup calls Cleanup every interval until ctx is done
+func (s *Store) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.Cleanup(); err != nil {
+				s.log.Error("cleanup failed", "err", err)
+			} else if n > 0 {
+				s.log.Info("cleanup removed codes and tokens", "removed", n)
+			}
+		}
+	}
+}
+
+func toExtra(data interface{}) (oauth.JSONKV, error) {
+	if data == nil {
+		return oauth.JSONKV{}, nil
+	}
+	return oauth.ToJSONKV(data)
+}
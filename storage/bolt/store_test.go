@@ -0,0 +1,313 @@
+package bolt
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var userDataMock = oauth.JSONKV{"name": "foobar"}
+
+func newTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "oauth.db"), Options{Expiry: storage.Expiry{Refresh: storage.RefreshPolicy{TTL: time.Hour}}})
+	require.Nil(t, err)
+	t.Cleanup(func() { store.DB().Close() })
+	return store
+}
+
+func TestClientOperations(t *testing.T) {
+	store := newTestStore(t)
+
+	create := oauth.NewClient("1", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(create))
+	c, err := store.LoadClient("1")
+	require.Nil(t, err)
+	assert.Equal(t, "secret", c.GetSecret())
+	assert.Equal(t, create.Meta, c.Meta)
+
+	update := oauth.NewClient("1", "secret123", "http://www.google.com/")
+	require.Nil(t, store.SaveClient(update))
+	c, err = store.LoadClient("1")
+	require.Nil(t, err)
+	assert.Equal(t, "secret123", c.GetSecret())
+	assert.Equal(t, create.CreatedAt.Unix(), c.CreatedAt.Unix())
+
+	require.Nil(t, store.SaveClient(oauth.NewClient("2", "secret", "http://localhost/")))
+	assert.Equal(t, uint(2), store.CountClients())
+	spec := &oauth.ClientSpec{Page: 2, Limit: 1}
+	clients, err := store.LoadClients(spec)
+	require.Nil(t, err)
+	assert.Equal(t, 2, spec.Total)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "2", clients[0].ID)
+
+	require.Nil(t, store.RemoveClient("1"))
+	_, err = store.GetClient("1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, store.SaveClient(&oauth.Client{ID: ""}), storage.ErrInvalidValue)
+}
+
+func TestAuthorizeOperations(t *testing.T) {
+	store := newTestStore(t)
+	client := oauth.NewClient("2", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+
+	authorize := &osin.AuthorizeData{
+		Client:      client,
+		Code:        uuid.New(),
+		ExpiresIn:   int32(600),
+		Scope:       "scope",
+		RedirectUri: "http://localhost/",
+		State:       "state",
+		CreatedAt:   time.Now().Round(time.Second),
+		UserData:    userDataMock,
+	}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	assert.ErrorIs(t, store.SaveAuthorize(authorize), ErrExists)
+
+	result, err := store.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	assert.Equal(t, authorize.Code, result.Code)
+	assert.Equal(t, authorize.CreatedAt.Unix(), result.CreatedAt.Unix())
+	assert.Equal(t, authorize.Client.GetId(), result.Client.GetId())
+	assert.Equal(t, userDataMock, result.UserData)
+
+	require.Nil(t, store.RemoveAuthorize(authorize.Code))
+	_, err = store.LoadAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	authorize.UserData = struct{ foo string }{"bar"}
+	assert.NotNil(t, store.SaveAuthorize(authorize))
+}
+
+func TestAccessOperations(t *testing.T) {
+	store := newTestStore(t)
+	client := oauth.NewClient("3", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	authorize := &osin.AuthorizeData{
+		Client:    client,
+		Code:      uuid.New(),
+		ExpiresIn: int32(60),
+		CreatedAt: time.Now(),
+	}
+	nestedAccess := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessToken:   uuid.New(),
+		RefreshToken:  uuid.New(),
+		ExpiresIn:     int32(60),
+		CreatedAt:     time.Now(),
+		UserData:      userDataMock,
+	}
+	access := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessData:    nestedAccess,
+		AccessToken:   uuid.New(),
+		RefreshToken:  uuid.New(),
+		ExpiresIn:     int32(60),
+		CreatedAt:     time.Now(),
+		UserData:      userDataMock,
+	}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	require.Nil(t, store.SaveAccess(nestedAccess))
+	require.Nil(t, store.SaveAccess(access))
+	require.Nil(t, store.SaveAccess(access))
+
+	result, err := store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.CreatedAt.Unix(), result.CreatedAt.Unix())
+	assert.Equal(t, nestedAccess.AccessToken, result.AccessData.AccessToken)
+	assert.Equal(t, authorize.Code, result.AuthorizeData.Code)
+	assert.Equal(t, userDataMock, result.UserData)
+
+	result, err = store.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.AccessToken, result.AccessToken)
+
+	require.Nil(t, store.RemoveRefresh(access.RefreshToken))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.Nil(t, store.RemoveAccess(nestedAccess.AccessToken))
+	result, err = store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Nil(t, result.AccessData)
+
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCleanup(t *testing.T) {
+	store := newTestStore(t)
+	client := oauth.NewClient("4", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	past := time.Now().Add(-2 * time.Minute)
+
+	require.Nil(t, store.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "expired", ExpiresIn: 60, CreatedAt: past}))
+	require.Nil(t, store.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "valid", ExpiresIn: 600, CreatedAt: past}))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "expired", ExpiresIn: 60, CreatedAt: past}))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "refreshable", RefreshToken: "r1",
+		ExpiresIn: 60, CreatedAt: past}))
+	// a refresh token issued an hour ago
+	store.opt.Expiry.Now = func() time.Time { return past.Add(-time.Hour) }
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "stale", RefreshToken: "r2",
+		ExpiresIn: 60, CreatedAt: past.Add(-time.Hour)}))
+	store.opt.Expiry.Now = nil
+
+	n, err := store.Cleanup()
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = store.LoadAuthorize("expired")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.LoadAuthorize("valid")
+	assert.Nil(t, err)
+	_, err = store.LoadAccess("expired")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.LoadRefresh("r1")
+	assert.Nil(t, err)
+	_, err = store.LoadRefresh("r2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestAuthorized(t *testing.T) {
+	store := newTestStore(t)
+	assert.False(t, store.IsAuthorized("5", "eagle"))
+	require.Nil(t, store.SaveAuthorized("5", "eagle"))
+	assert.True(t, store.IsAuthorized("5", "eagle"))
+	assert.False(t, store.IsAuthorized("5", "hawk"))
+
+	require.Nil(t, store.SaveScope(&oauth.Scope{Name: "basic", Label: "Basic", IsDefault: true}))
+	scopes, err := store.LoadScopes()
+	require.Nil(t, err)
+	require.Len(t, scopes, 1)
+	assert.Equal(t, "basic", scopes[0].Name)
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	store, err := Open(filepath.Join(t.TempDir(), "oauth.db"), Options{
+		Expiry: storage.Expiry{Enforce: true, Refresh: storage.RefreshPolicy{TTL: time.Hour}, Now: func() time.Time { return now }}})
+	require.Nil(t, err)
+	defer store.DB().Close()
+	client := oauth.NewClient("6", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	past := now.Add(-2 * time.Minute)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: "expired", ExpiresIn: 60, CreatedAt: past}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AuthorizeData: authorize,
+		AccessToken: "expired", RefreshToken: "r1", ExpiresIn: 60, CreatedAt: past}))
+
+	_, err = store.LoadAuthorize("expired")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	_, err = store.LoadAccess("expired")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	a, err := store.LoadRefresh("r1")
+	require.Nil(t, err)
+	assert.Equal(t, "expired", a.AuthorizeData.Code)
+
+	now = now.Add(2 * time.Hour)
+	_, err = store.LoadRefresh("r1")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+}
+
+func TestUpdateClient(t *testing.T) {
+	store := newTestStore(t)
+	client := oauth.NewClient("7", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	assert.Equal(t, 1, client.Version)
+
+	update := *client
+	update.Secret = "secret123"
+	require.Nil(t, store.UpdateClient(&update, 1))
+	assert.Equal(t, 2, update.Version)
+	assert.Equal(t, client.CreatedAt.Unix(), update.CreatedAt.Unix())
+	assert.ErrorIs(t, store.UpdateClient(client, 1), storage.ErrConflict)
+	assert.ErrorIs(t, store.UpdateClient(oauth.NewClient("8", "secret", "http://localhost/"), 1), storage.ErrNotFound)
+
+	c, err := store.LoadClient("7")
+	require.Nil(t, err)
+	assert.Equal(t, "secret123", c.Secret)
+	assert.Equal(t, 2, c.Version)
+}
+
+func TestRefreshLifetime(t *testing.T) {
+	now := time.Now()
+	store, err := Open(filepath.Join(t.TempDir(), "oauth.db"), Options{
+		Expiry: storage.Expiry{Refresh: storage.RefreshPolicy{MaxLifetime: 2 * time.Hour},
+			Now: func() time.Time { return now }}})
+	require.Nil(t, err)
+	defer store.DB().Close()
+	client := oauth.NewClient("9", "secret", "http://localhost/")
+	client.Meta.RefreshTTL = 3 * 3600
+	require.Nil(t, store.SaveClient(client))
+
+	first := &osin.AccessData{Client: client, AccessToken: "a1", RefreshToken: "r1", ExpiresIn: 60, CreatedAt: now}
+	require.Nil(t, store.SaveAccess(first))
+	now = now.Add(50 * time.Minute)
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessData: first,
+		AccessToken: "a2", RefreshToken: "r2", ExpiresIn: 60, CreatedAt: now}))
+	require.Nil(t, store.RemoveRefresh("r1"))
+	require.Nil(t, store.RemoveAccess("a1"))
+
+	// r2 expires with the lifetime of its chain, before the TTL of the client
+	now = now.Add(50 * time.Minute)
+	_, err = store.LoadRefresh("r2")
+	require.Nil(t, err)
+	now = now.Add(30 * time.Minute)
+	_, err = store.LoadRefresh("r2")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+}
+
+func TestErrors(t *testing.T) {
+	store := newTestStore(t)
+	_, err := store.LoadAccess("none")
+	var se *storage.Error
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, "LoadAccess", se.Op)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// the errors of bbolt are of the database
+	require.Nil(t, store.DB().Close())
+	_, err = store.LoadAccess("none")
+	require.ErrorAs(t, err, &se)
+	assert.ErrorIs(t, err, storage.ErrDatabase)
+	_, err = store.LoadRefresh("none")
+	assert.ErrorIs(t, err, storage.ErrDatabase)
+	assert.ErrorIs(t, store.SaveClient(oauth.NewClient("1", "secret", "http://localhost/")), storage.ErrDatabase)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	store, err := Open(filepath.Join(t.TempDir(), "oauth.db"), Options{Logger: slog.NewTextHandler(&buf, nil)})
+	require.Nil(t, err)
+	t.Cleanup(func() { store.DB().Close() })
+	client := oauth.NewClient("log", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	token := uuid.New()
+	err = store.SaveAccess(&osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: "alice@example.com"})
+	assert.NotNil(t, err)
+
+	// the user data is never logged, the tokens are hashed
+	out := buf.String()
+	assert.Contains(t, out, "invalid access userdata")
+	assert.Contains(t, out, "store=bolt")
+	assert.NotContains(t, out, "alice")
+	assert.NotContains(t, out, token)
+	assert.Contains(t, out, storage.TokenHash(token))
+}
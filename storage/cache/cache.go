@@ -0,0 +1,328 @@
+// Package cache is a read-through cache decorator for any osin-storage implementation.
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+var (
+	_ Storage                   = (*cachedStore)(nil)
+	_ storage.ClientUpdater     = (*cachedStore)(nil)
+	_ storage.AuthorizeConsumer = (*cachedStore)(nil)
+	_ storage.ReplayCache       = (*cachedStore)(nil)
+)
+
+// defaults
+const (
+	DefaultSize = 1024
+	DefaultTTL  = 5 * time.Minute
+)
+
+// Storage is a storage.Storage with cache statistics
+type Storage interface {
+	storage.Storage
+	Stats() Stats
+}
+
+// Stats of the cache
+type Stats struct {
+	ClientHits   uint64 `json:"client_hits"`
+	ClientMisses uint64 `json:"client_misses"`
+	AccessHits   uint64 `json:"access_hits"`
+	AccessMisses uint64 `json:"access_misses"`
+	Evictions    uint64 `json:"evictions"`
+}
+
+// Hits returns all hits
+func (s Stats) Hits() uint64 {
+	return s.ClientHits + s.AccessHits
+}
+
+// Misses returns all misses
+func (s Stats) Misses() uint64 {
+	return s.ClientMisses + s.AccessMisses
+}
+
+// HitRatio returns hits / (hits + misses), 0 if nothing was looked up.
+func (s Stats) HitRatio() float64 {
+	total := s.Hits() + s.Misses()
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits()) / float64(total)
+}
+
+type counters struct {
+	clientHits, clientMisses uint64
+	accessHits, accessMisses uint64
+}
+
+type cachedStore struct {
+	next    storage.Storage
+	ttl     time.Duration
+	clients *lru
+	access  *lru
+	stats   *counters
+}
+
+// New wraps next with a LRU cache of GetClient and LoadAccess results.
+// size bounds the entries of clients and tokens each, ttl bounds the age of an entry,
+// zero values fall back to DefaultSize and DefaultTTL.
+func New(next storage.Storage, size int, ttl time.Duration) Storage {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return decorate(&cachedStore{
+		next:    next,
+		ttl:     ttl,
+		clients: newLRU(size),
+		access:  newLRU(size),
+		stats:   new(counters),
+	})
+}
+
+// decorate returns s with the optional interfaces of its storage only, see storage.Decorate
+func decorate(s *cachedStore) Storage {
+	o := storage.OptionalOf(s).Of(s.next)
+	u, c, r := o.ClientUpdater, o.AuthorizeConsumer, o.ReplayCache
+	switch {
+	case u != nil && c != nil && r != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.AuthorizeConsumer
+			storage.ReplayCache
+		}{s, u, c, r}
+	case u != nil && c != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.AuthorizeConsumer
+		}{s, u, c}
+	case u != nil && r != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+			storage.ReplayCache
+		}{s, u, r}
+	case c != nil && r != nil:
+		return struct {
+			Storage
+			storage.AuthorizeConsumer
+			storage.ReplayCache
+		}{s, c, r}
+	case u != nil:
+		return struct {
+			Storage
+			storage.ClientUpdater
+		}{s, u}
+	case c != nil:
+		return struct {
+			Storage
+			storage.AuthorizeConsumer
+		}{s, c}
+	case r != nil:
+		return struct {
+			Storage
+			storage.ReplayCache
+		}{s, r}
+	}
+	return struct{ Storage }{s}
+}
+
+// Stats returns a snapshot of the cache statistics
+func (s *cachedStore) Stats() Stats {
+	return Stats{
+		ClientHits:   atomic.LoadUint64(&s.stats.clientHits),
+		ClientMisses: atomic.LoadUint64(&s.stats.clientMisses),
+		AccessHits:   atomic.LoadUint64(&s.stats.accessHits),
+		AccessMisses: atomic.LoadUint64(&s.stats.accessMisses),
+		Evictions:    s.clients.evicted() + s.access.evicted(),
+	}
+}
+
+// Clone clones the underlying storage, the cache is shared.
+func (s *cachedStore) Clone() osin.Storage {
+	next, ok := s.next.Clone().(storage.Storage)
+	if !ok {
+		next = s.next
+	}
+	return decorate(&cachedStore{
+		next:    next,
+		ttl:     s.ttl,
+		clients: s.clients,
+		access:  s.access,
+		stats:   s.stats,
+	})
+}
+
+// Close closes the underlying storage
+func (s *cachedStore) Close() {
+	s.next.Close()
+}
+
+// GetClient loads the client by id, from cache first, as a deep copy of the cached one.
+// A client loaded while the cache was invalidated is returned but not cached, it may be stale already.
+func (s *cachedStore) GetClient(id string) (osin.Client, error) {
+	if v, ok := s.clients.get(id); ok {
+		atomic.AddUint64(&s.stats.clientHits, 1)
+		return deepCopy(v).(osin.Client), nil
+	}
+	atomic.AddUint64(&s.stats.clientMisses, 1)
+	gen := s.clients.generation()
+	c, err := s.next.GetClient(id)
+	if err != nil {
+		return c, err
+	}
+	s.clients.addSince(gen, id, deepCopy(c), s.clients.now().Add(s.ttl))
+	return c, nil
+}
+
+// SaveClient saves the client and drops it and its cached tokens
+func (s *cachedStore) SaveClient(c storage.Client) error {
+	err := s.next.SaveClient(c)
+	s.forgetClient(c.GetId())
+	return err
+}
+
+// UpdateClient updates the client if next is a storage.ClientUpdater, and drops it and its cached tokens
+func (s *cachedStore) UpdateClient(c storage.Client, version int) error {
+	u, ok := s.next.(storage.ClientUpdater)
+	if !ok {
+		return fmt.Errorf("%w: %T updates no client by version", storage.ErrInvalidValue, s.next)
+	}
+	err := u.UpdateClient(c, version)
+	s.forgetClient(c.GetId())
+	return err
+}
+
+// RemoveClient removes the client and drops it and its cached tokens
+func (s *cachedStore) RemoveClient(id string) error {
+	err := s.next.RemoveClient(id)
+	s.forgetClient(id)
+	return err
+}
+
+// SaveAuthorize saves authorize data
+func (s *cachedStore) SaveAuthorize(data *osin.AuthorizeData) error {
+	return s.next.SaveAuthorize(data)
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *cachedStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	return s.next.LoadAuthorize(code)
+}
+
+// RemoveAuthorize removes the code and drops the cached tokens which embed it
+func (s *cachedStore) RemoveAuthorize(code string) error {
+	err := s.next.RemoveAuthorize(code)
+	s.forgetCode(code)
+	return err
+}
+
+// ConsumeAuthorize consumes the code if next is a storage.AuthorizeConsumer.
+// A reuse revokes the tokens of the code, so they are dropped from the cache, with the ones refreshed from them.
+func (s *cachedStore) ConsumeAuthorize(code string) (*osin.AuthorizeData, error) {
+	c, ok := s.next.(storage.AuthorizeConsumer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T consumes no code", storage.ErrInvalidValue, s.next)
+	}
+	data, err := c.ConsumeAuthorize(code)
+	s.forgetCode(code)
+	return data, err
+}
+
+// SaveAccess writes AccessData
+func (s *cachedStore) SaveAccess(data *osin.AccessData) error {
+	err := s.next.SaveAccess(data)
+	s.access.remove(storage.SavedKey(data.AccessToken))
+	return err
+}
+
+// LoadAccess retrieves access data by token, from cache first, as a deep copy of the cached one with its chain.
+// An entry never outlives the expiry of its token, it is cached by storage.TokenKey as in the storages.
+// A token loaded while the cache was invalidated is returned but not cached, e.g. if removed meanwhile.
+func (s *cachedStore) LoadAccess(token string) (*osin.AccessData, error) {
+	key := storage.TokenKey(token)
+	if v, ok := s.access.get(key); ok {
+		atomic.AddUint64(&s.stats.accessHits, 1)
+		return deepCopy(v).(*osin.AccessData), nil
+	}
+	atomic.AddUint64(&s.stats.accessMisses, 1)
+	gen := s.access.generation()
+	a, err := s.next.LoadAccess(token)
+	if err != nil || a == nil {
+		return a, err
+	}
+	expires := s.access.now().Add(s.ttl)
+	if at := a.ExpireAt(); a.ExpiresIn > 0 && at.Before(expires) {
+		expires = at
+	}
+	s.access.addSince(gen, key, deepCopy(a), expires)
+	return a, nil
+}
+
+// RemoveAccess removes the token and drops it and the cached tokens chained to it
+func (s *cachedStore) RemoveAccess(token string) error {
+	err := s.next.RemoveAccess(token)
+	key := storage.SavedKey(token)
+	s.access.remove(key)
+	s.access.removeFunc(func(v interface{}) bool {
+		a := v.(*osin.AccessData)
+		return a.AccessData != nil && storage.SavedKey(a.AccessData.AccessToken) == key
+	})
+	return err
+}
+
+// LoadRefresh retrieves refresh AccessData
+func (s *cachedStore) LoadRefresh(token string) (*osin.AccessData, error) {
+	return s.next.LoadRefresh(token)
+}
+
+// RemoveRefresh removes the refresh token and drops the cached tokens which carry it
+func (s *cachedStore) RemoveRefresh(token string) error {
+	err := s.next.RemoveRefresh(token)
+	key := storage.SavedKey(token)
+	s.access.removeFunc(func(v interface{}) bool {
+		return storage.SavedKey(v.(*osin.AccessData).RefreshToken) == key
+	})
+	return err
+}
+
+// SaveJTI saves the jti if next is a storage.ReplayCache, it is never cached
+func (s *cachedStore) SaveJTI(issuer, jti string, exp time.Time) error {
+	r, ok := s.next.(storage.ReplayCache)
+	if !ok {
+		return fmt.Errorf("%w: %T saves no jti", storage.ErrInvalidValue, s.next)
+	}
+	return r.SaveJTI(issuer, jti, exp)
+}
+
+// forgetCode drops the cached tokens issued with the code, or refreshed from one
+func (s *cachedStore) forgetCode(code string) {
+	s.access.removeFunc(func(v interface{}) bool {
+		for a := v.(*osin.AccessData); a != nil; a = a.AccessData {
+			if a.AuthorizeData != nil && a.AuthorizeData.Code == code {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *cachedStore) forgetClient(id string) {
+	s.clients.remove(id)
+	s.access.removeFunc(func(v interface{}) bool {
+		a := v.(*osin.AccessData)
+		return a.Client != nil && a.Client.GetId() == id
+	})
+}
@@ -0,0 +1,379 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var errNotFound = errors.New("not found")
+
+// memStore is a minimal storage.Storage counting the lookups
+type memStore struct {
+	clients map[string]*oauth.Client
+	access  map[string]*osin.AccessData
+
+	clientLoads, accessLoads int
+	onLoad                   func() // called in LoadAccess, after the token is found
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		clients: make(map[string]*oauth.Client),
+		access:  make(map[string]*osin.AccessData),
+	}
+}
+
+func (m *memStore) Clone() osin.Storage { return m }
+func (m *memStore) Close()              {}
+
+func (m *memStore) GetClient(id string) (osin.Client, error) {
+	m.clientLoads++
+	if c, ok := m.clients[id]; ok {
+		cp := *c
+		return &cp, nil
+	}
+	return nil, errNotFound
+}
+
+func (m *memStore) SaveClient(c storage.Client) error {
+	o := new(oauth.Client)
+	o.CopyFrom(c)
+	m.clients[o.ID] = o
+	return nil
+}
+
+func (m *memStore) RemoveClient(id string) error {
+	delete(m.clients, id)
+	return nil
+}
+
+func (m *memStore) SaveAuthorize(*osin.AuthorizeData) error { return nil }
+func (m *memStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	return nil, errNotFound
+}
+func (m *memStore) RemoveAuthorize(code string) error { return nil }
+
+func (m *memStore) SaveAccess(data *osin.AccessData) error {
+	cp := *data
+	m.access[storage.SavedKey(data.AccessToken)] = &cp
+	return nil
+}
+
+func (m *memStore) LoadAccess(token string) (*osin.AccessData, error) {
+	m.accessLoads++
+	if a, ok := m.access[storage.TokenKey(token)]; ok {
+		cp := *a
+		if c, ok := m.clients[clientID(cp.Client)]; ok {
+			cc := *c
+			cp.Client = &cc
+		}
+		if m.onLoad != nil {
+			m.onLoad()
+		}
+		return &cp, nil
+	}
+	return nil, errNotFound
+}
+
+func (m *memStore) RemoveAccess(token string) error {
+	delete(m.access, storage.SavedKey(token))
+	return nil
+}
+
+func (m *memStore) LoadRefresh(token string) (*osin.AccessData, error) {
+	for _, a := range m.access {
+		if a.RefreshToken == token {
+			return m.LoadAccess(a.AccessToken)
+		}
+	}
+	return nil, errNotFound
+}
+
+func (m *memStore) RemoveRefresh(token string) error {
+	for _, a := range m.access {
+		if a.RefreshToken == token {
+			a.RefreshToken = ""
+		}
+	}
+	return nil
+}
+
+func TestClientCache(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Minute)
+
+	client := oauth.NewClient("c1", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+
+	for i := 0; i < 3; i++ {
+		c, err := store.GetClient("c1")
+		require.Nil(t, err)
+		assert.Equal(t, "secret", c.GetSecret())
+	}
+	assert.Equal(t, 1, mem.clientLoads)
+
+	client.Secret = "changed"
+	require.Nil(t, store.SaveClient(client))
+	c, err := store.GetClient("c1")
+	require.Nil(t, err)
+	assert.Equal(t, "changed", c.GetSecret())
+	assert.Equal(t, 2, mem.clientLoads)
+
+	require.Nil(t, store.RemoveClient("c1"))
+	_, err = store.GetClient("c1")
+	assert.Equal(t, errNotFound, err)
+
+	st := store.Stats()
+	assert.Equal(t, uint64(2), st.ClientHits)
+	assert.Equal(t, uint64(3), st.ClientMisses)
+}
+
+func TestAccessCache(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Minute)
+
+	client := oauth.NewClient("c2", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	prev := &osin.AccessData{Client: client, AccessToken: "t0", ExpiresIn: 3600, CreatedAt: time.Now()}
+	access := &osin.AccessData{Client: client, AccessData: prev, AccessToken: "t1", RefreshToken: "r1",
+		ExpiresIn: 3600, CreatedAt: time.Now()}
+	require.Nil(t, store.SaveAccess(prev))
+	require.Nil(t, store.SaveAccess(access))
+
+	for i := 0; i < 3; i++ {
+		a, err := store.LoadAccess("t1")
+		require.Nil(t, err)
+		assert.Equal(t, "r1", a.RefreshToken)
+	}
+	assert.Equal(t, 1, mem.accessLoads)
+
+	// removing the previous token drops the chained one
+	require.Nil(t, store.RemoveAccess("t0"))
+	_, err := store.LoadAccess("t1")
+	require.Nil(t, err)
+	assert.Equal(t, 2, mem.accessLoads)
+
+	require.Nil(t, store.RemoveRefresh("r1"))
+	a, err := store.LoadAccess("t1")
+	require.Nil(t, err)
+	assert.Equal(t, "", a.RefreshToken)
+	assert.Equal(t, 3, mem.accessLoads)
+
+	client.Secret = "changed"
+	require.Nil(t, store.SaveClient(client))
+	a, err = store.LoadAccess("t1")
+	require.Nil(t, err)
+	assert.Equal(t, "changed", a.Client.GetSecret())
+	assert.Equal(t, 4, mem.accessLoads)
+
+	require.Nil(t, store.RemoveAccess("t1"))
+	_, err = store.LoadAccess("t1")
+	assert.Equal(t, errNotFound, err)
+
+	st := store.Stats()
+	assert.Equal(t, uint64(2), st.AccessHits)
+	assert.Equal(t, uint64(5), st.AccessMisses)
+}
+
+func TestLongToken(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Minute)
+	long := strings.Repeat("t", storage.MaxTokenLen+1)
+	key := storage.TokenKey(long)
+	require.Nil(t, store.SaveAccess(&osin.AccessData{AccessToken: long, ExpiresIn: 60, CreatedAt: time.Now()}))
+
+	_, err := store.LoadAccess(long)
+	require.Nil(t, err)
+	// the key does not hit the entry of its token
+	_, err = store.LoadAccess(key)
+	assert.Equal(t, errNotFound, err)
+	assert.Equal(t, 2, mem.accessLoads)
+
+	// removed by the key loaded with a chain
+	require.Nil(t, store.RemoveAccess(key))
+	_, err = store.LoadAccess(long)
+	assert.Equal(t, errNotFound, err)
+}
+
+func TestDeepCopy(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Minute)
+	client := oauth.NewClient("c5", "secret", "http://localhost/")
+	client.Meta.Scopes = []string{"basic"}
+	require.Nil(t, store.SaveClient(client))
+
+	// neither the loaded client nor the one of the storage change the cached one
+	c, err := store.GetClient("c5")
+	require.Nil(t, err)
+	c.(*oauth.Client).Meta.Scopes[0] = "admin"
+	client.Meta.Scopes[0] = "admin"
+	c, err = store.GetClient("c5")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"basic"}, c.(*oauth.Client).Meta.Scopes)
+	c.(*oauth.Client).Secret = "changed"
+	c, err = store.GetClient("c5")
+	require.Nil(t, err)
+	assert.Equal(t, "secret", c.GetSecret())
+	assert.Equal(t, 1, mem.clientLoads)
+
+	prev := &osin.AccessData{Client: client, AccessToken: "t0", UserData: map[string]interface{}{"name": "foo"}}
+	access := &osin.AccessData{Client: client, AccessData: prev, AccessToken: "t1", ExpiresIn: 3600, CreatedAt: time.Now(),
+		AuthorizeData: &osin.AuthorizeData{Code: "code", Client: client}, UserData: map[string]interface{}{"name": "foo"}}
+	require.Nil(t, store.SaveAccess(access))
+	a, err := store.LoadAccess("t1")
+	require.Nil(t, err)
+	a.UserData.(map[string]interface{})["name"] = "bar"
+	a.AccessData.UserData.(map[string]interface{})["name"] = "bar"
+	a.AuthorizeData.Code = "changed"
+	a.Client.(*oauth.Client).Meta.Scopes[0] = "basic"
+	access.UserData.(map[string]interface{})["name"] = "baz"
+	for i := 0; i < 2; i++ {
+		a, err = store.LoadAccess("t1")
+		require.Nil(t, err)
+		assert.Equal(t, "foo", a.UserData.(map[string]interface{})["name"])
+		assert.Equal(t, "foo", a.AccessData.UserData.(map[string]interface{})["name"])
+		assert.Equal(t, "code", a.AuthorizeData.Code)
+		assert.Equal(t, []string{"admin"}, a.Client.(*oauth.Client).Meta.Scopes)
+	}
+	assert.Equal(t, 1, mem.accessLoads)
+}
+
+func TestAccessExpiry(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Hour).(struct{ Storage }).Storage.(*cachedStore)
+	now := time.Now()
+	store.access.now = func() time.Time { return now }
+
+	require.Nil(t, store.SaveAccess(&osin.AccessData{AccessToken: "t", ExpiresIn: 60, CreatedAt: now}))
+	_, err := store.LoadAccess("t")
+	require.Nil(t, err)
+	_, err = store.LoadAccess("t")
+	require.Nil(t, err)
+	assert.Equal(t, 1, mem.accessLoads)
+
+	now = now.Add(61 * time.Second)
+	_, err = store.LoadAccess("t")
+	require.Nil(t, err)
+	assert.Equal(t, 2, mem.accessLoads)
+}
+
+func TestLRUBound(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", 1, time.Time{})
+	c.add("b", 2, time.Time{})
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	c.add("c", 3, time.Time{})
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	_, ok = c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.len())
+	assert.Equal(t, uint64(1), c.evicted())
+}
+
+func clientID(c osin.Client) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetId()
+}
+
+func TestAccessInvalidatedOnLoad(t *testing.T) {
+	mem := newMemStore()
+	store := New(mem, 10, time.Minute)
+	client := oauth.NewClient("c3", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "t1", ExpiresIn: 3600, CreatedAt: time.Now()}))
+
+	// the token is removed while it is loaded, the loaded data is not cached after the removal
+	mem.onLoad = func() {
+		mem.onLoad = nil
+		require.Nil(t, store.RemoveAccess("t1"))
+	}
+	a, err := store.LoadAccess("t1")
+	require.Nil(t, err)
+	assert.NotNil(t, a)
+	_, err = store.LoadAccess("t1")
+	assert.Equal(t, errNotFound, err)
+	assert.Equal(t, 2, mem.accessLoads)
+}
+
+// consumerStore is a memStore with the optional interfaces
+type consumerStore struct {
+	*memStore
+	consumed []string
+	jtis     []string
+}
+
+func (m *consumerStore) UpdateClient(c storage.Client, version int) error {
+	return m.SaveClient(c)
+}
+
+func (m *consumerStore) ConsumeAuthorize(code string) (*osin.AuthorizeData, error) {
+	m.consumed = append(m.consumed, code)
+	return nil, storage.ErrReused
+}
+
+func (m *consumerStore) SaveJTI(issuer, jti string, exp time.Time) error {
+	m.jtis = append(m.jtis, issuer+":"+jti)
+	return nil
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	// the cache implements the optional interfaces of the cached storage only
+	store := New(newMemStore(), 10, time.Minute)
+	_, ok := store.(storage.ClientUpdater)
+	assert.False(t, ok)
+	_, ok = store.(storage.AuthorizeConsumer)
+	assert.False(t, ok)
+	_, ok = store.(storage.ReplayCache)
+	assert.False(t, ok)
+	_, ok = store.Clone().(storage.ClientUpdater)
+	assert.False(t, ok)
+
+	mem := &consumerStore{memStore: newMemStore()}
+	store = New(mem, 10, time.Minute)
+	_, ok = store.Clone().(Storage)
+	assert.True(t, ok)
+	client := oauth.NewClient("c4", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	_, err := store.GetClient("c4")
+	require.Nil(t, err)
+	client.Secret = "changed"
+	require.Nil(t, store.(storage.ClientUpdater).UpdateClient(client, 1))
+	c, err := store.GetClient("c4")
+	require.Nil(t, err)
+	assert.Equal(t, "changed", c.GetSecret())
+
+	// a reused code drops the tokens issued with it, and refreshed from them
+	code := &osin.AuthorizeData{Code: "code", Client: client}
+	first := &osin.AccessData{Client: client, AuthorizeData: code, AccessToken: "t1", ExpiresIn: 3600, CreatedAt: time.Now()}
+	refreshed := &osin.AccessData{Client: client, AccessData: first, AccessToken: "t2", ExpiresIn: 3600, CreatedAt: time.Now()}
+	require.Nil(t, store.SaveAccess(first))
+	require.Nil(t, store.SaveAccess(refreshed))
+	for _, token := range []string{"t1", "t2", "t1", "t2"} {
+		_, err = store.LoadAccess(token)
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 2, mem.accessLoads)
+	_, err = store.(storage.AuthorizeConsumer).ConsumeAuthorize("code")
+	assert.ErrorIs(t, err, storage.ErrReused)
+	assert.Equal(t, []string{"code"}, mem.consumed)
+	_, _ = store.LoadAccess("t1")
+	_, _ = store.LoadAccess("t2")
+	assert.Equal(t, 4, mem.accessLoads)
+
+	require.Nil(t, store.(storage.ReplayCache).SaveJTI("rp", "1", time.Now()))
+	assert.Equal(t, []string{"rp:1"}, mem.jtis)
+}
@@ -10,9 +10,24 @@ CREATE TABLE IF NOT EXISTS oauth.client
 	redirect_uri varchar(255) NOT NULL DEFAULT '',
 	meta jsonb NOT NULL DEFAULT '{}'::jsonb,
 	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	version int NOT NULL DEFAULT 1, -- incremented by every update
+	updated timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	PRIMARY KEY (id)
 );
 
+CREATE TABLE IF NOT EXISTS oauth.client_revision
+(
+	client_id varchar(30) NOT NULL,
+	version int NOT NULL,
+	secret varchar(40) NOT NULL,
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	meta jsonb NOT NULL DEFAULT '{}'::jsonb,
+	actor varchar(120) NOT NULL DEFAULT '',
+	removed boolean NOT NULL DEFAULT false, -- a tombstone of the removal
+	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (client_id, version)
+);
+
 CREATE TABLE IF NOT EXISTS oauth.access
 (
 	id serial,
@@ -29,12 +44,15 @@ CREATE TABLE IF NOT EXISTS oauth.access
 	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	PRIMARY KEY (id)
 );
+CREATE INDEX IF NOT EXISTS oauth_access_authorize_code_idx ON oauth.access (authorize_code);
 
 CREATE TABLE IF NOT EXISTS oauth.refresh
 (
 	token varchar(240) NOT NULL UNIQUE,
 	access varchar(240) NOT NULL ,
 	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	started timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP, -- of the first refresh token of the rotation chain
+	expires_at timestamptz NULL,
 	PRIMARY KEY (token)
 );
 
@@ -49,6 +67,7 @@ CREATE TABLE IF NOT EXISTS oauth.authorize
 	state varchar(255) NOT NULL DEFAULT '',
 	extra jsonb NOT NULL DEFAULT '{}'::jsonb,
 	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_at timestamptz NULL, -- consumed by ConsumeAuthorize
 	UNIQUE (code),
 	PRIMARY KEY (id)
 );
@@ -74,4 +93,51 @@ CREATE TABLE IF NOT EXISTS oauth.scopes
 	PRIMARY KEY (id)
 );
 
+CREATE TABLE IF NOT EXISTS oauth.audit
+(
+	id bigserial,
+	action varchar(32) NOT NULL,
+	target varchar(240) NOT NULL DEFAULT '', -- client id or hashed token
+	client_id varchar(30) NOT NULL DEFAULT '',
+	actor varchar(120) NOT NULL DEFAULT '',
+	ip varchar(64) NOT NULL DEFAULT '',
+	state_before jsonb,
+	state_after jsonb,
+	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS oauth_audit_target_idx ON oauth.audit (target, created);
+CREATE INDEX IF NOT EXISTS oauth_audit_created_idx ON oauth.audit (created);
+
+CREATE TABLE IF NOT EXISTS oauth.outbox
+(
+	id bigserial,
+	aggregate varchar(240) NOT NULL, -- client:id, token:hash or refresh:hash
+	kind varchar(32) NOT NULL,
+	payload jsonb NOT NULL DEFAULT '{}'::jsonb,
+	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	delivered timestamptz,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS oauth_outbox_pending_idx ON oauth.outbox (id) WHERE delivered IS NULL;
+
 END;
+
+CREATE TABLE IF NOT EXISTS oauth.jti
+(
+	issuer varchar(120) NOT NULL,
+	jti varchar(255) NOT NULL,
+	expires timestamptz NOT NULL,
+	PRIMARY KEY (issuer, jti)
+);
+
+CREATE TABLE IF NOT EXISTS oauth.signing_key
+(
+	kid varchar(64) NOT NULL,
+	alg varchar(10) NOT NULL,
+	state varchar(10) NOT NULL DEFAULT 'next', -- next, active or retired
+	private_key jsonb NOT NULL, -- PKCS #8, sealed by the keyring
+	created timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (kid)
+);
@@ -0,0 +1,139 @@
+
+-- MySQL 5.7+ or MariaDB 10.2+, tables are prefixed with oauth_ in the current database
+
+CREATE TABLE IF NOT EXISTS oauth_client
+(
+	id varchar(30) NOT NULL,     -- client_id
+	secret varchar(40) NOT NULL, -- client_secret
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	meta json NOT NULL,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	version int NOT NULL DEFAULT 1, -- incremented by every update
+	updated datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_client_revision
+(
+	client_id varchar(30) NOT NULL,
+	version int NOT NULL,
+	secret varchar(40) NOT NULL,
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	meta json NOT NULL,
+	actor varchar(120) NOT NULL DEFAULT '',
+	removed boolean NOT NULL DEFAULT false, -- a tombstone of the removal
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (client_id, version)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_access
+(
+	id int NOT NULL AUTO_INCREMENT,
+	client_id varchar(30) NOT NULL,
+	authorize_code varchar(140) NOT NULL,
+	access_token varchar(240) NOT NULL UNIQUE,
+	refresh_token varchar(240) NOT NULL DEFAULT '',
+	previous varchar(240) NOT NULL DEFAULT '',
+	expires_in int NOT NULL DEFAULT 86400,
+	scopes varchar(255) NOT NULL DEFAULT '',
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	extra json NOT NULL,
+	is_frozen BOOLEAN NOT NULL DEFAULT false,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX (authorize_code),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_refresh
+(
+	token varchar(240) NOT NULL,
+	access varchar(240) NOT NULL ,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	started datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), -- of the first refresh token of the rotation chain
+	expires_at datetime(6) NULL,
+	PRIMARY KEY (token)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_authorize
+(
+	id int NOT NULL AUTO_INCREMENT,
+	code varchar(140) NOT NULL,
+	client_id varchar(30) NOT NULL, -- client.code
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	expires_in int NOT NULL DEFAULT 86400,
+	scopes varchar(255) NOT NULL DEFAULT '',
+	state varchar(255) NOT NULL DEFAULT '',
+	extra json NOT NULL,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	used_at datetime(6) NULL, -- consumed by ConsumeAuthorize
+	UNIQUE (code),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_client_user_authorized
+(
+	id int NOT NULL AUTO_INCREMENT,
+	client_id varchar(30) NOT NULL, -- client.code
+	username varchar(120) NOT NULL DEFAULT '',
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	UNIQUE (client_id, username),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_scopes
+(
+	id int NOT NULL AUTO_INCREMENT,
+	name varchar(64) NOT NULL, -- ascii code
+	label varchar(120) NOT NULL,
+	description varchar(255) NOT NULL DEFAULT '',
+	is_default BOOLEAN  NOT NULL DEFAULT false,
+	UNIQUE (name),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_audit
+(
+	id bigint NOT NULL AUTO_INCREMENT,
+	action varchar(32) NOT NULL,
+	target varchar(240) NOT NULL DEFAULT '', -- client id or hashed token
+	client_id varchar(30) NOT NULL DEFAULT '',
+	actor varchar(120) NOT NULL DEFAULT '',
+	ip varchar(64) NOT NULL DEFAULT '',
+	state_before json,
+	state_after json,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX (target, created),
+	INDEX (created),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_outbox
+(
+	id bigint NOT NULL AUTO_INCREMENT,
+	aggregate varchar(240) NOT NULL, -- client:id, token:hash or refresh:hash
+	kind varchar(32) NOT NULL,
+	payload json NOT NULL,
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	delivered datetime(6) NULL,
+	INDEX (delivered, id),
+	PRIMARY KEY (id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_jti
+(
+	issuer varchar(120) NOT NULL,
+	jti varchar(255) NOT NULL,
+	expires datetime(6) NOT NULL,
+	PRIMARY KEY (issuer, jti)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS oauth_signing_key
+(
+	kid varchar(64) NOT NULL,
+	alg varchar(10) NOT NULL,
+	state varchar(10) NOT NULL DEFAULT 'next', -- next, active or retired
+	private_key json NOT NULL, -- PKCS #8, sealed by the keyring
+	created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	updated datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (kid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
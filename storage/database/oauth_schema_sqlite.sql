@@ -0,0 +1,137 @@
+
+BEGIN;
+
+-- SQLite has no schemas, tables are prefixed with oauth_ and JSON is stored as text
+
+CREATE TABLE IF NOT EXISTS oauth_client
+(
+	id varchar(30) NOT NULL,     -- client_id
+	secret varchar(40) NOT NULL, -- client_secret
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	meta text NOT NULL DEFAULT '{}',
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	version int NOT NULL DEFAULT 1, -- incremented by every update
+	updated timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_client_revision
+(
+	client_id varchar(30) NOT NULL,
+	version int NOT NULL,
+	secret varchar(40) NOT NULL,
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	meta text NOT NULL DEFAULT '{}',
+	actor varchar(120) NOT NULL DEFAULT '',
+	removed boolean NOT NULL DEFAULT false, -- a tombstone of the removal
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (client_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_access
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id varchar(30) NOT NULL,
+	authorize_code varchar(140) NOT NULL,
+	access_token varchar(240) NOT NULL UNIQUE,
+	refresh_token varchar(240) NOT NULL DEFAULT '',
+	previous varchar(240) NOT NULL DEFAULT '',
+	expires_in int NOT NULL DEFAULT 86400,
+	scopes varchar(255) NOT NULL DEFAULT '',
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	extra text NOT NULL DEFAULT '{}',
+	is_frozen BOOLEAN NOT NULL DEFAULT false,
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS oauth_access_authorize_code_idx ON oauth_access (authorize_code);
+
+CREATE TABLE IF NOT EXISTS oauth_refresh
+(
+	token varchar(240) NOT NULL UNIQUE,
+	access varchar(240) NOT NULL ,
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	started timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, -- of the first refresh token of the rotation chain
+	expires_at timestamp NULL,
+	PRIMARY KEY (token)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_authorize
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code varchar(140) NOT NULL,
+	client_id varchar(30) NOT NULL, -- client.code
+	redirect_uri varchar(255) NOT NULL DEFAULT '',
+	expires_in int NOT NULL DEFAULT 86400,
+	scopes varchar(255) NOT NULL DEFAULT '',
+	state varchar(255) NOT NULL DEFAULT '',
+	extra text NOT NULL DEFAULT '{}',
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_at timestamp NULL, -- consumed by ConsumeAuthorize
+	UNIQUE (code)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_client_user_authorized
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id varchar(30) NOT NULL, -- client.code
+	username varchar(120) NOT NULL DEFAULT '',
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (client_id, username)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_scopes
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name varchar(64) NOT NULL, -- ascii code
+	label varchar(120) NOT NULL,
+	description varchar(255) NOT NULL DEFAULT '',
+	is_default BOOLEAN  NOT NULL DEFAULT false,
+	UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_audit
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action varchar(32) NOT NULL,
+	target varchar(240) NOT NULL DEFAULT '', -- client id or hashed token
+	client_id varchar(30) NOT NULL DEFAULT '',
+	actor varchar(120) NOT NULL DEFAULT '',
+	ip varchar(64) NOT NULL DEFAULT '',
+	state_before text,
+	state_after text,
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS oauth_audit_target_idx ON oauth_audit (target, created);
+CREATE INDEX IF NOT EXISTS oauth_audit_created_idx ON oauth_audit (created);
+
+CREATE TABLE IF NOT EXISTS oauth_outbox
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	aggregate varchar(240) NOT NULL, -- client:id, token:hash or refresh:hash
+	kind varchar(32) NOT NULL,
+	payload text NOT NULL DEFAULT '{}',
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	delivered timestamp
+);
+CREATE INDEX IF NOT EXISTS oauth_outbox_pending_idx ON oauth_outbox (id) WHERE delivered IS NULL;
+
+END;
+
+CREATE TABLE IF NOT EXISTS oauth_jti
+(
+	issuer varchar(120) NOT NULL,
+	jti varchar(255) NOT NULL,
+	expires timestamp NOT NULL,
+	PRIMARY KEY (issuer, jti)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_signing_key
+(
+	kid varchar(64) NOT NULL,
+	alg varchar(10) NOT NULL,
+	state varchar(10) NOT NULL DEFAULT 'next', -- next, active or retired
+	private_key text NOT NULL, -- PKCS #8, sealed by the keyring
+	created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (kid)
+);
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// kinds of the errors returned by the storages, test them with errors.Is.
+// ErrInvalidClient is also an ErrInvalidValue.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrExpired       = errors.New("expired")
+	ErrConflict      = errors.New("already exists")
+	ErrInvalidValue  = errors.New("invalid value")
+	ErrInvalidClient = fmt.Errorf("%w: client", ErrInvalidValue)
+	ErrFrozen        = errors.New("frozen")
+	ErrReused        = errors.New("already used")
+	ErrDatabase      = errors.New("database error")
+)
+
+var kinds = []error{ErrNotFound, ErrExpired, ErrConflict, ErrInvalidClient, ErrInvalidValue, ErrFrozen, ErrReused, ErrDatabase}
+
+// Error is an error of the storage method Op, of a Kind above and caused by Err, which may be nil.
+// Both Kind and Err match with errors.Is and errors.As.
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Op != "" {
+		s = e.Op + ": " + s
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns the kind and the cause
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Wrap returns an Error of the method op of kind, caused by err
+func Wrap(op string, kind, err error) error {
+	return &Error{Op: op, Kind: kind, Err: err}
+}
+
+// AsError returns err as an Error of the method op: an Error is returned as is, a kind is wrapped
+// without cause, and other errors are wrapped as the kind returned by classify, e.g. ErrDatabase.
+func AsError(op string, err error, classify func(error) error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	for _, kind := range kinds {
+		if err == kind {
+			return Wrap(op, kind, nil)
+		}
+		if errors.Is(err, kind) {
+			return Wrap(op, kind, err)
+		}
+	}
+	return Wrap(op, classify(err), err)
+}
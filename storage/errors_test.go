@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsError(t *testing.T) {
+	classify := func(err error) error {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return ErrDatabase
+	}
+	assert.Nil(t, AsError("LoadAccess", nil, classify))
+
+	err := AsError("LoadAccess", sql.ErrNoRows, classify)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, "LoadAccess: not found: sql: no rows in result set", err.Error())
+	assert.Equal(t, err, AsError("GetClient", err, classify), "kept by the outer method")
+
+	err = AsError("SaveClient", ErrInvalidClient, classify)
+	assert.ErrorIs(t, err, ErrInvalidClient)
+	assert.ErrorIs(t, err, ErrInvalidValue)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "SaveClient", e.Op)
+	assert.Nil(t, e.Err)
+
+	err = AsError("SaveAccess", errors.New("connection refused"), classify)
+	assert.ErrorIs(t, err, ErrDatabase)
+	assert.NotErrorIs(t, err, ErrNotFound)
+}
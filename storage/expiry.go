@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openshift/osin"
+)
+
+// Expiry is the policy of the storages on the expiry of codes and tokens when they are loaded.
+// The zero value enforces nothing and leaves the checks to osin, which is the default of every storage.
+type Expiry struct {
+	// Enforce rejects the expired codes and access tokens with ErrExpired on load.
+	// The refresh tokens, not checked by osin, expire by their policy once set, regardless of Enforce.
+	Enforce bool
+	// Skew allows for the clock skew between servers, codes and tokens expire Skew later
+	Skew time.Duration
+	// Refresh is the default lifetime of the refresh tokens, of the clients without their own
+	Refresh RefreshPolicy
+	// Now is the clock, default time.Now
+	Now func() time.Time
+}
+
+func (e Expiry) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+// expired returns an ErrExpired of what, if created plus ttl and the skew is before now, as osin does
+func (e Expiry) expired(what string, created time.Time, ttl time.Duration) error {
+	if at := created.Add(ttl); at.Add(e.Skew).Before(e.now()) {
+		return fmt.Errorf("%w: %s at %s", ErrExpired, what, at)
+	}
+	return nil
+}
+
+// CheckAuthorize returns an ErrExpired if the code is expired and the policy is enforced
+func (e Expiry) CheckAuthorize(a *osin.AuthorizeData) error {
+	if !e.Enforce {
+		return nil
+	}
+	return e.expired("code", a.CreatedAt, time.Duration(a.ExpiresIn)*time.Second)
+}
+
+// CheckAccess returns an ErrExpired if the access token is expired and the policy is enforced
+func (e Expiry) CheckAccess(a *osin.AccessData) error {
+	if !e.Enforce {
+		return nil
+	}
+	return e.expired("access token", a.CreatedAt, time.Duration(a.ExpiresIn)*time.Second)
+}
+
+// CheckRefresh returns an ErrExpired if the refresh token of a, saved without its lifetime, is expired
+// by the policy of its client as CheckRefreshToken, as if it were issued with its access token.
+// The access token may be expired.
+func (e Expiry) CheckRefresh(a *osin.AccessData) error {
+	r := RefreshToken{Created: a.CreatedAt, Started: a.CreatedAt}
+	if p := e.RefreshPolicy(a.Client); p.TTL > 0 {
+		r.ExpiresAt = a.CreatedAt.Add(p.TTL)
+	}
+	return e.CheckRefreshToken(a, r)
+}
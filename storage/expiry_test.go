@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	code := &osin.AuthorizeData{ExpiresIn: 60, CreatedAt: now.Add(-90 * time.Second)}
+	access := &osin.AccessData{ExpiresIn: 60, CreatedAt: now.Add(-30 * time.Minute)}
+
+	var e Expiry
+	assert.Nil(t, e.CheckAuthorize(code))
+	assert.Nil(t, e.CheckAccess(access))
+	assert.Nil(t, e.CheckRefresh(access))
+
+	e = Expiry{Enforce: true, Now: func() time.Time { return now }}
+	assert.ErrorIs(t, e.CheckAuthorize(code), ErrExpired)
+	assert.ErrorIs(t, e.CheckAccess(access), ErrExpired)
+	assert.Nil(t, e.CheckRefresh(access), "refresh tokens never expire without a policy")
+
+	e.Skew = time.Minute
+	e.Refresh.TTL = time.Hour
+	assert.Nil(t, e.CheckAuthorize(code))
+	assert.ErrorIs(t, e.CheckAccess(access), ErrExpired)
+	assert.Nil(t, e.CheckRefresh(access))
+
+	now = now.Add(32 * time.Minute)
+	assert.ErrorIs(t, e.CheckRefresh(access), ErrExpired)
+
+	// the refresh policy is enforced once set, as CheckRefreshToken
+	e.Enforce = false
+	assert.Nil(t, e.CheckAccess(access))
+	assert.ErrorIs(t, e.CheckRefresh(access), ErrExpired)
+	assert.ErrorIs(t, e.CheckRefreshToken(access, RefreshToken{ExpiresAt: access.CreatedAt.Add(time.Hour)}), ErrExpired)
+}
+
+type policedClient struct {
+	osin.DefaultClient
+	p RefreshPolicy
+}
+
+func (c *policedClient) GetRefreshPolicy() RefreshPolicy { return c.p }
+
+func TestRefreshToken(t *testing.T) {
+	now := time.Now()
+	e := Expiry{Refresh: RefreshPolicy{TTL: time.Hour, MaxLifetime: 24 * time.Hour}, Now: func() time.Time { return now }}
+	access := &osin.AccessData{Client: &osin.DefaultClient{Id: "default"}}
+
+	// the first token starts its chain
+	r := e.NewRefreshToken(access, time.Time{})
+	assert.Equal(t, now, r.Started)
+	assert.Equal(t, now.Add(time.Hour), r.ExpiresAt)
+	assert.Nil(t, e.CheckRefreshToken(access, r))
+
+	now = now.Add(2 * time.Hour)
+	assert.ErrorIs(t, e.CheckRefreshToken(access, r), ErrExpired)
+
+	// rotated tokens expire with their chain
+	r = e.NewRefreshToken(access, now.Add(-23*time.Hour-30*time.Minute))
+	assert.Nil(t, e.CheckRefreshToken(access, r))
+	now = now.Add(45 * time.Minute)
+	assert.ErrorIs(t, e.CheckRefreshToken(access, r), ErrExpired)
+
+	// the policy of the client is over the default
+	access.Client = &policedClient{osin.DefaultClient{Id: "idle"}, RefreshPolicy{TTL: -1, Idle: 10 * time.Minute}}
+	assert.Equal(t, RefreshPolicy{TTL: -1, Idle: 10 * time.Minute, MaxLifetime: 24 * time.Hour}, e.RefreshPolicy(access.Client))
+	r = e.NewRefreshToken(access, time.Time{})
+	assert.True(t, r.ExpiresAt.IsZero())
+	now = now.Add(5 * time.Minute)
+	assert.Nil(t, e.CheckRefreshToken(access, r))
+	now = now.Add(10 * time.Minute)
+	assert.ErrorIs(t, e.CheckRefreshToken(access, r), ErrExpired)
+}
+
+func TestRefreshDeadline(t *testing.T) {
+	now := time.Now()
+	e := Expiry{Skew: time.Minute, Now: func() time.Time { return now }}
+	access := &osin.AccessData{Client: &osin.DefaultClient{Id: "default"}}
+	assert.True(t, e.RefreshDeadline(access, e.NewRefreshToken(access, time.Time{})).IsZero())
+
+	e.Refresh = RefreshPolicy{TTL: 3 * time.Hour, Idle: 2 * time.Hour, MaxLifetime: 24 * time.Hour}
+	r := e.NewRefreshToken(access, time.Time{})
+	assert.Equal(t, now.Add(2*time.Hour+time.Minute), e.RefreshDeadline(access, r))
+	r = e.NewRefreshToken(access, now.Add(-23*time.Hour))
+	assert.Equal(t, now.Add(time.Hour+time.Minute), e.RefreshDeadline(access, r))
+	e.Refresh.Idle = 0
+	r = e.NewRefreshToken(access, time.Time{})
+	assert.Equal(t, now.Add(3*time.Hour+time.Minute), e.RefreshDeadline(access, r))
+}
@@ -1,7 +1,11 @@
 // Package storage defines an interface, which all osin-storage implementations are going to support.
 package storage
 
-import "github.com/openshift/osin"
+import (
+	"time"
+
+	"github.com/openshift/osin"
+)
 
 // Client ...
 type Client interface {
@@ -14,6 +18,11 @@ type Client interface {
 	CopyFrom(Client)
 }
 
+// AccessTTLer is a client with its own lifetime of the access tokens in seconds, zero for the default of the server
+type AccessTTLer interface {
+	GetAccessTTL() int
+}
+
 // Storage extends github.com/openshift/osin.Storage with create, update and delete methods for clients.
 type Storage interface {
 	osin.Storage
@@ -24,3 +33,41 @@ type Storage interface {
 	// RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
 	RemoveClient(id string) error
 }
+
+// Counts of the records of a storage, codes and tokens are not expired
+type Counts struct {
+	Clients   int64 `json:"clients"`
+	Codes     int64 `json:"codes"`
+	Tokens    int64 `json:"tokens"`
+	Refreshes int64 `json:"refreshes"`
+}
+
+// ActiveCounter is a storage counting its records
+type ActiveCounter interface {
+	CountActive() (Counts, error)
+}
+
+// Versioned is a client with a version, which is incremented by every update
+type Versioned interface {
+	GetVersion() int
+}
+
+// ClientUpdater is a storage updating the clients with optimistic concurrency
+type ClientUpdater interface {
+	// UpdateClient updates the client if its stored version is version, and increments the version.
+	// It returns an ErrConflict if the client is updated since, or an ErrNotFound.
+	UpdateClient(client Client, version int) error
+}
+
+// AuthorizeConsumer is a storage consuming the authorization codes atomically
+type AuthorizeConsumer interface {
+	// ConsumeAuthorize loads the code and marks it used at once, only the first call succeeds.
+	// The next calls return an ErrReused, and revoke the tokens issued with the code and refreshed from them.
+	ConsumeAuthorize(code string) (*osin.AuthorizeData, error)
+}
+
+// ReplayCache is a storage remembering the ids (jti) of the client assertions until they expire
+type ReplayCache interface {
+	// SaveJTI saves the jti of the issuer until exp, it returns an ErrReused if saved and not expired yet
+	SaveJTI(issuer, jti string, exp time.Time) error
+}
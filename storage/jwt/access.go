@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// AccessTokenType is the typ of the JWT access tokens of RFC 9068
+const AccessTokenType = "at+jwt"
+
+// DefaultKeysTTL keeps the signing keys loaded by AccessTokenGen this long
+const DefaultKeysTTL = time.Minute
+
+var _ osin.AccessTokenGen = (*AccessTokenGen)(nil)
+
+// AccessClaims are the claims of a JWT access token
+type AccessClaims struct {
+	Claims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// AccessTokenGen is an osin.AccessTokenGen of JWT access tokens (RFC 9068), signed by the active key of Keys.
+// The tokens are longer than the token columns, the SQL storages save them by storage.TokenKey.
+//
+// The access TTL of a storage.AccessTTLer client, e.g. the access_ttl of an oauth.Client, is set to the expires_in
+// of the data before signing, as oauth.ApplyAccess does on save, so the exp is the lifetime saved and returned.
+type AccessTokenGen struct {
+	Keys     KeyStore
+	Issuer   string
+	Audience []string                        // the resource servers, default the client_id
+	Subject  func(d *osin.AccessData) string // default the UserData as a string, or the client_id
+	Refresh  osin.AccessTokenGen             // the opaque refresh tokens, default osin.AccessTokenGenDefault
+	KeysTTL  time.Duration                   // default DefaultKeysTTL
+
+	mu     sync.Mutex
+	keys   []SigningKey
+	loaded time.Time
+}
+
+// GenerateAccessToken osin.AccessTokenGen
+func (g *AccessTokenGen) GenerateAccessToken(data *osin.AccessData, generaterefresh bool) (string, string, error) {
+	key, err := g.signingKey()
+	if err != nil {
+		return "", "", err
+	}
+	jti := make([]byte, 16)
+	if _, err = rand.Read(jti); err != nil {
+		return "", "", err
+	}
+	if c, ok := data.Client.(storage.AccessTTLer); ok && c.GetAccessTTL() > 0 {
+		data.ExpiresIn = int32(c.GetAccessTTL())
+	}
+	created := data.CreatedAt
+	if created.IsZero() {
+		created = time.Now()
+	}
+	cid := data.Client.GetId()
+	claims := AccessClaims{
+		Claims: Claims{
+			Issuer:    g.Issuer,
+			Subject:   g.subject(data),
+			Audience:  g.Audience,
+			ExpiresAt: created.Add(time.Duration(data.ExpiresIn) * time.Second).Unix(),
+			IssuedAt:  created.Unix(),
+			ID:        hex.EncodeToString(jti),
+		},
+		ClientID: cid,
+		Scope:    data.Scope,
+	}
+	if len(claims.Audience) == 0 {
+		claims.Audience = Audience{cid}
+	}
+	token, err := Sign(Header{Alg: key.Alg, Kid: key.Kid, Typ: AccessTokenType}, claims, key.Key)
+	if err != nil {
+		return "", "", err
+	}
+	var refresh string
+	if generaterefresh {
+		gen := g.Refresh
+		if gen == nil {
+			gen = &osin.AccessTokenGenDefault{}
+		}
+		if _, refresh, err = gen.GenerateAccessToken(data, true); err != nil {
+			return "", "", err
+		}
+	}
+	return token, refresh, nil
+}
+
+func (g *AccessTokenGen) subject(data *osin.AccessData) string {
+	if g.Subject != nil {
+		return g.Subject(data)
+	}
+	if s, ok := data.UserData.(string); ok && s != "" {
+		return s
+	}
+	return data.Client.GetId()
+}
+
+// signingKey returns the active key, the keys are loaded again after KeysTTL to follow the rotations
+func (g *AccessTokenGen) signingKey() (*SigningKey, error) {
+	ttl := g.KeysTTL
+	if ttl == 0 {
+		ttl = DefaultKeysTTL
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.keys == nil || time.Since(g.loaded) >= ttl {
+		keys, err := g.Keys.SigningKeys()
+		if err != nil {
+			return nil, err
+		}
+		g.keys, g.loaded = keys, time.Now()
+	}
+	return ActiveKey(g.keys)
+}
+
+// ParseAccessToken verifies a JWT access token for the resource server audience, with the keys of the issuer,
+// e.g. the JWKS of KeySet.
+func ParseAccessToken(s string, keys *JWKS, issuer, audience string, now time.Time) (*AccessClaims, error) {
+	t, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if t.Header.Typ != AccessTokenType && t.Header.Typ != "application/"+AccessTokenType {
+		return nil, fmt.Errorf("%w: typ %q", ErrInvalidToken, t.Header.Typ)
+	}
+	if err = t.Verify(keys); err != nil {
+		return nil, err
+	}
+	claims := new(AccessClaims)
+	if err = t.UnmarshalClaims(claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if claims.Issuer != issuer || !claims.Audience.Contains(audience) || claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: iss, aud or exp", ErrInvalidToken)
+	}
+	if err = claims.Valid(now, 0); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
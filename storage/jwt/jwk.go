@@ -0,0 +1,114 @@
+// Package jwt signs and verifies the JSON Web Tokens with the keys of a JWKS, with the standard library only:
+// the client assertions of private_key_jwt, and the JWT access tokens of RFC 9068 signed with rotated keys.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// vars
+var (
+	ErrInvalidKey = errors.New("invalid key")
+	ErrUnknownKey = errors.New("unknown key id")
+)
+
+var b64 = base64.RawURLEncoding
+
+// JWK is a public JSON Web Key of RFC 7517, of type RSA, EC or OKP (Ed25519)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Lookup returns the keys of kid, or all keys with an empty kid
+func (s *JWKS) Lookup(kid string) (keys []JWK) {
+	for _, k := range s.Keys {
+		if kid == "" || k.Kid == kid {
+			keys = append(keys, k)
+		}
+	}
+	return
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// PublicKey returns the key as an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil || len(n) < 256 {
+			return nil, fmt.Errorf("%w: RSA modulus of %s", ErrInvalidKey, k.Kid)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: RSA exponent of %s", ErrInvalidKey, k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("%w: curve %q of %s", ErrInvalidKey, k.Crv, k.Kid)
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if err1 != nil || err2 != nil || !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("%w: EC point of %s", ErrInvalidKey, k.Kid)
+		}
+		return pub, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: Ed25519 key of %s", ErrInvalidKey, k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("%w: key type %q of %s", ErrInvalidKey, k.Kty, k.Kid)
+}
+
+// NewJWK returns the JWK of the public key pub, an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func NewJWK(kid, alg string, pub crypto.PublicKey) (JWK, error) {
+	k := JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = b64.EncodeToString(p.N.Bytes())
+		k.E = b64.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		k.Kty, k.Crv = "EC", p.Curve.Params().Name
+		size := (p.Curve.Params().BitSize + 7) / 8
+		k.X = b64.EncodeToString(p.X.FillBytes(make([]byte, size)))
+		k.Y = b64.EncodeToString(p.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		k.Kty, k.Crv = "OKP", "Ed25519"
+		k.X = b64.EncodeToString(p)
+	default:
+		return k, fmt.Errorf("%w: %T", ErrInvalidKey, pub)
+	}
+	return k, nil
+}
@@ -0,0 +1,255 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // the hashes of the algorithms
+	_ "crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// ErrInvalidToken is also a storage.ErrInvalidValue
+var ErrInvalidToken = fmt.Errorf("%w: token", storage.ErrInvalidValue)
+
+// Header of a JWS in compact serialization
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Audience is one or more audiences, a string or an array in JSON
+type Audience []string
+
+// UnmarshalJSON accepts a string or an array of strings
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*a = Audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Contains reports whether aud is one of a
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the registered claims of RFC 7519, the times are in seconds since the epoch
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Valid returns a storage.ErrExpired if the claims are expired or not valid yet at now, with the leeway
+func (c *Claims) Valid(now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt != 0 && time.Unix(c.ExpiresAt, 0).Add(leeway).Before(now) {
+		return fmt.Errorf("%w: token at %s", storage.ErrExpired, time.Unix(c.ExpiresAt, 0))
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("%w: not before %s", ErrInvalidToken, time.Unix(c.NotBefore, 0))
+	}
+	return nil
+}
+
+// Token is a parsed JWS, not verified yet
+type Token struct {
+	Header Header
+	Claims Claims
+
+	payload   []byte
+	signed    string
+	signature []byte
+}
+
+// Parse parses a JWS in compact serialization, its signature is not verified
+func Parse(s string) (*Token, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWS", ErrInvalidToken)
+	}
+	t := &Token{signed: parts[0] + "." + parts[1]}
+	header, err := b64.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(header, &t.Header)
+	}
+	if err == nil {
+		if t.payload, err = b64.DecodeString(parts[1]); err == nil {
+			err = json.Unmarshal(t.payload, &t.Claims)
+		}
+	}
+	if err == nil {
+		t.signature, err = b64.DecodeString(parts[2])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	return t, nil
+}
+
+// UnmarshalClaims decodes the payload into v, for the claims other than the registered ones
+func (t *Token) UnmarshalClaims(v interface{}) error {
+	return json.Unmarshal(t.payload, v)
+}
+
+// Verify verifies the signature with the keys of the kid of the header, or with any key without one
+func (t *Token) Verify(keys *JWKS) error {
+	candidates := keys.Lookup(t.Header.Kid)
+	if len(candidates) == 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, t.Header.Kid)
+	}
+	var err error
+	for _, k := range candidates {
+		if k.Alg != "" && k.Alg != t.Header.Alg {
+			continue
+		}
+		var pub crypto.PublicKey
+		if pub, err = k.PublicKey(); err != nil {
+			continue
+		}
+		if err = verify(t.Header.Alg, pub, []byte(t.signed), t.signature); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: no key of alg %s", ErrInvalidToken, t.Header.Alg)
+	}
+	return err
+}
+
+var hashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// ecBits are the curves of the ECDSA algorithms
+var ecBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+var errSignature = fmt.Errorf("%w: bad signature", ErrInvalidToken)
+
+// verify verifies the signature of the asymmetric algorithms only, "none" and HMAC are rejected
+func verify(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		if k, ok := pub.(ed25519.PublicKey); ok && ed25519.Verify(k, signed, sig) {
+			return nil
+		}
+		return errSignature
+	}
+	h, ok := hashes[alg]
+	if !ok {
+		return fmt.Errorf("%w: alg %q", ErrInvalidToken, alg)
+	}
+	hh := h.New()
+	hh.Write(signed)
+	digest := hh.Sum(nil)
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(k, h, digest, sig)
+		case 'P':
+			err = rsa.VerifyPSS(k, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			err = errors.New("not an RSA alg")
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errSignature, err)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || k.Curve.Params().BitSize != ecBits[alg] || len(sig) != 2*size {
+			return errSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if ecdsa.Verify(k, digest, r, s) {
+			return nil
+		}
+	}
+	return errSignature
+}
+
+// Sign returns the JWS of the claims in compact serialization, signed by key with the alg of h,
+// key is an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+func Sign(h Header, claims interface{}, key crypto.Signer) (string, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sig, err := sign(h.Alg, key, []byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + b64.EncodeToString(sig), nil
+}
+
+func sign(alg string, key crypto.Signer, signed []byte) ([]byte, error) {
+	if alg == "EdDSA" {
+		if k, ok := key.(ed25519.PrivateKey); ok {
+			return ed25519.Sign(k, signed), nil
+		}
+		return nil, fmt.Errorf("%w: %T for %s", ErrInvalidKey, key, alg)
+	}
+	h, ok := hashes[alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: alg %q", ErrInvalidToken, alg)
+	}
+	hh := h.New()
+	hh.Write(signed)
+	digest := hh.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch alg[0] {
+		case 'R':
+			return rsa.SignPKCS1v15(rand.Reader, k, h, digest)
+		case 'P':
+			return rsa.SignPSS(rand.Reader, k, h, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PrivateKey:
+		if alg[0] != 'E' || k.Curve.Params().BitSize != ecBits[alg] {
+			break
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	}
+	return nil, fmt.Errorf("%w: %T for %s", ErrInvalidKey, key, alg)
+}
@@ -0,0 +1,226 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+func TestSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		alg string
+		key crypto.Signer
+	}{
+		{"RS256", rsaKey},
+		{"PS256", rsaKey},
+		{"ES256", ecKey},
+		{"EdDSA", edKey},
+	} {
+		jwk, err := NewJWK(tc.alg, tc.alg, tc.key.Public())
+		require.Nil(t, err, tc.alg)
+		b, err := json.Marshal(JWKS{Keys: []JWK{jwk}})
+		require.Nil(t, err)
+		keys := new(JWKS)
+		require.Nil(t, json.Unmarshal(b, keys))
+
+		s, err := Sign(Header{Alg: tc.alg, Kid: tc.alg}, Claims{Issuer: "rp", Audience: Audience{"as"}}, tc.key)
+		require.Nil(t, err, tc.alg)
+		tok, err := Parse(s)
+		require.Nil(t, err)
+		assert.Equal(t, "rp", tok.Claims.Issuer)
+		assert.Nil(t, tok.Verify(keys), tc.alg)
+
+		// a tampered payload or an unknown kid
+		parts := strings.Split(s, ".")
+		other, _ := json.Marshal(Claims{Issuer: "evil"})
+		tok, err = Parse(parts[0] + "." + b64.EncodeToString(other) + "." + parts[2])
+		require.Nil(t, err)
+		assert.ErrorIs(t, tok.Verify(keys), ErrInvalidToken, tc.alg)
+		tok.Header.Kid = "other"
+		assert.ErrorIs(t, tok.Verify(keys), ErrUnknownKey)
+	}
+
+	// the algorithms without a public key are rejected
+	jwk, _ := NewJWK("", "", ecKey.Public())
+	none := b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{}`)) + "."
+	tok, err := Parse(none)
+	require.Nil(t, err)
+	assert.ErrorIs(t, tok.Verify(&JWKS{Keys: []JWK{jwk}}), ErrInvalidToken)
+
+	_, err = Parse("a.b")
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+}
+
+func TestClaims(t *testing.T) {
+	var c Claims
+	require.Nil(t, json.Unmarshal([]byte(`{"aud":"as"}`), &c))
+	assert.True(t, c.Audience.Contains("as"))
+	require.Nil(t, json.Unmarshal([]byte(`{"aud":["as","rs"]}`), &c))
+	assert.True(t, c.Audience.Contains("rs"))
+	assert.False(t, c.Audience.Contains("other"))
+
+	now := time.Now()
+	c = Claims{ExpiresAt: now.Add(-time.Second).Unix()}
+	assert.ErrorIs(t, c.Valid(now, 0), storage.ErrExpired)
+	assert.Nil(t, c.Valid(now, time.Minute))
+	c = Claims{NotBefore: now.Add(time.Minute).Unix()}
+	assert.ErrorIs(t, c.Valid(now, 0), ErrInvalidToken)
+	assert.Nil(t, c.Valid(now, 2*time.Minute))
+}
+
+func TestPublicKey(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	jwk, err := NewJWK("small", "RS256", small.Public())
+	require.Nil(t, err)
+	_, err = jwk.PublicKey()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	_, err = JWK{Kty: "EC", Crv: "P-256", X: "AA", Y: "AA"}.PublicKey()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = JWK{Kty: "oct"}.PublicKey()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+type memoryKeys map[string]SigningKey
+
+func (m memoryKeys) SigningKeys() (keys []SigningKey, err error) {
+	for _, k := range m {
+		keys = append(keys, k)
+	}
+	return
+}
+
+func (m memoryKeys) SaveSigningKey(k *SigningKey) error {
+	m[k.Kid] = *k
+	return nil
+}
+
+func (m memoryKeys) RemoveSigningKey(kid string) error {
+	delete(m, kid)
+	return nil
+}
+
+func (m memoryKeys) states() map[KeyState]int {
+	n := make(map[KeyState]int)
+	for _, k := range m {
+		n[k.State]++
+	}
+	return n
+}
+
+func TestRotate(t *testing.T) {
+	ks := memoryKeys{}
+	require.Nil(t, Rotate(ks, "ES256", time.Hour))
+	assert.Equal(t, map[KeyState]int{KeyActive: 1, KeyNext: 1}, ks.states())
+	keys, _ := ks.SigningKeys()
+	first, err := ActiveKey(keys)
+	require.Nil(t, err)
+
+	// the next key signs, the active one is retired and still published
+	require.Nil(t, Rotate(ks, "ES256", time.Hour))
+	assert.Equal(t, map[KeyState]int{KeyActive: 1, KeyNext: 1, KeyRetired: 1}, ks.states())
+	assert.Equal(t, KeyRetired, ks[first.Kid].State)
+	set, err := KeySet(ks)
+	require.Nil(t, err)
+	assert.Len(t, set.Keys, 3)
+	assert.NotEmpty(t, set.Lookup(first.Kid))
+
+	// removed after retain
+	require.Nil(t, Rotate(ks, "ES256", 0))
+	assert.Equal(t, map[KeyState]int{KeyActive: 1, KeyNext: 1, KeyRetired: 1}, ks.states())
+	assert.NotContains(t, ks, first.Kid)
+}
+
+func TestAccessTokenGen(t *testing.T) {
+	ks := memoryKeys{}
+	require.Nil(t, Rotate(ks, "RS256", time.Hour))
+	gen := &AccessTokenGen{Keys: ks, Issuer: "https://as.example.com", Audience: []string{"https://api.example.com"}}
+	data := &osin.AccessData{
+		Client:    &osin.DefaultClient{Id: "rp"},
+		ExpiresIn: 3600,
+		Scope:     "read write",
+		CreatedAt: time.Now(),
+		UserData:  "alice",
+	}
+	token, refresh, err := gen.GenerateAccessToken(data, true)
+	require.Nil(t, err)
+	assert.Greater(t, len(token), storage.MaxTokenLen)
+	assert.NotEmpty(t, refresh)
+	assert.NotContains(t, refresh, ".")
+
+	set, err := KeySet(ks)
+	require.Nil(t, err)
+	claims, err := ParseAccessToken(token, set, "https://as.example.com", "https://api.example.com", time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "rp", claims.ClientID)
+	assert.Equal(t, "read write", claims.Scope)
+	assert.Equal(t, data.CreatedAt.Add(time.Hour).Unix(), claims.ExpiresAt)
+	assert.NotEmpty(t, claims.ID)
+
+	_, err = ParseAccessToken(token, set, "https://as.example.com", "https://other.example.com", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = ParseAccessToken(token, set, "https://as.example.com", "https://api.example.com", time.Now().Add(2*time.Hour))
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	// a client credentials token is of the client, without refresh
+	data.UserData = nil
+	token, refresh, err = gen.GenerateAccessToken(data, false)
+	require.Nil(t, err)
+	assert.Empty(t, refresh)
+	claims, err = ParseAccessToken(token, set, "https://as.example.com", "https://api.example.com", time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, "rp", claims.Subject)
+}
+
+type ttlClient struct {
+	osin.DefaultClient
+	ttl int
+}
+
+func (c *ttlClient) GetAccessTTL() int { return c.ttl }
+
+func TestAccessTokenGenClientTTL(t *testing.T) {
+	ks := memoryKeys{}
+	require.Nil(t, Rotate(ks, "ES256", time.Hour))
+	gen := &AccessTokenGen{Keys: ks, Issuer: "https://as.example.com"}
+	data := &osin.AccessData{Client: &ttlClient{osin.DefaultClient{Id: "short"}, 300}, ExpiresIn: 3600, CreatedAt: time.Now()}
+	token, _, err := gen.GenerateAccessToken(data, false)
+	require.Nil(t, err)
+	// the exp and the expires_in returned and saved are of the client
+	assert.Equal(t, int32(300), data.ExpiresIn)
+	set, _ := KeySet(ks)
+	claims, err := ParseAccessToken(token, set, "https://as.example.com", "short", time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, data.CreatedAt.Add(300*time.Second).Unix(), claims.ExpiresAt)
+
+	// the default of the server without one
+	data = &osin.AccessData{Client: &ttlClient{osin.DefaultClient{Id: "default"}, 0}, ExpiresIn: 3600, CreatedAt: time.Now()}
+	token, _, err = gen.GenerateAccessToken(data, false)
+	require.Nil(t, err)
+	assert.Equal(t, int32(3600), data.ExpiresIn)
+	claims, err = ParseAccessToken(token, set, "https://as.example.com", "default", time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, data.CreatedAt.Add(time.Hour).Unix(), claims.ExpiresAt)
+}
@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// KeyState is the state of a signing key in its rotation
+type KeyState string
+
+// states of the signing keys: the next key is published before it signs, the active key signs,
+// a retired key is published until the tokens it signed expire
+const (
+	KeyNext    KeyState = "next"
+	KeyActive  KeyState = "active"
+	KeyRetired KeyState = "retired"
+)
+
+// SigningKey is a private key of the server signing the access tokens
+type SigningKey struct {
+	Kid     string
+	Alg     string
+	State   KeyState
+	Key     crypto.Signer
+	Created time.Time
+	Updated time.Time // when the state is changed
+}
+
+// JWK returns the public key of k
+func (k *SigningKey) JWK() (JWK, error) {
+	return NewJWK(k.Kid, k.Alg, k.Key.Public())
+}
+
+// KeyStore saves the signing keys, e.g. sqlstore with the oauth.signing_key table
+type KeyStore interface {
+	// SigningKeys returns all keys, the newest first
+	SigningKeys() ([]SigningKey, error)
+	// SaveSigningKey inserts or updates the key by kid
+	SaveSigningKey(k *SigningKey) error
+	// RemoveSigningKey removes the key by kid
+	RemoveSigningKey(kid string) error
+}
+
+// GenerateKey returns a new private key for alg: RSA of 2048 bits, ECDSA of the curve of alg, or Ed25519
+func GenerateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("%w: alg %q", ErrInvalidKey, alg)
+}
+
+// NewSigningKey generates a key of alg in state, with a random kid
+func NewSigningKey(alg string, state KeyState) (*SigningKey, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &SigningKey{Kid: hex.EncodeToString(b), Alg: alg, State: state, Key: key, Created: now, Updated: now}, nil
+}
+
+// ActiveKey returns the active key of keys, the newest if more
+func ActiveKey(keys []SigningKey) (*SigningKey, error) {
+	var active *SigningKey
+	for i := range keys {
+		if k := &keys[i]; k.State == KeyActive && (active == nil || k.Updated.After(active.Updated)) {
+			active = k
+		}
+	}
+	if active == nil {
+		return nil, fmt.Errorf("%w: no active signing key", ErrUnknownKey)
+	}
+	return active, nil
+}
+
+// PublicKeys returns the JWKS of keys, all states are published
+func PublicKeys(keys []SigningKey) (*JWKS, error) {
+	sorted := append([]SigningKey(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Created.After(sorted[j].Created) })
+	set := &JWKS{Keys: make([]JWK, 0, len(sorted))}
+	for i := range sorted {
+		jwk, err := sorted[i].JWK()
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// KeySet returns the JWKS document of the keys of ks, published at the jwks_uri of the server
+func KeySet(ks KeyStore) (*JWKS, error) {
+	keys, err := ks.SigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	return PublicKeys(keys)
+}
+
+// Rotate promotes the next key of ks to active, retires the active one and saves a new next key of alg.
+// Without a next key, an active key is generated. The keys retired longer than retain ago are removed,
+// retain is the lifetime of the access tokens at least.
+// A key is active at any time, and the next key is published a rotation before it signs.
+func Rotate(ks KeyStore, alg string, retain time.Duration) error {
+	keys, err := ks.SigningKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var active *SigningKey
+	for i := range keys {
+		if k := &keys[i]; k.State == KeyNext && (active == nil || k.Created.After(active.Created)) {
+			active = k
+		}
+	}
+	if active == nil {
+		if active, err = NewSigningKey(alg, KeyActive); err != nil {
+			return err
+		}
+	}
+	active.State, active.Updated = KeyActive, now
+	if err = ks.SaveSigningKey(active); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		k := &keys[i]
+		switch {
+		case k.Kid == active.Kid || k.State == KeyNext:
+		case k.State == KeyActive:
+			k.State, k.Updated = KeyRetired, now
+			err = ks.SaveSigningKey(k)
+		case now.Sub(k.Updated) > retain:
+			err = ks.RemoveSigningKey(k.Kid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	next, err := NewSigningKey(alg, KeyNext)
+	if err != nil {
+		return err
+	}
+	return ks.SaveSigningKey(next)
+}
@@ -0,0 +1,108 @@
+// Package logging holds the structured logging conventions of the storages:
+// the attribute keys, and a slog.Handler redacting tokens, codes and secrets.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// attribute keys of the storages
+const (
+	KeyStore    = "store"
+	KeyOp       = "op"
+	KeyClientID = "client_id"
+	KeyCode     = "code"
+	KeyToken    = "token"
+	KeySecret   = "secret"
+	KeyErr      = "err"
+)
+
+// Redacted replaces the value of a secret
+const Redacted = "[REDACTED]"
+
+// hashed are the keys of codes and tokens, logged as storage.TokenHash
+var hashed = map[string]bool{
+	KeyCode:          true,
+	KeyToken:         true,
+	"access_token":   true,
+	"refresh_token":  true,
+	"authorize_code": true,
+	"previous":       true,
+}
+
+// hidden are the keys of secrets, never logged
+var hidden = map[string]bool{
+	KeySecret:       true,
+	"client_secret": true,
+	"password":      true,
+	"code_verifier": true,
+	"assertion":     true,
+}
+
+// RedactAttr returns a, with the value of a code or token hashed and the value of a secret replaced
+func RedactAttr(a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i := range attrs {
+			redacted[i] = RedactAttr(attrs[i])
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case hidden[key]:
+		return slog.String(a.Key, Redacted)
+	case hashed[key]:
+		return slog.String(a.Key, storage.TokenHash(a.Value.Resolve().String()))
+	}
+	return a
+}
+
+// Redact returns a handler redacting the attributes of the records before h
+func Redact(h slog.Handler) slog.Handler {
+	if r, ok := h.(redactHandler); ok {
+		return r
+	}
+	return redactHandler{h}
+}
+
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(RedactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i := range attrs {
+		redacted[i] = RedactAttr(attrs[i])
+	}
+	return redactHandler{h.next.WithAttrs(redacted)}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.next.WithGroup(name)}
+}
+
+// New returns a logger of the store to h, or to the default handler if h is nil, with redaction
+func New(h slog.Handler, store string) *slog.Logger {
+	if h == nil {
+		h = slog.Default().Handler()
+	}
+	return slog.New(Redact(h)).With(KeyStore, store)
+}
@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), "test")
+	logger = logger.With("refresh_token", "r3fr3sh")
+	logger.Debug("saved", "client_id", "1", "token", "acc3ss", "secret", "s3cr3t",
+		slog.Group("data", "code", "c0de", "password", "passw0rd"))
+
+	out := buf.String()
+	for _, v := range []string{"r3fr3sh", "acc3ss", "s3cr3t", "c0de", "passw0rd"} {
+		assert.NotContains(t, out, v)
+	}
+	assert.Contains(t, out, "store=test")
+	assert.Contains(t, out, "client_id=1")
+	assert.Contains(t, out, "token="+storage.TokenHash("acc3ss"))
+	assert.Contains(t, out, "data.code="+storage.TokenHash("c0de"))
+	assert.Contains(t, out, "secret="+Redacted)
+
+	buf.Reset()
+	New(slog.NewTextHandler(&buf, nil), "test").Debug("hidden")
+	assert.Empty(t, buf.String(), "level of the handler")
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/cache"
+	"github.com/liut/osin-storage/storage/logging"
+)
+
+// cacheCollector exports the statistics of a cache.Storage when scraped
+type cacheCollector struct {
+	cs        cache.Storage
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	evictions *prometheus.Desc
+	ratio     *prometheus.Desc
+}
+
+func newCacheCollector(ns string, cs cache.Storage) *cacheCollector {
+	return &cacheCollector{
+		cs:        cs,
+		hits:      prometheus.NewDesc(ns+"_cache_hits_total", "Cache hits by kind.", []string{"kind"}, nil),
+		misses:    prometheus.NewDesc(ns+"_cache_misses_total", "Cache misses by kind.", []string{"kind"}, nil),
+		evictions: prometheus.NewDesc(ns+"_cache_evictions_total", "Cache evictions.", nil, nil),
+		ratio:     prometheus.NewDesc(ns+"_cache_hit_ratio", "Cache hits / lookups.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.ratio
+}
+
+// Collect implements prometheus.Collector
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.cs.Stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.ClientHits), "client")
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.AccessHits), "access")
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.ClientMisses), "client")
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.AccessMisses), "access")
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(st.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.ratio, prometheus.GaugeValue, st.HitRatio())
+}
+
+// Poller sets gauges of the active clients, codes and tokens counted by a storage.
+// Counting scans the tables, so it is done periodically by Run rather than on scrape.
+type Poller struct {
+	src    storage.ActiveCounter
+	active *prometheus.GaugeVec
+	log    *slog.Logger
+}
+
+// NewPoller returns a poller of src, its gauges are registered to reg with the namespace ns,
+// empty for "osin_storage"
+func NewPoller(src storage.ActiveCounter, reg prometheus.Registerer, ns string) (*Poller, error) {
+	if ns == "" {
+		ns = "osin_storage"
+	}
+	p := &Poller{
+		src: src,
+		log: logging.New(nil, "metrics"),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "active",
+			Help:      "Clients, codes and tokens not expired, and refresh tokens.",
+		}, []string{"kind"}),
+	}
+	if err := reg.Register(p.active); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WithLogger logs the failed polls to the handler h, default is the handler of slog.Default()
+func (p *Poller) WithLogger(h slog.Handler) *Poller {
+	p.log = logging.New(h, "metrics")
+	return p
+}
+
+// Poll counts once and sets the gauges
+func (p *Poller) Poll() error {
+	c, err := p.src.CountActive()
+	if err != nil {
+		return err
+	}
+	p.active.WithLabelValues("clients").Set(float64(c.Clients))
+	p.active.WithLabelValues("codes").Set(float64(c.Codes))
+	p.active.WithLabelValues("tokens").Set(float64(c.Tokens))
+	p.active.WithLabelValues("refreshes").Set(float64(c.Refreshes))
+	return nil
+}
+
+// Run polls at once and then every interval until ctx is done
+func (p *Poller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Poll(); err != nil {
+			p.log.Error("poll active counts failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package metrics is a Prometheus instrumented decorator for any osin-storage implementation.
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/cache"
+)
+
+// error kinds of the errors counter
+const (
+	KindNotFound = "not_found"
+	KindExpired  = "expired"
+	KindConflict = "conflict"
+	KindInvalid  = "invalid"
+	KindFrozen   = "frozen"
+	KindReused   = "reused"
+	KindError    = "error"
+)
+
+// Options of the metrics
+type Options struct {
+	// Namespace of the metrics, default "osin_storage"
+	Namespace string
+	// Buckets of the latency histogram, default prometheus.DefBuckets
+	Buckets []float64
+	// Classify returns the kind of an error, default DefaultClassify
+	Classify func(err error) string
+}
+
+// DefaultClassify returns the kind of the errors of package storage, others are KindError
+func DefaultClassify(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, sql.ErrNoRows):
+		return KindNotFound
+	case errors.Is(err, storage.ErrExpired):
+		return KindExpired
+	case errors.Is(err, storage.ErrConflict):
+		return KindConflict
+	case errors.Is(err, storage.ErrInvalidValue):
+		return KindInvalid
+	case errors.Is(err, storage.ErrFrozen):
+		return KindFrozen
+	case errors.Is(err, storage.ErrReused):
+		return KindReused
+	}
+	return KindError
+}
+
+type instrumentedStore struct {
+	next     storage.Storage
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	classify func(err error) string
+}
+
+// New wraps next with a latency histogram and an error counter by method,
+// and counters of the cache statistics if next is a cache.Storage.
+// The metrics are registered to reg. The storage implements the optional interfaces of next only.
+func New(next storage.Storage, reg prometheus.Registerer, opts ...Options) (storage.Storage, error) {
+	var opt Options
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Namespace == "" {
+		opt.Namespace = "osin_storage"
+	}
+	if opt.Buckets == nil {
+		opt.Buckets = prometheus.DefBuckets
+	}
+	if opt.Classify == nil {
+		opt.Classify = DefaultClassify
+	}
+	s := &instrumentedStore{
+		next: next,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opt.Namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of storage operations by method.",
+			Buckets:   opt.Buckets,
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opt.Namespace,
+			Name:      "operation_errors_total",
+			Help:      "Errors of storage operations by method and kind.",
+		}, []string{"method", "kind"}),
+		classify: opt.Classify,
+	}
+	collectors := []prometheus.Collector{s.duration, s.errors}
+	if cs, ok := next.(cache.Storage); ok {
+		collectors = append(collectors, newCacheCollector(opt.Namespace, cs))
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return storage.Decorate(s, next), nil
+}
+
+func (s *instrumentedStore) observe(method string, start time.Time, err error) {
+	s.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.errors.WithLabelValues(method, s.classify(err)).Inc()
+	}
+}
+
+// Clone clones the underlying storage, the metrics are shared
+func (s *instrumentedStore) Clone() osin.Storage {
+	next, ok := s.next.Clone().(storage.Storage)
+	if !ok {
+		next = s.next
+	}
+	c := *s
+	c.next = next
+	return storage.Decorate(&c, next)
+}
+
+// Close closes the underlying storage
+func (s *instrumentedStore) Close() {
+	s.next.Close()
+}
+
+// GetClient loads the client by id
+func (s *instrumentedStore) GetClient(id string) (c osin.Client, err error) {
+	defer func(start time.Time) { s.observe("GetClient", start, err) }(time.Now())
+	return s.next.GetClient(id)
+}
+
+// SaveClient saves the client
+func (s *instrumentedStore) SaveClient(c storage.Client) (err error) {
+	defer func(start time.Time) { s.observe("SaveClient", start, err) }(time.Now())
+	return s.next.SaveClient(c)
+}
+
+// UpdateClient updates the client of version, see storage.ClientUpdater
+func (s *instrumentedStore) UpdateClient(c storage.Client, version int) (err error) {
+	defer func(start time.Time) { s.observe("UpdateClient", start, err) }(time.Now())
+	u, ok := s.next.(storage.ClientUpdater)
+	if !ok {
+		return fmt.Errorf("%w: %T updates no client by version", storage.ErrInvalidValue, s.next)
+	}
+	return u.UpdateClient(c, version)
+}
+
+// RemoveClient removes the client
+func (s *instrumentedStore) RemoveClient(id string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveClient", start, err) }(time.Now())
+	return s.next.RemoveClient(id)
+}
+
+// SaveAuthorize saves authorize data
+func (s *instrumentedStore) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	defer func(start time.Time) { s.observe("SaveAuthorize", start, err) }(time.Now())
+	return s.next.SaveAuthorize(data)
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *instrumentedStore) LoadAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	defer func(start time.Time) { s.observe("LoadAuthorize", start, err) }(time.Now())
+	return s.next.LoadAuthorize(code)
+}
+
+// ConsumeAuthorize consumes the code, see storage.AuthorizeConsumer
+func (s *instrumentedStore) ConsumeAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	defer func(start time.Time) { s.observe("ConsumeAuthorize", start, err) }(time.Now())
+	c, ok := s.next.(storage.AuthorizeConsumer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T consumes no code", storage.ErrInvalidValue, s.next)
+	}
+	return c.ConsumeAuthorize(code)
+}
+
+// RemoveAuthorize removes the code
+func (s *instrumentedStore) RemoveAuthorize(code string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveAuthorize", start, err) }(time.Now())
+	return s.next.RemoveAuthorize(code)
+}
+
+// SaveAccess writes AccessData
+func (s *instrumentedStore) SaveAccess(data *osin.AccessData) (err error) {
+	defer func(start time.Time) { s.observe("SaveAccess", start, err) }(time.Now())
+	return s.next.SaveAccess(data)
+}
+
+// LoadAccess retrieves access data by token
+func (s *instrumentedStore) LoadAccess(token string) (a *osin.AccessData, err error) {
+	defer func(start time.Time) { s.observe("LoadAccess", start, err) }(time.Now())
+	return s.next.LoadAccess(token)
+}
+
+// RemoveAccess revokes the token
+func (s *instrumentedStore) RemoveAccess(token string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveAccess", start, err) }(time.Now())
+	return s.next.RemoveAccess(token)
+}
+
+// LoadRefresh retrieves refresh AccessData
+func (s *instrumentedStore) LoadRefresh(token string) (a *osin.AccessData, err error) {
+	defer func(start time.Time) { s.observe("LoadRefresh", start, err) }(time.Now())
+	return s.next.LoadRefresh(token)
+}
+
+// RemoveRefresh revokes the refresh token
+func (s *instrumentedStore) RemoveRefresh(token string) (err error) {
+	defer func(start time.Time) { s.observe("RemoveRefresh", start, err) }(time.Now())
+	return s.next.RemoveRefresh(token)
+}
+
+// SaveJTI records the jti of issuer, see storage.ReplayCache
+func (s *instrumentedStore) SaveJTI(issuer, jti string, exp time.Time) (err error) {
+	defer func(start time.Time) { s.observe("SaveJTI", start, err) }(time.Now())
+	r, ok := s.next.(storage.ReplayCache)
+	if !ok {
+		return fmt.Errorf("%w: %T saves no jti", storage.ErrInvalidValue, s.next)
+	}
+	return r.SaveJTI(issuer, jti, exp)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/bolt"
+	"github.com/liut/osin-storage/storage/cache"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+func newBolt(t *testing.T) *bolt.Store {
+	bs, err := bolt.Open(filepath.Join(t.TempDir(), "oauth.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { bs.DB().Close() })
+	return bs
+}
+
+func TestInstrumented(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	store, err := New(cache.New(oauth.AsStorage(newBolt(t)), 10, time.Minute), reg)
+	require.Nil(t, err)
+
+	client := oauth.NewClient("1", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	_, err = store.GetClient("1")
+	require.Nil(t, err)
+	_, err = store.GetClient("1")
+	require.Nil(t, err)
+	_, err = store.LoadAccess("none")
+	require.NotNil(t, err)
+	assert.NotNil(t, store.SaveClient(oauth.NewClient("", "", "")))
+
+	// the optional interfaces of the cached bolt storage only
+	_, ok := store.(storage.AuthorizeConsumer)
+	assert.False(t, ok)
+	_, ok = store.Clone().(storage.ReplayCache)
+	assert.False(t, ok)
+	u, ok := store.Clone().(storage.ClientUpdater)
+	require.True(t, ok)
+	assert.ErrorIs(t, u.UpdateClient(client, 0), storage.ErrConflict)
+
+	s := store.(struct {
+		storage.Storage
+		storage.ClientUpdater
+	}).Storage.(*instrumentedStore)
+	assert.Equal(t, 4, testutil.CollectAndCount(s.duration)) // methods called
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.errors.WithLabelValues("UpdateClient", KindConflict)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.errors.WithLabelValues("LoadAccess", KindNotFound)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.errors.WithLabelValues("SaveClient", KindInvalid)))
+
+	n, err := testutil.GatherAndCount(reg, "osin_storage_cache_hits_total", "osin_storage_cache_hit_ratio")
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = New(store, reg)
+	assert.NotNil(t, err, "registered twice")
+}
+
+func TestPoller(t *testing.T) {
+	bs := newBolt(t)
+	client := oauth.NewClient("1", "secret", "http://localhost/")
+	require.Nil(t, bs.SaveClient(client))
+	require.Nil(t, bs.SaveAccess(&osin.AccessData{Client: client, AccessToken: "a", RefreshToken: "r",
+		ExpiresIn: 60, CreatedAt: time.Now()}))
+	require.Nil(t, bs.SaveAccess(&osin.AccessData{Client: client, AccessToken: "b",
+		ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)}))
+
+	reg := prometheus.NewRegistry()
+	p, err := NewPoller(bs, reg, "")
+	require.Nil(t, err)
+	require.Nil(t, p.Poll())
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.active.WithLabelValues("clients")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.active.WithLabelValues("tokens")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.active.WithLabelValues("refreshes")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.active.WithLabelValues("codes")))
+}
+
+type failingCounter struct{}
+
+func (failingCounter) CountActive() (storage.Counts, error) {
+	return storage.Counts{}, errors.New("db down")
+}
+
+func TestPollerLogger(t *testing.T) {
+	var buf bytes.Buffer
+	p, err := NewPoller(failingCounter{}, prometheus.NewRegistry(), "")
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.WithLogger(slog.NewTextHandler(&buf, nil)).Run(ctx, time.Minute)
+	assert.Contains(t, buf.String(), "poll active counts failed")
+	assert.Contains(t, buf.String(), "store=metrics")
+	assert.Contains(t, buf.String(), "db down")
+}
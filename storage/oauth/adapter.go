@@ -0,0 +1,30 @@
+package oauth
+
+import (
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// AsStorage adapts a Store to storage.Storage, with the optional interfaces of package storage implemented by s,
+// a Store can not be one directly, as SaveClient takes a *Client there.
+func AsStorage(s Store) storage.Storage {
+	return storage.Extend(&storeAdapter{s}, storage.OptionalOf(s))
+}
+
+type storeAdapter struct {
+	Store
+}
+
+// Clone clones the underlying store and adapts it again
+func (a *storeAdapter) Clone() osin.Storage {
+	if s, ok := a.Store.Clone().(Store); ok {
+		return AsStorage(s)
+	}
+	return a
+}
+
+// SaveClient storage.Storage
+func (a *storeAdapter) SaveClient(client storage.Client) error {
+	return a.Store.SaveClient(ClientOf(client))
+}
@@ -3,12 +3,18 @@ package oauth
 import (
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/liut/osin-storage/storage"
 )
 
-var _ storage.Client = (*Client)(nil)
+var (
+	_ storage.Client         = (*Client)(nil)
+	_ storage.AccessTTLer    = (*Client)(nil)
+	_ storage.RefreshPolicer = (*Client)(nil)
+)
 
 // Client of oauth2
 type Client struct {
@@ -17,6 +23,8 @@ type Client struct {
 	RedirectURI string     `json:"redirectURI" db:"redirect_uri" `
 	Meta        ClientMeta `json:"meta,omitempty" db:"meta" `       // jsonb
 	CreatedAt   time.Time  `json:"created,omitempty" db:"created" ` // time.Now()
+	Version     int        `json:"version,omitempty" db:"version"`  // incremented by every update
+	UpdatedAt   time.Time  `json:"updated,omitempty" db:"updated"`
 }
 
 func (c *Client) String() string {
@@ -48,6 +56,29 @@ func (c *Client) GetName() string {
 	return c.Meta.Name
 }
 
+// GetVersion storage.Versioned
+func (c *Client) GetVersion() int {
+	return c.Version
+}
+
+// ETag returns the version as an entity tag of HTTP, e.g. "3"
+func (c *Client) ETag() string {
+	return strconv.Quote(strconv.Itoa(c.Version))
+}
+
+// ParseETag returns the version of an entity tag of ETag, e.g. of the If-Match header, weak or not
+func ParseETag(tag string) (int, error) {
+	s, err := strconv.Unquote(strings.TrimPrefix(strings.TrimSpace(tag), "W/"))
+	if err != nil {
+		return 0, fmt.Errorf("%w: etag %q", storage.ErrInvalidValue, tag)
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: etag %q", storage.ErrInvalidValue, tag)
+	}
+	return v, nil
+}
+
 // GetGrantTypes ...
 func (c *Client) GetGrantTypes() []string {
 	return c.Meta.GrantTypes
@@ -63,6 +94,47 @@ func (c *Client) GetScopes() []string {
 	return c.Meta.Scopes
 }
 
+// GetAccessTTL storage.AccessTTLer
+func (c *Client) GetAccessTTL() int {
+	return c.Meta.AccessTTL
+}
+
+// GetRefreshPolicy storage.RefreshPolicer
+func (c *Client) GetRefreshPolicy() storage.RefreshPolicy {
+	return storage.RefreshPolicy{
+		TTL:         time.Duration(c.Meta.RefreshTTL) * time.Second,
+		Idle:        time.Duration(c.Meta.RefreshIdle) * time.Second,
+		MaxLifetime: time.Duration(c.Meta.RefreshMaxLifetime) * time.Second,
+	}
+}
+
+// Validate returns an ErrInvalidClient if the client has no id or redirect URI,
+// a public client has a secret, a client authenticating with a secret has none,
+// or a client of private_key_jwt has no keys.
+func (c *Client) Validate() error {
+	if c.ID == "" || c.RedirectURI == "" {
+		return storage.ErrInvalidClient
+	}
+	switch m := c.Meta.TokenEndpointAuthMethod; m {
+	case AuthNone:
+		if c.Secret != "" {
+			return fmt.Errorf("%w: public client %s has a secret", storage.ErrInvalidClient, c.ID)
+		}
+	case "", AuthClientSecretBasic, AuthClientSecretPost:
+		if c.Secret == "" {
+			return fmt.Errorf("%w: client %s has no secret", storage.ErrInvalidClient, c.ID)
+		}
+	case AuthPrivateKeyJWT:
+		if c.Meta.JWKS == nil && c.Meta.JWKSURI == "" {
+			return fmt.Errorf("%w: client %s has no jwks or jwks_uri", storage.ErrInvalidClient, c.ID)
+		}
+	case AuthTLSClientAuth:
+	default:
+		return fmt.Errorf("%w: token_endpoint_auth_method %q", storage.ErrInvalidClient, m)
+	}
+	return nil
+}
+
 // CopyFrom ...
 func (c *Client) CopyFrom(other storage.Client) {
 	c.ID = other.GetId()
@@ -77,6 +149,16 @@ func (c *Client) CopyFrom(other storage.Client) {
 	}
 }
 
+// ClientOf returns c if it is a *Client, or a copy of it
+func ClientOf(c storage.Client) *Client {
+	if o, ok := c.(*Client); ok {
+		return o
+	}
+	o := new(Client)
+	o.CopyFrom(c)
+	return o
+}
+
 // NewClient build a client
 func NewClient(id, secret, redirectURI string) (c *Client) {
 	c = &Client{
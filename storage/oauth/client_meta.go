@@ -2,7 +2,17 @@ package oauth
 
 import (
 	"database/sql/driver"
-	"encoding/json"
+
+	"github.com/liut/osin-storage/storage/jwt"
+)
+
+// the token_endpoint_auth_method of the clients, see RFC 7591
+const (
+	AuthNone              = "none" // the public clients, without a secret
+	AuthClientSecretBasic = "client_secret_basic"
+	AuthClientSecretPost  = "client_secret_post"
+	AuthPrivateKeyJWT     = "private_key_jwt"
+	AuthTLSClientAuth     = "tls_client_auth"
 )
 
 var (
@@ -23,6 +33,29 @@ type ClientMeta struct {
 	GrantTypes    []string `json:"grant_types,omitempty"`    // AllowedGrantTypes
 	ResponseTypes []string `json:"response_types,omitempty"` // AllowedResponseTypes
 	Scopes        []string `json:"scopes,omitempty"`         // AllowedScopes
+
+	// the lifetime of the refresh tokens in seconds, over the default of the storage
+	RefreshTTL         int `json:"refresh_ttl,omitempty"`
+	RefreshIdle        int `json:"refresh_idle,omitempty"`
+	RefreshMaxLifetime int `json:"refresh_max_lifetime,omitempty"`
+
+	// the settings over the osin.ServerConfig, applied with WithClientSettings
+	AccessTTL    int  `json:"access_ttl,omitempty"`    // seconds
+	CodeTTL      int  `json:"code_ttl,omitempty"`      // seconds
+	RefreshReuse bool `json:"refresh_reuse,omitempty"` // keeps the refresh token on refresh instead of rotating it
+	PKCERequired bool `json:"pkce_required,omitempty"`
+	SkipConsent  bool `json:"skip_consent,omitempty"` // for the first party apps
+
+	// TokenEndpointAuthMethod is how the client authenticates, one of Auth*, empty as client_secret_basic
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"`
+	// the public keys of private_key_jwt, by value or by reference
+	JWKS    *jwt.JWKS `json:"jwks,omitempty"`
+	JWKSURI string    `json:"jwks_uri,omitempty"`
+}
+
+// IsPublic reports whether the client authenticates with no secret, as the native apps and SPAs
+func (m ClientMeta) IsPublic() bool {
+	return m.TokenEndpointAuthMethod == AuthNone
 }
 
 // Scan implements the sql.Scanner interface.
@@ -31,14 +64,15 @@ func (m *ClientMeta) Scan(value interface{}) (err error) {
 	case ClientMeta:
 		*m = data
 	case []byte:
-		err = json.Unmarshal(data, m)
+		err = UnmarshalSealed(data, m)
 	case string:
-		err = json.Unmarshal([]byte(data), m)
+		err = UnmarshalSealed([]byte(data), m)
 	}
 	return
 }
 
-// Value implements the driver.Valuer interface.
+// Value implements the driver.Valuer interface, JSON is valued as text,
+// sealed if a keyring is set.
 func (m ClientMeta) Value() (driver.Value, error) {
-	return json.Marshal(m)
+	return sealedValue(m)
 }
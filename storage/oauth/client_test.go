@@ -3,7 +3,11 @@ package oauth
 import (
 	"testing"
 
+	"github.com/openshift/osin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
 )
 
 func TestClient(t *testing.T) {
@@ -29,3 +33,161 @@ func TestJSONKV(t *testing.T) {
 	m := JSONKV{"name": "eagle"}
 	assert.Equal(t, m.WithKey("name"), "eagle")
 }
+
+func testKeyring(t *testing.T, primary string) *Keyring {
+	k, err := NewKeyring(primary, map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+		"k2": []byte("fedcba9876543210fedcba9876543210"),
+	})
+	assert.Nil(t, err)
+	return k
+}
+
+func TestKeyring(t *testing.T) {
+	_, err := NewKeyring("k3", map[string][]byte{"k1": []byte("0123456789abcdef")})
+	assert.Equal(t, ErrUnknownKey, err)
+	_, err = NewKeyring("k1", map[string][]byte{"k1": []byte("short")})
+	assert.Equal(t, ErrInvalidKey, err)
+
+	k1 := testKeyring(t, "k1")
+	plain := []byte(`{"name":"eagle"}`)
+	data, err := k1.Seal(plain)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "eagle")
+	out, err := k1.Open(data)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, out)
+
+	out, err = k1.Open(plain)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, out)
+
+	// rotate to k2
+	k2 := testKeyring(t, "k2")
+	resealed, changed, err := k2.Reseal(data)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	_, changed, err = k2.Reseal(resealed)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	out, err = k1.Open(resealed)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, out)
+
+	only1, err := NewKeyring("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")})
+	assert.Nil(t, err)
+	_, err = only1.Open(resealed)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	resealed[len(resealed)-10]++ // in the tag
+	_, err = k2.Open(resealed)
+	assert.NotNil(t, err)
+}
+
+func TestSealedValue(t *testing.T) {
+	m := JSONKV{"name": "eagle"}
+	v, err := m.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"eagle"}`, v)
+
+	SetKeyring(testKeyring(t, "k1"))
+	v, err = m.Value()
+	assert.Nil(t, err)
+	assert.NotContains(t, v, "eagle")
+
+	var got JSONKV
+	assert.Nil(t, got.Scan(v))
+	assert.Equal(t, m, got)
+
+	meta := defaultClientMeta
+	mv, err := meta.Value()
+	assert.Nil(t, err)
+	var gotMeta ClientMeta
+	assert.Nil(t, gotMeta.Scan([]byte(mv.(string))))
+	assert.Equal(t, meta, gotMeta)
+
+	SetKeyring(nil)
+	assert.Equal(t, ErrNoKeyring, got.Scan(v))
+	assert.Nil(t, got.Scan(`{"name":"hawk"}`))
+	assert.Equal(t, "hawk", got.WithKey("name"))
+}
+
+func TestClientETag(t *testing.T) {
+	c := &Client{Version: 3}
+	assert.Equal(t, `"3"`, c.ETag())
+	for _, tag := range []string{c.ETag(), `W/"3"`, ` "3" `} {
+		v, err := ParseETag(tag)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, v)
+	}
+	_, err := ParseETag("3")
+	assert.ErrorIs(t, err, storage.ErrInvalidValue)
+}
+
+func TestDiffClients(t *testing.T) {
+	a := &Client{ID: "c", Secret: "s1", RedirectURI: "http://a", Meta: ClientMeta{Name: "eagle", Scopes: []string{"basic"}}}
+	b := &Client{ID: "c", Secret: "s2", RedirectURI: "http://a", Meta: ClientMeta{Name: "eagle", GrantTypes: []string{"password"}}}
+	changes := DiffClients(a, b)
+	require.Len(t, changes, 3)
+	assert.Equal(t, ClientChange{Field: "secret"}, changes[0])
+	assert.Equal(t, "meta.grant_types", changes[1].Field)
+	assert.Nil(t, changes[1].From)
+	assert.Equal(t, []interface{}{"password"}, changes[1].To)
+	assert.Equal(t, ClientChange{Field: "meta.scopes", From: []interface{}{"basic"}}, changes[2])
+
+	assert.Empty(t, DiffClients(a, a))
+}
+
+func TestClientSettings(t *testing.T) {
+	c := NewClient("settings", "secret", "http://localhost")
+	c.Meta.CodeTTL = 60
+	c.Meta.AccessTTL = 600
+	c.Meta.PKCERequired = true
+	c.Meta.RefreshReuse = true
+	c.Meta.SkipConsent = true
+	assert.True(t, SkipsConsent(c))
+	assert.False(t, SkipsConsent(&osin.DefaultClient{Id: "other"}))
+
+	a := &osin.AuthorizeData{Client: c, Code: "code", ExpiresIn: 250}
+	assert.ErrorIs(t, ApplyAuthorize(a), storage.ErrInvalidValue)
+	a.CodeChallenge = "challenge"
+	require.Nil(t, ApplyAuthorize(a))
+	assert.Equal(t, int32(60), a.ExpiresIn)
+
+	prev := &osin.AccessData{Client: c, AccessToken: "a1", RefreshToken: "r1"}
+	access := &osin.AccessData{Client: c, AccessData: prev, AccessToken: "a2", RefreshToken: "r2", ExpiresIn: 3600}
+	require.Nil(t, ApplyAccess(access))
+	assert.Equal(t, int32(600), access.ExpiresIn)
+	assert.Equal(t, "r1", access.RefreshToken)
+	assert.True(t, storage.RefreshReused(access))
+
+	// the settings of other clients are left to osin
+	access = &osin.AccessData{Client: &osin.DefaultClient{Id: "other"}, AccessData: prev, RefreshToken: "r2", ExpiresIn: 3600}
+	require.Nil(t, ApplyAccess(access))
+	assert.Equal(t, int32(3600), access.ExpiresIn)
+	assert.Equal(t, "r2", access.RefreshToken)
+}
+
+func TestClientValidate(t *testing.T) {
+	c := NewClient("public", "", "http://localhost")
+	assert.ErrorIs(t, c.Validate(), storage.ErrInvalidClient)
+	c.Meta.TokenEndpointAuthMethod = AuthNone
+	assert.Nil(t, c.Validate())
+	assert.True(t, c.Meta.IsPublic())
+	c.Secret = "secret"
+	assert.ErrorIs(t, c.Validate(), storage.ErrInvalidClient)
+
+	c.Meta.TokenEndpointAuthMethod = AuthClientSecretPost
+	assert.Nil(t, c.Validate())
+	c.Meta.TokenEndpointAuthMethod = AuthPrivateKeyJWT
+	c.Secret = ""
+	assert.ErrorIs(t, c.Validate(), storage.ErrInvalidClient)
+	c.Meta.JWKSURI = "https://client.example.com/jwks.json"
+	assert.Nil(t, c.Validate())
+	c.Meta.TokenEndpointAuthMethod = "unknown"
+	assert.ErrorIs(t, c.Validate(), storage.ErrInvalidClient)
+
+	// public clients require PKCE
+	c.Meta.TokenEndpointAuthMethod = AuthNone
+	assert.ErrorIs(t, ApplyAuthorize(&osin.AuthorizeData{Client: c, Code: "code"}), storage.ErrInvalidValue)
+}
@@ -2,13 +2,14 @@ package oauth
 
 import (
 	"database/sql/driver"
-	"encoding/json"
-	"errors"
+	"fmt"
+
+	"github.com/liut/osin-storage/storage"
 )
 
 // vars
 var (
-	ErrInvalidJSON = errors.New("Invalid JSON")
+	ErrInvalidJSON = fmt.Errorf("%w: Invalid JSON", storage.ErrInvalidValue)
 )
 
 // JSONKV ...
@@ -42,14 +43,15 @@ func (m *JSONKV) Scan(value interface{}) (err error) {
 	case map[string]interface{}:
 		*m = JSONKV(data)
 	case []byte:
-		err = json.Unmarshal(data, m)
+		err = UnmarshalSealed(data, m)
 	case string:
-		err = json.Unmarshal([]byte(data), m)
+		err = UnmarshalSealed([]byte(data), m)
 	}
 	return
 }
 
-// Value implements the driver.Valuer interface.
+// Value implements the driver.Valuer interface, JSON is valued as text,
+// sealed if a keyring is set.
 func (m JSONKV) Value() (driver.Value, error) {
-	return json.Marshal(m)
+	return sealedValue(m)
 }
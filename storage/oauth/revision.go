@@ -0,0 +1,89 @@
+package oauth
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ClientRevision is a snapshot of a client by version, saved by Actor at Created.
+// The secret of the client is a digest, the secret itself is never kept.
+// A removal is a Removed revision, with the id and the version of the client only.
+type ClientRevision struct {
+	Client  Client    `json:"client"`
+	Actor   string    `json:"actor,omitempty"`
+	Created time.Time `json:"created"`
+	Removed bool      `json:"removed,omitempty"`
+}
+
+// ClientHistory is a store keeping a revision of the clients by version, also after their removal.
+// Only sqlstore keeps the revisions, check a storage with s.(ClientHistory).
+type ClientHistory interface {
+	// ClientRevisions returns the revisions of the client, the latest first
+	ClientRevisions(id string) ([]ClientRevision, error)
+	// ClientRevision returns the revision of the client by version
+	ClientRevision(id string, version int) (*ClientRevision, error)
+	// RestoreClient saves the client of the revision by version again, as a new version.
+	// A removed client is not restored, it has no secret to keep.
+	RestoreClient(id string, version int) error
+}
+
+// ClientChange is a field of a client changed between two revisions
+type ClientChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// DiffClients returns the fields changed from a to b, by their names of JSON.
+// The fields of meta are prefixed with "meta.", a changed secret is reported without values.
+func DiffClients(a, b *Client) (changes []ClientChange) {
+	if a.Secret != b.Secret {
+		changes = append(changes, ClientChange{Field: "secret"})
+	}
+	if a.RedirectURI != b.RedirectURI {
+		changes = append(changes, ClientChange{Field: "redirectURI", From: a.RedirectURI, To: b.RedirectURI})
+	}
+	from, to := metaFields(a.Meta), metaFields(b.Meta)
+	keys := make([]string, 0, len(from)+len(to))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	for k := range to {
+		if _, ok := from[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !reflect.DeepEqual(from[k], to[k]) {
+			changes = append(changes, ClientChange{Field: "meta." + k, From: from[k], To: to[k]})
+		}
+	}
+	return
+}
+
+// DiffRevisions returns the fields of the client changed from the revision by version from to the one by version to
+func DiffRevisions(h ClientHistory, id string, from, to int) ([]ClientChange, error) {
+	a, err := h.ClientRevision(id, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.ClientRevision(id, to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffClients(&a.Client, &b.Client), nil
+}
+
+func metaFields(m ClientMeta) (fields map[string]interface{}) {
+	b, err := json.Marshal(m)
+	if err == nil {
+		err = json.Unmarshal(b, &fields)
+	}
+	if err != nil {
+		return nil
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package oauth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// vars
+var (
+	ErrInvalidKey = errors.New("invalid key, need 16, 24 or 32 bytes")
+	ErrUnknownKey = errors.New("unknown key id")
+	ErrNoKeyring  = errors.New("sealed data but no keyring")
+	ErrSealed     = errors.New("invalid sealed data")
+)
+
+// sealed is the JSON envelope of encrypted data, so it still fits in a JSON column.
+// Data is the nonce followed by the AES-GCM ciphertext, the key id is the additional data.
+type sealed struct {
+	KeyID string `json:"$kid"`
+	Data  []byte `json:"$sealed"`
+}
+
+var sealedMark = []byte(`"$sealed"`)
+
+// unwrap returns the envelope if data is sealed, or nil
+func unwrap(data []byte) (*sealed, error) {
+	if !bytes.Contains(data, sealedMark) {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || len(fields) != 2 || fields["$kid"] == nil {
+		return nil, nil
+	}
+	var env sealed
+	if err := json.Unmarshal(data, &env); err != nil || env.KeyID == "" {
+		return nil, ErrSealed
+	}
+	return &env, nil
+}
+
+// Keyring seals data with AES-GCM under the primary key,
+// any key of the ring opens data sealed by it, so keys can be rotated.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of AES keys by id, data is sealed by the primary key.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, ErrUnknownKey
+	}
+	k := &Keyring{primary: primary, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Primary returns the id of the key sealing data
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Seal encrypts plain into a JSON envelope
+func (k *Keyring) Seal(plain []byte) ([]byte, error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed{
+		KeyID: k.primary,
+		Data:  aead.Seal(nonce, nonce, plain, []byte(k.primary)),
+	})
+}
+
+// Open decrypts a JSON envelope, data not sealed is returned as is.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	env, err := unwrap(data)
+	if env == nil {
+		return data, err
+	}
+	aead, ok := k.aeads[env.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(env.Data) < aead.NonceSize() {
+		return nil, ErrSealed
+	}
+	nonce, text := env.Data[:aead.NonceSize()], env.Data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, text, []byte(env.KeyID))
+	if err != nil {
+		return nil, ErrSealed
+	}
+	return plain, nil
+}
+
+// Reseal seals data again with the primary key, unless it is sealed by it already.
+// Plain data is sealed, so it also encrypts existing rows.
+func (k *Keyring) Reseal(data []byte) (out []byte, changed bool, err error) {
+	if env, _ := unwrap(data); env != nil && env.KeyID == k.primary {
+		return data, false, nil
+	}
+	plain, err := k.Open(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if out, err = k.Seal(plain); err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+var keyring atomic.Value
+
+// SetKeyring sets the keyring sealing JSONKV and ClientMeta values, nil stops sealing.
+// Sealed values can not be scanned without the keyring.
+func SetKeyring(k *Keyring) {
+	keyring.Store(k)
+}
+
+// CurrentKeyring returns the keyring set, or nil
+func CurrentKeyring() *Keyring {
+	k, _ := keyring.Load().(*Keyring)
+	return k
+}
+
+// MarshalSealed returns the JSON of v, sealed if a keyring is set
+func MarshalSealed(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if k := CurrentKeyring(); k != nil {
+		return k.Seal(b)
+	}
+	return b, nil
+}
+
+// UnmarshalSealed parses the JSON data into v, which is opened first if sealed
+func UnmarshalSealed(data []byte, v interface{}) error {
+	if k := CurrentKeyring(); k != nil {
+		var err error
+		if data, err = k.Open(data); err != nil {
+			return err
+		}
+	} else if env, err := unwrap(data); env != nil || err != nil {
+		return ErrNoKeyring
+	}
+	return json.Unmarshal(data, v)
+}
+
+func sealedValue(v interface{}) (driver.Value, error) {
+	b, err := MarshalSealed(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,103 @@
+package oauth
+
+import (
+	"fmt"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// MetaOf returns the meta of the client, a Client or any with a ClientMeta as its user data
+func MetaOf(c osin.Client) (ClientMeta, bool) {
+	switch v := c.(type) {
+	case *Client:
+		return v.Meta, true
+	case nil:
+		return ClientMeta{}, false
+	}
+	m, ok := c.GetUserData().(ClientMeta)
+	return m, ok
+}
+
+// SkipsConsent reports whether the client is trusted to skip the consent of users
+func SkipsConsent(c osin.Client) bool {
+	m, _ := MetaOf(c)
+	return m.SkipConsent
+}
+
+// ApplyAuthorize applies the settings of the client of a before SaveAuthorize: the TTL of the code.
+// It returns an ErrInvalidValue if the client requires PKCE, as the public clients do, and a has no code challenge.
+func ApplyAuthorize(a *osin.AuthorizeData) error {
+	m, ok := MetaOf(a.Client)
+	if !ok {
+		return nil
+	}
+	if (m.PKCERequired || m.IsPublic()) && a.CodeChallenge == "" {
+		return fmt.Errorf("%w: client %s requires PKCE", storage.ErrInvalidValue, a.Client.GetId())
+	}
+	if m.CodeTTL > 0 {
+		a.ExpiresIn = int32(m.CodeTTL)
+	}
+	return nil
+}
+
+// ApplyAccess applies the settings of the client of a before SaveAccess: the TTL of the access token,
+// and the refresh token of the previous access token on refresh, if the client reuses it.
+func ApplyAccess(a *osin.AccessData) error {
+	m, ok := MetaOf(a.Client)
+	if !ok {
+		return nil
+	}
+	if m.AccessTTL > 0 {
+		a.ExpiresIn = int32(m.AccessTTL)
+	}
+	if prev := a.AccessData; m.RefreshReuse && prev != nil && prev.RefreshToken != "" && a.RefreshToken != "" {
+		a.RefreshToken = prev.RefreshToken
+	}
+	return nil
+}
+
+// WithClientSettings wraps a storage to apply the settings of the clients,
+// with ApplyAuthorize and ApplyAccess before saving codes and tokens.
+//
+// A reused refresh token is cleared from the previous access data after it is saved,
+// so osin removes the previous access token only.
+// The optional interfaces of next are forwarded as they are, see storage.Extend.
+func WithClientSettings(next storage.Storage) storage.Storage {
+	return storage.Extend(&settingStore{next}, storage.OptionalOf(next))
+}
+
+type settingStore struct {
+	storage.Storage
+}
+
+// Clone clones the underlying storage and wraps it again
+func (s *settingStore) Clone() osin.Storage {
+	if next, ok := s.Storage.Clone().(storage.Storage); ok {
+		return WithClientSettings(next)
+	}
+	return WithClientSettings(s.Storage)
+}
+
+// SaveAuthorize osin.Storage
+func (s *settingStore) SaveAuthorize(a *osin.AuthorizeData) error {
+	if err := ApplyAuthorize(a); err != nil {
+		return err
+	}
+	return s.Storage.SaveAuthorize(a)
+}
+
+// SaveAccess osin.Storage
+func (s *settingStore) SaveAccess(a *osin.AccessData) error {
+	if err := ApplyAccess(a); err != nil {
+		return err
+	}
+	if err := s.Storage.SaveAccess(a); err != nil {
+		return err
+	}
+	if storage.RefreshReused(a) {
+		a.AccessData.RefreshToken = ""
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openshift/osin"
+)
+
+// Op is the name of a storage operation
+type Op string
+
+// operations of Storage
+const (
+	OpGetClient       Op = "GetClient"
+	OpSaveClient      Op = "SaveClient"
+	OpRemoveClient    Op = "RemoveClient"
+	OpSaveAuthorize   Op = "SaveAuthorize"
+	OpLoadAuthorize   Op = "LoadAuthorize"
+	OpRemoveAuthorize Op = "RemoveAuthorize"
+	OpSaveAccess      Op = "SaveAccess"
+	OpLoadAccess      Op = "LoadAccess"
+	OpRemoveAccess    Op = "RemoveAccess"
+	OpLoadRefresh     Op = "LoadRefresh"
+	OpRemoveRefresh   Op = "RemoveRefresh"
+)
+
+// operations of the optional interfaces
+const (
+	OpUpdateClient     Op = "UpdateClient"
+	OpConsumeAuthorize Op = "ConsumeAuthorize"
+	OpSaveJTI          Op = "SaveJTI"
+)
+
+// Operation is a call of Storage seen by an Observer.
+// Key is the client id, code, token or jti, Data is the Client, *osin.AuthorizeData or *osin.AccessData saved,
+// or the issuer of a jti, and Result is the value loaded, set before After.
+type Operation struct {
+	Op     Op
+	Key    string
+	Data   interface{}
+	Result interface{}
+}
+
+// IsSave reports whether the operation saves data
+func (op *Operation) IsSave() bool {
+	switch op.Op {
+	case OpSaveClient, OpUpdateClient, OpSaveAuthorize, OpSaveAccess, OpSaveJTI:
+		return true
+	}
+	return false
+}
+
+// Observer hooks the operations of a Storage wrapped with Observe.
+type Observer interface {
+	// Before is called before the operation, an error vetoes it and is returned to the caller.
+	Before(op *Operation) error
+	// After is called with the result of the operation, or the veto of a later observer.
+	After(op *Operation, err error)
+}
+
+// ObserverFuncs is an Observer of functions, nil ones are skipped
+type ObserverFuncs struct {
+	BeforeFunc func(op *Operation) error
+	AfterFunc  func(op *Operation, err error)
+}
+
+// Before calls BeforeFunc
+func (f ObserverFuncs) Before(op *Operation) error {
+	if f.BeforeFunc == nil {
+		return nil
+	}
+	return f.BeforeFunc(op)
+}
+
+// After calls AfterFunc
+func (f ObserverFuncs) After(op *Operation, err error) {
+	if f.AfterFunc != nil {
+		f.AfterFunc(op, err)
+	}
+}
+
+type observedStore struct {
+	next      Storage
+	observers []Observer
+}
+
+// Observe wraps next, observers are called in order before each operation and in reverse order after it.
+// After is only called on observers whose Before passed.
+// The storage implements the optional interfaces of next only, see Decorate.
+func Observe(next Storage, observers ...Observer) Storage {
+	return Decorate(&observedStore{next: next, observers: observers}, next)
+}
+
+func (s *observedStore) do(op *Operation, fn func() error) (err error) {
+	n := 0
+	for _, o := range s.observers {
+		if err = o.Before(op); err != nil {
+			break
+		}
+		n++
+	}
+	if err == nil {
+		err = fn()
+	}
+	for i := n - 1; i >= 0; i-- {
+		s.observers[i].After(op, err)
+	}
+	return
+}
+
+// Clone clones the underlying storage
+func (s *observedStore) Clone() osin.Storage {
+	next, ok := s.next.Clone().(Storage)
+	if !ok {
+		next = s.next
+	}
+	return Decorate(&observedStore{next: next, observers: s.observers}, next)
+}
+
+// Close closes the underlying storage
+func (s *observedStore) Close() {
+	s.next.Close()
+}
+
+// GetClient loads the client by id
+func (s *observedStore) GetClient(id string) (c osin.Client, err error) {
+	op := &Operation{Op: OpGetClient, Key: id}
+	err = s.do(op, func() (err error) {
+		c, err = s.next.GetClient(id)
+		op.Result = c
+		return
+	})
+	return
+}
+
+// SaveClient saves the client
+func (s *observedStore) SaveClient(c Client) error {
+	return s.do(&Operation{Op: OpSaveClient, Key: c.GetId(), Data: c}, func() error {
+		return s.next.SaveClient(c)
+	})
+}
+
+// UpdateClient updates the client of version, see ClientUpdater
+func (s *observedStore) UpdateClient(c Client, version int) error {
+	u, ok := s.next.(ClientUpdater)
+	if !ok {
+		return fmt.Errorf("%w: %T updates no client by version", ErrInvalidValue, s.next)
+	}
+	return s.do(&Operation{Op: OpUpdateClient, Key: c.GetId(), Data: c}, func() error {
+		return u.UpdateClient(c, version)
+	})
+}
+
+// RemoveClient removes the client
+func (s *observedStore) RemoveClient(id string) error {
+	return s.do(&Operation{Op: OpRemoveClient, Key: id}, func() error {
+		return s.next.RemoveClient(id)
+	})
+}
+
+// SaveAuthorize saves authorize data
+func (s *observedStore) SaveAuthorize(data *osin.AuthorizeData) error {
+	return s.do(&Operation{Op: OpSaveAuthorize, Key: data.Code, Data: data}, func() error {
+		return s.next.SaveAuthorize(data)
+	})
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *observedStore) LoadAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	op := &Operation{Op: OpLoadAuthorize, Key: code}
+	err = s.do(op, func() (err error) {
+		a, err = s.next.LoadAuthorize(code)
+		op.Result = a
+		return
+	})
+	return
+}
+
+// RemoveAuthorize removes the code
+func (s *observedStore) RemoveAuthorize(code string) error {
+	return s.do(&Operation{Op: OpRemoveAuthorize, Key: code}, func() error {
+		return s.next.RemoveAuthorize(code)
+	})
+}
+
+// ConsumeAuthorize consumes the code, see AuthorizeConsumer
+func (s *observedStore) ConsumeAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	c, ok := s.next.(AuthorizeConsumer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T consumes no code", ErrInvalidValue, s.next)
+	}
+	op := &Operation{Op: OpConsumeAuthorize, Key: code}
+	err = s.do(op, func() (err error) {
+		a, err = c.ConsumeAuthorize(code)
+		op.Result = a
+		return
+	})
+	return
+}
+
+// SaveAccess writes AccessData
+func (s *observedStore) SaveAccess(data *osin.AccessData) error {
+	return s.do(&Operation{Op: OpSaveAccess, Key: data.AccessToken, Data: data}, func() error {
+		return s.next.SaveAccess(data)
+	})
+}
+
+// LoadAccess retrieves access data by token
+func (s *observedStore) LoadAccess(token string) (a *osin.AccessData, err error) {
+	op := &Operation{Op: OpLoadAccess, Key: token}
+	err = s.do(op, func() (err error) {
+		a, err = s.next.LoadAccess(token)
+		op.Result = a
+		return
+	})
+	return
+}
+
+// RemoveAccess revokes the token
+func (s *observedStore) RemoveAccess(token string) error {
+	return s.do(&Operation{Op: OpRemoveAccess, Key: token}, func() error {
+		return s.next.RemoveAccess(token)
+	})
+}
+
+// LoadRefresh retrieves refresh AccessData
+func (s *observedStore) LoadRefresh(token string) (a *osin.AccessData, err error) {
+	op := &Operation{Op: OpLoadRefresh, Key: token}
+	err = s.do(op, func() (err error) {
+		a, err = s.next.LoadRefresh(token)
+		op.Result = a
+		return
+	})
+	return
+}
+
+// RemoveRefresh revokes the refresh token
+func (s *observedStore) RemoveRefresh(token string) error {
+	return s.do(&Operation{Op: OpRemoveRefresh, Key: token}, func() error {
+		return s.next.RemoveRefresh(token)
+	})
+}
+
+// SaveJTI records the jti of issuer, see ReplayCache
+func (s *observedStore) SaveJTI(issuer, jti string, exp time.Time) error {
+	r, ok := s.next.(ReplayCache)
+	if !ok {
+		return fmt.Errorf("%w: %T saves no jti", ErrInvalidValue, s.next)
+	}
+	return s.do(&Operation{Op: OpSaveJTI, Key: jti, Data: issuer}, func() error {
+		return r.SaveJTI(issuer, jti, exp)
+	})
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+)
+
+var errMissing = errors.New("missing")
+
+type testClient struct {
+	osin.DefaultClient
+}
+
+func (c *testClient) GetName() string       { return c.Id }
+func (c *testClient) CopyFrom(other Client) { c.Id = other.GetId() }
+
+// memStore keeps clients and tokens in maps
+type memStore struct {
+	clients map[string]osin.Client
+	access  map[string]*osin.AccessData
+}
+
+func newMemStore() *memStore {
+	return &memStore{clients: map[string]osin.Client{}, access: map[string]*osin.AccessData{}}
+}
+
+func (m *memStore) Clone() osin.Storage { return m }
+func (m *memStore) Close()              {}
+func (m *memStore) GetClient(id string) (osin.Client, error) {
+	if c, ok := m.clients[id]; ok {
+		return c, nil
+	}
+	return nil, errMissing
+}
+func (m *memStore) SaveClient(c Client) error                          { m.clients[c.GetId()] = c; return nil }
+func (m *memStore) RemoveClient(id string) error                       { delete(m.clients, id); return nil }
+func (m *memStore) SaveAuthorize(*osin.AuthorizeData) error            { return nil }
+func (m *memStore) LoadAuthorize(string) (*osin.AuthorizeData, error)  { return nil, errMissing }
+func (m *memStore) RemoveAuthorize(string) error                       { return nil }
+func (m *memStore) SaveAccess(a *osin.AccessData) error                { m.access[a.AccessToken] = a; return nil }
+func (m *memStore) RemoveAccess(token string) error                    { delete(m.access, token); return nil }
+func (m *memStore) LoadRefresh(token string) (*osin.AccessData, error) { return nil, errMissing }
+func (m *memStore) RemoveRefresh(string) error                         { return nil }
+func (m *memStore) LoadAccess(token string) (*osin.AccessData, error) {
+	if a, ok := m.access[token]; ok {
+		return a, nil
+	}
+	return nil, errMissing
+}
+
+type recorder struct {
+	name  string
+	calls *[]string
+	veto  error
+}
+
+func (r recorder) Before(op *Operation) error {
+	*r.calls = append(*r.calls, r.name+".before."+string(op.Op))
+	if op.IsSave() {
+		return r.veto
+	}
+	return nil
+}
+
+func (r recorder) After(op *Operation, err error) {
+	s := r.name + ".after." + string(op.Op)
+	if err != nil {
+		s += ":" + err.Error()
+	}
+	*r.calls = append(*r.calls, s)
+}
+
+func TestObserve(t *testing.T) {
+	var calls []string
+	mem := newMemStore()
+	store := Observe(mem, recorder{name: "a", calls: &calls}, recorder{name: "b", calls: &calls})
+
+	c := &testClient{osin.DefaultClient{Id: "1"}}
+	assert.Nil(t, store.SaveClient(c))
+	assert.Equal(t, []string{"a.before.SaveClient", "b.before.SaveClient", "b.after.SaveClient", "a.after.SaveClient"}, calls)
+
+	calls = nil
+	_, err := store.LoadAccess("none")
+	assert.Equal(t, errMissing, err)
+	assert.Equal(t, []string{"a.before.LoadAccess", "b.before.LoadAccess",
+		"b.after.LoadAccess:missing", "a.after.LoadAccess:missing"}, calls)
+
+	var loaded interface{}
+	store = Observe(mem, ObserverFuncs{AfterFunc: func(op *Operation, err error) { loaded = op.Result }})
+	got, err := store.Clone().GetClient("1")
+	assert.Nil(t, err)
+	assert.Equal(t, c, got)
+	assert.Equal(t, c, loaded)
+}
+
+func TestObserveVeto(t *testing.T) {
+	var calls []string
+	veto := errors.New("denied")
+	mem := newMemStore()
+	store := Observe(mem, recorder{name: "a", calls: &calls}, recorder{name: "b", calls: &calls, veto: veto},
+		recorder{name: "c", calls: &calls})
+
+	err := store.SaveAccess(&osin.AccessData{AccessToken: "t"})
+	assert.Equal(t, veto, err)
+	assert.Empty(t, mem.access)
+	assert.Equal(t, []string{"a.before.SaveAccess", "b.before.SaveAccess", "a.after.SaveAccess:denied"}, calls)
+
+	// only saves are vetoed by the recorder
+	calls = nil
+	assert.Nil(t, store.RemoveAccess("t"))
+	assert.Len(t, calls, 6)
+}
+
+// updaterStore updates clients and saves jtis
+type updaterStore struct {
+	*memStore
+	jtis []string
+}
+
+func (m *updaterStore) Clone() osin.Storage                      { return m }
+func (m *updaterStore) UpdateClient(c Client, version int) error { return m.SaveClient(c) }
+func (m *updaterStore) SaveJTI(issuer, jti string, exp time.Time) error {
+	m.jtis = append(m.jtis, issuer+":"+jti)
+	return nil
+}
+
+func TestObserveOptional(t *testing.T) {
+	var calls []string
+	store := Observe(newMemStore(), recorder{name: "a", calls: &calls})
+	_, ok := store.(ClientUpdater)
+	assert.False(t, ok)
+	_, ok = store.(AuthorizeConsumer)
+	assert.False(t, ok)
+	_, ok = store.(ReplayCache)
+	assert.False(t, ok)
+
+	veto := errors.New("denied")
+	mem := &updaterStore{memStore: newMemStore()}
+	store = Observe(mem, recorder{name: "a", calls: &calls, veto: veto})
+	_, ok = store.(AuthorizeConsumer)
+	assert.False(t, ok)
+	u, ok := store.Clone().(ClientUpdater)
+	assert.True(t, ok)
+	r, ok := store.(ReplayCache)
+	assert.True(t, ok)
+
+	calls = nil
+	assert.Equal(t, veto, u.UpdateClient(&testClient{osin.DefaultClient{Id: "1"}}, 1))
+	assert.Equal(t, veto, r.SaveJTI("rp", "1", time.Now()))
+	assert.Empty(t, mem.clients)
+	assert.Empty(t, mem.jtis)
+	assert.Equal(t, []string{"a.before.UpdateClient", "a.before.SaveJTI"}, calls)
+
+	store = Observe(mem)
+	assert.Nil(t, store.(ReplayCache).SaveJTI("rp", "1", time.Now()))
+	assert.Equal(t, []string{"rp:1"}, mem.jtis)
+}
+
+func TestExtend(t *testing.T) {
+	mem := &updaterStore{memStore: newMemStore()}
+	s := Extend(mem, Optional{ReplayCache: mem})
+	_, ok := s.(ClientUpdater)
+	assert.False(t, ok)
+	_, ok = s.(ReplayCache)
+	assert.True(t, ok)
+	assert.Equal(t, Optional{ClientUpdater: mem, ReplayCache: mem}, OptionalOf(mem))
+	assert.Equal(t, Optional{ReplayCache: mem}, OptionalOf(mem).Of(s))
+}
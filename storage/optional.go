@@ -0,0 +1,85 @@
+package storage
+
+// Optional are the optional interfaces of a storage, nil if not implemented
+type Optional struct {
+	ClientUpdater     ClientUpdater
+	AuthorizeConsumer AuthorizeConsumer
+	ReplayCache       ReplayCache
+}
+
+// OptionalOf returns the optional interfaces implemented by s
+func OptionalOf(s interface{}) (o Optional) {
+	o.ClientUpdater, _ = s.(ClientUpdater)
+	o.AuthorizeConsumer, _ = s.(AuthorizeConsumer)
+	o.ReplayCache, _ = s.(ReplayCache)
+	return
+}
+
+// Of returns o without the interfaces not implemented by next, e.g. the ones of a decorator forwarding to next
+func (o Optional) Of(next interface{}) Optional {
+	n := OptionalOf(next)
+	if n.ClientUpdater == nil {
+		o.ClientUpdater = nil
+	}
+	if n.AuthorizeConsumer == nil {
+		o.AuthorizeConsumer = nil
+	}
+	if n.ReplayCache == nil {
+		o.ReplayCache = nil
+	}
+	return o
+}
+
+// Decorate returns the decorator d of next implementing the optional interfaces of next only,
+// so a capability check, e.g. s.(ClientUpdater), is the one of next. The Clone of d should decorate its clone again.
+func Decorate(d, next Storage) Storage {
+	return Extend(d, OptionalOf(d).Of(next))
+}
+
+// Extend returns s with the optional interfaces set in o, and none of the others implemented by s
+func Extend(s Storage, o Optional) Storage {
+	u, c, r := o.ClientUpdater, o.AuthorizeConsumer, o.ReplayCache
+	switch {
+	case u != nil && c != nil && r != nil:
+		return struct {
+			Storage
+			ClientUpdater
+			AuthorizeConsumer
+			ReplayCache
+		}{s, u, c, r}
+	case u != nil && c != nil:
+		return struct {
+			Storage
+			ClientUpdater
+			AuthorizeConsumer
+		}{s, u, c}
+	case u != nil && r != nil:
+		return struct {
+			Storage
+			ClientUpdater
+			ReplayCache
+		}{s, u, r}
+	case c != nil && r != nil:
+		return struct {
+			Storage
+			AuthorizeConsumer
+			ReplayCache
+		}{s, c, r}
+	case u != nil:
+		return struct {
+			Storage
+			ClientUpdater
+		}{s, u}
+	case c != nil:
+		return struct {
+			Storage
+			AuthorizeConsumer
+		}{s, c}
+	case r != nil:
+		return struct {
+			Storage
+			ReplayCache
+		}{s, r}
+	}
+	return struct{ Storage }{s}
+}
@@ -0,0 +1,104 @@
+// Package outbox relays the events written by a storage in the transactions of its mutations,
+// so an event is published at least once if and only if the mutation is committed.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/audit"
+	"github.com/liut/osin-storage/storage/logging"
+)
+
+// kinds of messages
+const (
+	ClientSavedKind    = "client.saved"
+	ClientRemovedKind  = "client.removed"
+	TokenIssuedKind    = "token.issued"
+	TokenRevokedKind   = "token.revoked"
+	RefreshRevokedKind = "refresh.revoked"
+)
+
+// Message is an event in the outbox.
+// Messages of an aggregate (a client or a token) are published in order of their ID.
+type Message struct {
+	ID        int64           `json:"id"`
+	Aggregate string          `json:"aggregate"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Created   time.Time       `json:"created"`
+}
+
+// Store is a storage writing messages in the outbox
+type Store interface {
+	// PendingMessages returns the oldest messages not delivered, in order of ID
+	PendingMessages(limit int) ([]Message, error)
+	// MarkDelivered marks the messages delivered
+	MarkDelivered(ids ...int64) error
+}
+
+// Publisher delivers messages, e.g. to a message bus
+type Publisher interface {
+	Publish(ctx context.Context, m *Message) error
+}
+
+// PublisherFunc is a function as Publisher
+type PublisherFunc func(ctx context.Context, m *Message) error
+
+// Publish calls f
+func (f PublisherFunc) Publish(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// TokenPayload is the payload of token messages, the token is hashed with audit.TokenTarget
+type TokenPayload struct {
+	Token     string    `json:"token"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	ExpiresIn int32     `json:"expires_in,omitempty"`
+	Created   time.Time `json:"created,omitempty"`
+}
+
+func newMessage(aggregate, kind string, payload interface{}) *Message {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		logging.New(nil, "outbox").Error("marshal message failed", "kind", kind, "err", err)
+		b = []byte("{}")
+	}
+	return &Message{Aggregate: aggregate, Kind: kind, Payload: b, Created: time.Now()}
+}
+
+// ClientSaved returns the message of a saved client, without its secret and meta, see audit.ClientState
+func ClientSaved(c storage.Client) *Message {
+	return newMessage("client:"+c.GetId(), ClientSavedKind, audit.NewClientState(c))
+}
+
+// ClientRemoved returns the message of a removed client
+func ClientRemoved(id string) *Message {
+	return newMessage("client:"+id, ClientRemovedKind, audit.ClientState{ID: id})
+}
+
+// TokenIssued returns the message of an issued access token
+func TokenIssued(a *osin.AccessData) *Message {
+	p := TokenPayload{Token: audit.TokenTarget(a.AccessToken), Scope: a.Scope, ExpiresIn: a.ExpiresIn, Created: a.CreatedAt}
+	if a.Client != nil {
+		p.ClientID = a.Client.GetId()
+	}
+	return newMessage("token:"+p.Token, TokenIssuedKind, p)
+}
+
+// TokenRevoked returns the message of a revoked access token
+func TokenRevoked(token string) *Message {
+	p := TokenPayload{Token: audit.TokenTarget(token)}
+	return newMessage("token:"+p.Token, TokenRevokedKind, p)
+}
+
+// RefreshRevoked returns the message of a revoked refresh token
+func RefreshRevoked(token string) *Message {
+	p := TokenPayload{Token: audit.TokenTarget(token)}
+	return newMessage("refresh:"+p.Token, RefreshRevokedKind, p)
+}
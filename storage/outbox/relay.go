@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/liut/osin-storage/storage/logging"
+)
+
+// defaults of Relay
+const (
+	DefaultBatchSize = 100
+	DefaultInterval  = time.Second
+)
+
+// Relay delivers the pending messages of a Store to a Publisher at least once.
+// A message failing to publish holds back the later messages of its aggregate until it succeeds.
+// Run a single relay per outbox.
+type Relay struct {
+	store Store
+	pub   Publisher
+
+	BatchSize int
+	Interval  time.Duration
+	Logger    slog.Handler // of the failed publishes, default is the handler of slog.Default()
+}
+
+// NewRelay returns a relay with DefaultBatchSize and DefaultInterval
+func NewRelay(store Store, pub Publisher) *Relay {
+	return &Relay{store: store, pub: pub, BatchSize: DefaultBatchSize, Interval: DefaultInterval}
+}
+
+// Flush publishes a batch of pending messages and returns the number delivered,
+// and the first error of publishing.
+func (r *Relay) Flush(ctx context.Context) (n int, err error) {
+	msgs, err := r.store.PendingMessages(r.batchSize())
+	if err != nil {
+		return
+	}
+	held := make(map[string]bool)
+	for i := range msgs {
+		m := &msgs[i]
+		if held[m.Aggregate] {
+			continue
+		}
+		if e := r.pub.Publish(ctx, m); e != nil {
+			logging.New(r.Logger, "outbox").Error("publish failed", "id", m.ID, "kind", m.Kind, "err", e)
+			held[m.Aggregate] = true
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		if e := r.store.MarkDelivered(m.ID); e != nil {
+			return n, e
+		}
+		n++
+	}
+	return
+}
+
+// Run flushes the outbox until ctx is done, waiting Interval when it is empty or failing
+func (r *Relay) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// a full batch is followed by the next one at once
+		n, err := r.Flush(ctx)
+		if err == nil && n >= r.batchSize() && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	return r.BatchSize
+}
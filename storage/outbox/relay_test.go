@@ -0,0 +1,145 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/audit"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+// memStore is an outbox in memory
+type memStore struct {
+	mu        sync.Mutex
+	msgs      []Message
+	delivered map[int64]bool
+}
+
+func (m *memStore) add(msg *Message) {
+	msg.ID = int64(len(m.msgs) + 1)
+	m.msgs = append(m.msgs, *msg)
+}
+
+func (m *memStore) PendingMessages(limit int) (msgs []Message, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range m.msgs {
+		if !m.delivered[msg.ID] && len(msgs) < limit {
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func (m *memStore) MarkDelivered(ids ...int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		m.delivered[id] = true
+	}
+	return nil
+}
+
+func TestMessages(t *testing.T) {
+	client := oauth.NewClient("1", "secret", "http://localhost/")
+	client.Meta.Name = "eagle"
+	client.Meta.JWKSURI = "https://rp.example.com/jwks"
+	client.Version = 2
+	m := ClientSaved(client)
+	assert.Equal(t, "client:1", m.Aggregate)
+	assert.Equal(t, ClientSavedKind, m.Kind)
+	assert.NotContains(t, string(m.Payload), "secret")
+	assert.NotContains(t, string(m.Payload), client.Meta.JWKSURI)
+	var st audit.ClientState
+	require.Nil(t, json.Unmarshal(m.Payload, &st))
+	assert.Equal(t, audit.ClientState{ID: "1", Name: "eagle", RedirectURI: "http://localhost/", Version: 2}, st)
+
+	m = TokenIssued(&osin.AccessData{Client: client, AccessToken: "access", Scope: "basic"})
+	var p TokenPayload
+	require.Nil(t, json.Unmarshal(m.Payload, &p))
+	assert.Equal(t, audit.TokenTarget("access"), p.Token)
+	assert.Equal(t, "1", p.ClientID)
+	assert.Equal(t, "token:"+p.Token, m.Aggregate)
+	assert.Equal(t, m.Aggregate, TokenRevoked("access").Aggregate)
+
+	// a long token is revoked by the key saved, e.g. on a reused code, with the aggregate of its issue
+	long := strings.Repeat("a", storage.MaxTokenLen+1)
+	m = TokenIssued(&osin.AccessData{Client: client, AccessToken: long})
+	assert.Equal(t, m.Aggregate, TokenRevoked(storage.TokenKey(long)).Aggregate)
+}
+
+func TestRelay(t *testing.T) {
+	store := &memStore{delivered: map[int64]bool{}}
+	for _, m := range []*Message{ClientSaved(oauth.NewClient("1", "secret", "http://localhost/")),
+		TokenIssued(&osin.AccessData{AccessToken: "a"}), ClientRemoved("1"), TokenRevoked("a")} {
+		store.add(m)
+	}
+
+	var (
+		published []int64
+		failing   = map[int64]bool{1: true}
+	)
+	relay := NewRelay(store, PublisherFunc(func(ctx context.Context, m *Message) error {
+		if failing[m.ID] {
+			return errors.New("bus down")
+		}
+		published = append(published, m.ID)
+		return nil
+	}))
+	var buf bytes.Buffer
+	relay.Logger = slog.NewTextHandler(&buf, nil)
+
+	// the failing client message holds back the later one of the client
+	n, err := relay.Flush(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, buf.String(), "publish failed")
+	assert.Contains(t, buf.String(), "bus down")
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int64{2, 4}, published)
+
+	failing = nil
+	n, err = relay.Flush(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int64{2, 4, 1, 3}, published)
+
+	n, err = relay.Flush(context.Background())
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+}
+
+func TestRelayRun(t *testing.T) {
+	store := &memStore{delivered: map[int64]bool{}}
+	for i := 0; i < 5; i++ {
+		store.add(TokenIssued(&osin.AccessData{AccessToken: "a"}))
+	}
+	var mu sync.Mutex
+	var published int
+	relay := NewRelay(store, PublisherFunc(func(ctx context.Context, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published++
+		return nil
+	}))
+	relay.BatchSize = 2
+	relay.Interval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, relay.Run(ctx))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 5, published)
+}
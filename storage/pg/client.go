@@ -1,16 +1,20 @@
 package pg
 
 import (
+	"database/sql/driver"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
 	"github.com/openshift/osin"
 )
 
 var _ = fmt.Sprintf
 var _ storage.Client = (*Client)(nil)
+var _ storage.AccessTTLer = (*Client)(nil)
+var _ storage.RefreshPolicer = (*Client)(nil)
 var _ osin.Client = (*Client)(nil)
 
 // JSONKV ..
@@ -36,12 +40,29 @@ func (m JSONKV) WithKey(key string) (v interface{}) {
 	return
 }
 
-// ClientMeta ...
-type ClientMeta struct {
-	Site uint8  `json:"siteID"`
-	Name string `json:"name"`
+// Scan implements the sql.Scanner interface.
+func (m *JSONKV) Scan(value interface{}) (err error) {
+	switch data := value.(type) {
+	case []byte:
+		err = oauth.UnmarshalSealed(data, m)
+	case string:
+		err = oauth.UnmarshalSealed([]byte(data), m)
+	}
+	return
+}
+
+// Value implements the driver.Valuer interface, sealed if a keyring is set with oauth.SetKeyring.
+func (m JSONKV) Value() (driver.Value, error) {
+	b, err := oauth.MarshalSealed(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
 }
 
+// ClientMeta is the meta of the clients of every storage, so the settings and policies apply to them
+type ClientMeta = oauth.ClientMeta
+
 // Client ...
 type Client struct {
 	tableName struct{} `sql:"oauth.client"`
@@ -51,6 +72,8 @@ type Client struct {
 	RedirectURI string     `sql:"redirect_uri,notnull" json:"redirect_uri"`
 	Meta        ClientMeta `sql:"meta,notnull" json:"meta,omitempty"`
 	CreatedAt   time.Time  `sql:"created,notnull" json:"created,omitempty"`
+	Version     int        `sql:"version,notnull" json:"version,omitempty"` // incremented by every update
+	UpdatedAt   time.Time  `sql:"updated,notnull" json:"updated,omitempty"`
 }
 
 func (c *Client) String() string {
@@ -62,6 +85,11 @@ func (c *Client) GetName() string {
 	return c.Meta.Name
 }
 
+// GetVersion storage.Versioned
+func (c *Client) GetVersion() int {
+	return c.Version
+}
+
 // GetId osin.Client
 func (c *Client) GetId() string { // justifying
 	return c.ID
@@ -82,6 +110,41 @@ func (c *Client) GetUserData() interface{} {
 	return c.Meta
 }
 
+// GetGrantTypes ...
+func (c *Client) GetGrantTypes() []string {
+	return c.Meta.GrantTypes
+}
+
+// GetResponseTypes ...
+func (c *Client) GetResponseTypes() []string {
+	return c.Meta.ResponseTypes
+}
+
+// GetScopes ...
+func (c *Client) GetScopes() []string {
+	return c.Meta.Scopes
+}
+
+// GetAccessTTL storage.AccessTTLer
+func (c *Client) GetAccessTTL() int {
+	return c.Meta.AccessTTL
+}
+
+// GetRefreshPolicy storage.RefreshPolicer
+func (c *Client) GetRefreshPolicy() storage.RefreshPolicy {
+	return c.oauthClient().GetRefreshPolicy()
+}
+
+// Validate returns an ErrInvalidClient if the client is not valid, as oauth.Client.Validate
+func (c *Client) Validate() error {
+	return c.oauthClient().Validate()
+}
+
+func (c *Client) oauthClient() *oauth.Client {
+	return &oauth.Client{ID: c.ID, Secret: c.Secret, RedirectURI: c.RedirectURI, Meta: c.Meta,
+		CreatedAt: c.CreatedAt, Version: c.Version, UpdatedAt: c.UpdatedAt}
+}
+
 // CopyFrom ...
 func (c *Client) CopyFrom(other storage.Client) {
 	c.ID = other.GetId()
@@ -92,7 +155,7 @@ func (c *Client) CopyFrom(other storage.Client) {
 	if extra, ok := data.(ClientMeta); ok {
 		c.Meta = extra
 	} else {
-		log.Printf("invalid userData %v", data)
+		slog.Warn("invalid client userdata", "client_id", c.ID, "type", fmt.Sprintf("%T", data))
 	}
 }
 
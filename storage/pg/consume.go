@@ -0,0 +1,81 @@
+package pg
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/outbox"
+	"github.com/liut/osin-storage/storage/tracing"
+)
+
+var _ storage.AuthorizeConsumer = (*dbStore)(nil)
+
+// ConsumeAuthorize marks the code used with a conditional update and loads it, only the first call succeeds.
+// The next calls return storage.ErrReused, and revoke the tokens issued with the code and refreshed from them.
+// An empty code is never found. LoadAuthorize never consumes the code, e.g. policy.Server consumes it
+// once osin authenticated the client.
+func (s *dbStore) ConsumeAuthorize(code string) (_ *osin.AuthorizeData, err error) {
+	s, done := s.op("ConsumeAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
+	// the tokens without a code, e.g. of client credentials, are saved with an empty one
+	if code == "" {
+		return nil, storage.ErrNotFound
+	}
+	var reused bool
+	err = s.db.RunInTransaction(func(tx *Tx) error {
+		db := s.wrap(tx)
+		res, err := db.Exec("UPDATE oauth.authorize SET used_at = now() WHERE code = ? AND used_at IS NULL", code)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() > 0 {
+			return nil
+		}
+		var used int
+		if _, err = db.QueryOne(ormScan(&used), "SELECT COUNT(*) FROM oauth.authorize WHERE code = ?", code); err != nil {
+			return err
+		}
+		var issued []struct{ AccessToken string }
+		_, err = db.Query(&issued, `WITH RECURSIVE issued AS (
+			  SELECT access_token FROM oauth.access WHERE authorize_code = ?
+			  UNION
+			  SELECT a.access_token FROM oauth.access a JOIN issued ON a.previous = issued.access_token
+			) SELECT access_token FROM issued`, code)
+		if err != nil {
+			return err
+		}
+		// the code may be removed by osin after the tokens are issued
+		if used == 0 && len(issued) == 0 {
+			return dbErrNoRows
+		}
+		reused = true
+		s.log.Warn("authorize code reused", "code", code, "revoked", len(issued))
+		if len(issued) == 0 {
+			return nil
+		}
+		tokens := make([]string, len(issued))
+		for i, r := range issued {
+			tokens[i] = r.AccessToken
+		}
+		if _, err = db.Exec("DELETE FROM oauth.refresh WHERE access IN (?)", pg.In(tokens)); err != nil {
+			return err
+		}
+		if _, err = db.Exec("DELETE FROM oauth.access WHERE access_token IN (?)", pg.In(tokens)); err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if err = s.enqueue(db, outbox.TokenRevoked(token)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, storage.ErrReused
+	}
+	return s.LoadAuthorize(code)
+}
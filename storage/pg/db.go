@@ -19,7 +19,7 @@ type Tx = pg.Tx
 // Query ...
 type Query = orm.Query
 
-// ormDB of go-pg/pg/orm.DB
+// ormDB of go-pg/pg/orm.DB, implemented by DB, Tx and tracedDB
 type ormDB interface {
 	Model(model ...interface{}) *Query
 	Select(model interface{}) error
@@ -33,14 +33,6 @@ type ormDB interface {
 	QueryOne(model, query interface{}, params ...interface{}) (Result, error)
 }
 
-// Result ...
-type Result interface {
-
-	// RowsAffected returns the number of rows affected by SELECT, INSERT, UPDATE,
-	// or DELETE queries. It returns -1 if query can't possibly affect any rows,
-	// e.g. in case of CREATE or SHOW queries.
-	RowsAffected() int
-
-	// RowsReturned returns the number of rows returned by the query.
-	RowsReturned() int
-}
+// Result of go-pg/pg/orm, RowsAffected returns the number of rows affected by SELECT, INSERT, UPDATE,
+// or DELETE queries, or -1 if query can't possibly affect any rows, e.g. in case of CREATE or SHOW queries.
+type Result = orm.Result
@@ -2,11 +2,28 @@ package pg
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/go-pg/pg"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
 )
 
+// errors, the methods return a storage.Error of the kinds of package storage
 var (
-	errNotFound    = errors.New("Not found.")
-	errDatabase    = errors.New("Database error.")
-	errNilClient   = errors.New("data.Client must not be nil")
-	errInvalidJson = errors.New("Invalid JSON")
+	errNilClient   = fmt.Errorf("%w: data.Client must not be nil", storage.ErrInvalidClient)
+	errInvalidJson = oauth.ErrInvalidJSON
 )
+
+// errKind classifies an error of the database
+func errKind(err error) error {
+	if errors.Is(err, dbErrNoRows) {
+		return storage.ErrNotFound
+	}
+	var pe pg.Error
+	if errors.As(err, &pe) && pe.Field('C') == "23505" {
+		return storage.ErrConflict
+	}
+	return storage.ErrDatabase
+}
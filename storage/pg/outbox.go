@@ -0,0 +1,58 @@
+package pg
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-pg/pg"
+
+	"github.com/liut/osin-storage/storage/outbox"
+)
+
+var _ outbox.Store = (*dbStore)(nil)
+
+// enqueue writes m into oauth.outbox in tx, if WithOutbox
+func (s *dbStore) enqueue(tx ormDB, m *outbox.Message) error {
+	if !s.outbox {
+		return nil
+	}
+	_, err := tx.Exec("INSERT INTO oauth.outbox (aggregate, kind, payload, created) VALUES (?, ?, ?, ?)",
+		m.Aggregate, m.Kind, string(m.Payload), m.Created)
+	if err != nil {
+		s.log.Error("enqueue failed", "kind", m.Kind, "aggregate", m.Aggregate, "err", err)
+	}
+	return err
+}
+
+type outboxRow struct {
+	ID        int64
+	Aggregate string
+	Kind      string
+	Payload   string
+	Created   time.Time
+}
+
+// PendingMessages returns the oldest messages of oauth.outbox not delivered
+func (s *dbStore) PendingMessages(limit int) ([]outbox.Message, error) {
+	var rows []outboxRow
+	_, err := s.conn.Query(&rows, "SELECT id, aggregate, kind, payload::text AS payload, created FROM oauth.outbox "+
+		"WHERE delivered IS NULL ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]outbox.Message, len(rows))
+	for i, r := range rows {
+		msgs[i] = outbox.Message{ID: r.ID, Aggregate: r.Aggregate, Kind: r.Kind,
+			Payload: json.RawMessage(r.Payload), Created: r.Created}
+	}
+	return msgs, nil
+}
+
+// MarkDelivered marks the messages of oauth.outbox delivered
+func (s *dbStore) MarkDelivered(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.conn.Exec("UPDATE oauth.outbox SET delivered = now() WHERE id IN (?)", pg.In(ids))
+	return err
+}
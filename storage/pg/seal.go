@@ -0,0 +1,60 @@
+package pg
+
+import (
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+const resealBatch = 100
+
+// sealedColumns are the JSON columns sealed by oauth.SetKeyring, with the key column of their table
+var sealedColumns = []struct{ table, key, column string }{
+	{"oauth.client", "id", "meta"},
+	{"oauth.authorize", "code", "extra"},
+	{"oauth.access", "access_token", "extra"},
+}
+
+type sealedRow struct {
+	Key  string
+	Data string
+}
+
+// Reseal seals the JSON columns again with the primary key of k, after a key rotation
+// or to encrypt existing rows, and returns the number of rows updated.
+// The old keys must still be in k.
+func (s *dbStore) Reseal(k *oauth.Keyring) (n int, err error) {
+	s, done := s.op("Reseal")
+	defer func() { err = done(err) }()
+	for _, sc := range sealedColumns {
+		var last string
+		for {
+			var batch []sealedRow
+			_, err = s.conn.Query(&batch, "SELECT "+sc.key+" AS key, "+sc.column+"::text AS data FROM "+sc.table+
+				" WHERE "+sc.key+" > ? ORDER BY "+sc.key+" LIMIT ?", last, resealBatch)
+			if err != nil {
+				s.log.Error("reseal failed", "table", sc.table, "err", err)
+				return
+			}
+			for _, r := range batch {
+				out, changed, e := k.Reseal([]byte(r.Data))
+				if e != nil {
+					s.log.Error("reseal failed", "table", sc.table, sc.key, r.Key, "err", e)
+					return n, e
+				}
+				if !changed {
+					continue
+				}
+				if _, err = s.conn.Exec("UPDATE "+sc.table+" SET "+sc.column+" = ? WHERE "+sc.key+" = ?",
+					string(out), r.Key); err != nil {
+					s.log.Error("reseal failed", "table", sc.table, sc.key, r.Key, "err", err)
+					return
+				}
+				n++
+			}
+			if len(batch) < resealBatch {
+				break
+			}
+			last = batch[len(batch)-1].Key
+		}
+	}
+	return
+}
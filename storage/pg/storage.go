@@ -2,39 +2,94 @@
 package pg
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
+	"github.com/go-pg/pg"
 	"github.com/openshift/osin"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/logging"
+	"github.com/liut/osin-storage/storage/oauth"
+	"github.com/liut/osin-storage/storage/outbox"
+	"github.com/liut/osin-storage/storage/tracing"
 )
 
-var _ storage.Storage = (*dbStore)(nil)
+var (
+	_ storage.Storage       = (*dbStore)(nil)
+	_ storage.ActiveCounter = (*dbStore)(nil)
+	_ storage.ClientUpdater = (*dbStore)(nil)
+)
 
 // Storage ...
 type Storage interface {
 	storage.Storage
+	storage.ClientUpdater
 	AllClients() ([]Client, error)
 	CreateSchemas() error
+	Reseal(k *oauth.Keyring) (int, error)
+	WithContext(ctx context.Context) Storage
 }
 
 // Storage implements interface "github.com/openshift/osin".Storage and interface "github.com/ory-am/osin-storage".Storage
 type dbStore struct {
-	db *DB
+	db     *DB
+	conn   ormDB
+	outbox bool
+	tracer trace.Tracer
+	ctx    context.Context
+	log    *slog.Logger
+	expiry storage.Expiry
+}
+
+// Option of the storage
+type Option func(s *dbStore)
+
+// WithOutbox writes the events of client and token mutations into oauth.outbox,
+// in the same transaction, see outbox.NewRelay
+func WithOutbox() Option {
+	return func(s *dbStore) {
+		s.outbox = true
+	}
+}
+
+// WithLogger logs to the handler h, default is the handler of slog.Default().
+// Codes and tokens are logged as hashes, and secrets are never logged.
+func WithLogger(h slog.Handler) Option {
+	return func(s *dbStore) {
+		s.log = logging.New(h, "pg")
+	}
+}
+
+// WithExpiry enforces the expiry policy e when codes and tokens are loaded
+func WithExpiry(e storage.Expiry) Option {
+	return func(s *dbStore) {
+		s.expiry = e
+	}
 }
 
 // New returns a new postgres storage instance.
-func New(db *DB) Storage {
-	return &dbStore{db}
+func New(db *DB, opts ...Option) Storage {
+	s := &dbStore{db: db, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.log == nil {
+		s.log = logging.New(nil, "pg")
+	}
+	s.conn = s.wrap(db)
+	return s
 }
 
 // CreateSchemas creates the schemata, if they do not exist yet in the database. Returns an error if something went wrong.
 func (s *dbStore) CreateSchemas() error {
 	for k, schema := range schemas {
-		if _, err := s.db.Exec(schema); err != nil {
-			log.Printf("Error creating schema %d: %s", k, schema)
+		if _, err := s.conn.Exec(schema); err != nil {
+			s.log.Error("create schema failed", "index", k, "err", err)
 			return err
 		}
 	}
@@ -54,63 +109,99 @@ func (s *dbStore) Close() {
 }
 
 // GetClient loads the client by id
-func (s *dbStore) GetClient(id string) (osin.Client, error) {
-	var c = new(Client)
-	err := s.db.Model(c).Where("id = ?", id).Select()
-	if err == dbErrNoRows {
-		return nil, errNotFound
-	} else if err != nil {
-		log.Printf("get client %s err: %s", id, err)
+func (s *dbStore) GetClient(id string) (_ osin.Client, err error) {
+	s, done := s.op("GetClient", tracing.ClientID(id))
+	defer func() { err = done(err) }()
+	var c = &Client{ID: id}
+	err = s.conn.Select(c)
+	if err != nil {
+		if !errors.Is(err, dbErrNoRows) {
+			s.log.Error("load client failed", "client_id", id, "err", err)
+		}
+		return nil, err
 	}
-	return c, err
+	return c, nil
 }
 
 // SaveClient stores the client in the database and returns an error, if something went wrong.
+// An update increments the version of the client.
 func (s *dbStore) SaveClient(c storage.Client) (err error) {
+	s, done := s.op("SaveClient", tracing.ClientID(c.GetId()))
+	defer func() { err = done(err) }()
+	return s.saveClient(c, -1)
+}
+
+// UpdateClient updates the client if its stored version is version, and increments the version.
+// It returns a storage.ErrConflict if the client is updated since.
+func (s *dbStore) UpdateClient(c storage.Client, version int) (err error) {
+	s, done := s.op("UpdateClient", tracing.ClientID(c.GetId()))
+	defer func() { err = done(err) }()
+	return s.saveClient(c, version)
+}
+
+// saveClient updates the client of the version, or of any version and inserts it if not found with -1
+func (s *dbStore) saveClient(c storage.Client, version int) error {
 	_c := NewClient(c.GetId(), c.GetSecret(), c.GetRedirectUri())
-	if _c.GetId() == "" {
-		return errNilClient
-	}
 	data := c.GetUserData()
 	if extra, ok := data.(ClientMeta); ok {
 		_c.Meta = extra
 	}
-	err = s.db.RunInTransaction(func(tx *Tx) (err error) {
-		var created time.Time
-		_, err = tx.QueryOne(ormScan(&created), "SELECT created FROM oauth.client WHERE id = ?", _c.ID)
-		if err == nil {
-			_, err = tx.Model(_c).
-				Column("secret", "redirect_uri", "meta").
-				Where("id = ?", c.GetId()).
-				Returning("*").
-				Update()
-		} else {
-			err = tx.Insert(_c)
+	if err := _c.Validate(); err != nil {
+		return err
+	}
+	return s.db.RunInTransaction(func(tx *Tx) (err error) {
+		db := s.wrap(tx)
+		var stored int
+		_, err = db.QueryOne(ormScan(&stored), "SELECT version FROM oauth.client WHERE id = ? FOR UPDATE", _c.ID)
+		switch {
+		case err == nil && version >= 0 && stored != version:
+			return fmt.Errorf("%w: client %s of version %d, not %d", storage.ErrConflict, _c.ID, stored, version)
+		case err == nil:
+			_, err = db.QueryOne(_c, `UPDATE oauth.client SET secret = ?, redirect_uri = ?, meta = ?, version = version + 1, updated = now()
+				 WHERE id = ? RETURNING *`,
+				_c.Secret, _c.RedirectURI, _c.Meta, _c.ID)
+		case errors.Is(err, dbErrNoRows) && version < 0:
+			_c.Version, _c.UpdatedAt = 1, _c.CreatedAt
+			err = db.Insert(_c)
 		}
-		return
+		if err != nil {
+			return
+		}
+		if oc, ok := c.(*Client); ok {
+			oc.CreatedAt, oc.Version, oc.UpdatedAt = _c.CreatedAt, _c.Version, _c.UpdatedAt
+		}
+		return s.enqueue(db, outbox.ClientSaved(_c))
 	})
-
-	return
 }
 
 // RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
 func (s *dbStore) RemoveClient(code string) (err error) {
-	var c Client
-	_, err = s.db.Model(&c).Where("id = ?", code).Delete()
-	return
+	s, done := s.op("RemoveClient", tracing.ClientID(code))
+	defer func() { err = done(err) }()
+	return s.db.RunInTransaction(func(tx *Tx) error {
+		db := s.wrap(tx)
+		res, err := db.Exec("DELETE FROM oauth.client WHERE id = ?", code)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() > 0 {
+			return s.enqueue(db, outbox.ClientRemoved(code))
+		}
+		return nil
+	})
 }
 
 // SaveAuthorize saves authorize data.
 func (s *dbStore) SaveAuthorize(data *osin.AuthorizeData) (err error) {
-	if _, err = ToJSONKV(data.UserData); err != nil {
-		log.Printf("authorized.userdata %+v", data.UserData)
+	s, done := s.op("SaveAuthorize", tracing.Token(data.Code))
+	defer func() { err = done(err) }()
+	var extra JSONKV
+	if extra, err = ToJSONKV(data.UserData); err != nil {
+		s.log.Warn("invalid authorize userdata", "code", data.Code, "err", err)
 		return
 	}
-	if data.UserData == nil {
-		data.UserData = JSONKV{}
-	}
 
-	_, err = s.db.Exec(
+	_, err = s.conn.Exec(
 		"INSERT INTO oauth.authorize (client_id, code, expires_in, scopes, redirect_uri, state, created, extra) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		data.Client.GetId(),
 		data.Code,
@@ -119,28 +210,30 @@ func (s *dbStore) SaveAuthorize(data *osin.AuthorizeData) (err error) {
 		data.RedirectUri,
 		data.State,
 		data.CreatedAt,
-		data.UserData,
+		extra,
 	)
 	if err != nil {
-		log.Printf("SaveAuthorize error %s", err)
+		s.log.Error("save authorize failed", "code", data.Code, "err", err)
 	}
 	return
 }
 
 // LoadAuthorize looks up AuthorizeData by a code.
 // Client information MUST be loaded together.
-// Optionally can return error if expired.
-func (s *dbStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+// Returns an ErrExpired if expired and the expiry policy is enforced.
+func (s *dbStore) LoadAuthorize(code string) (_ *osin.AuthorizeData, err error) {
+	s, done := s.op("LoadAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
 	var data osin.AuthorizeData
 	var extra JSONKV
 	var cid string
 	scan := ormScan(&cid, &data.Code, &data.ExpiresIn, &data.Scope, &data.RedirectUri, &data.State, &data.CreatedAt, &extra)
-	_, err := s.db.QueryOne(scan, "SELECT client_id, code, expires_in, scopes, redirect_uri, state, created, extra FROM oauth.authorize WHERE code=? LIMIT 1", code)
-	if err == dbErrNoRows {
-		return nil, errNotFound
-	} else if err != nil {
-		log.Printf("db error: %s", err)
-		return nil, errDatabase
+	_, err = s.conn.QueryOne(scan, "SELECT client_id, code, expires_in, scopes, redirect_uri, state, created, extra FROM oauth.authorize WHERE code=? LIMIT 1", code)
+	if err != nil {
+		if !errors.Is(err, dbErrNoRows) {
+			s.log.Error("load authorize failed", "code", code, "err", err)
+		}
+		return nil, err
 	}
 	data.UserData = extra
 
@@ -149,8 +242,8 @@ func (s *dbStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 		return nil, err
 	}
 
-	if data.ExpireAt().Before(time.Now()) {
-		return nil, fmt.Errorf("Token expired at %s.", data.ExpireAt().String())
+	if err = s.expiry.CheckAuthorize(&data); err != nil {
+		return nil, err
 	}
 
 	data.Client = c
@@ -159,18 +252,24 @@ func (s *dbStore) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 
 // RemoveAuthorize revokes or deletes the authorization code.
 func (s *dbStore) RemoveAuthorize(code string) (err error) {
-	_, err = s.db.Exec("DELETE FROM oauth.authorize WHERE code=?", code)
-	return nil
+	s, done := s.op("RemoveAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
+	_, err = s.conn.Exec("DELETE FROM oauth.authorize WHERE code=?", code)
+	if err != nil {
+		s.log.Error("remove authorize failed", "code", code, "err", err)
+	}
+	return
 }
 
-// SaveAccess writes AccessData.
+// SaveAccess writes AccessData and its refresh token in one transaction, saving a token again is a no-op.
+// A token refreshed from a previous one is saved with the code of the previous one.
 // If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
 func (s *dbStore) SaveAccess(data *osin.AccessData) (err error) {
-	_, err = s.LoadAccess(data.AccessToken)
-	if err == nil {
-		return nil
-	} else if err != errNotFound {
-		return
+	s, done := s.op("SaveAccess", tracing.Token(data.AccessToken))
+	defer func() { err = done(err) }()
+	if data.Client == nil {
+		s.log.Warn("access client is nil", "token", data.AccessToken)
+		return errNilClient
 	}
 	prev := ""
 	authorizeData := &osin.AuthorizeData{}
@@ -187,65 +286,95 @@ func (s *dbStore) SaveAccess(data *osin.AccessData) (err error) {
 		extra JSONKV
 	)
 	if extra, err = ToJSONKV(data.UserData); err != nil {
-		log.Printf("access.userdata %+v", data.UserData)
+		s.log.Warn("invalid access userdata", "token", data.AccessToken, "err", err)
 		return
 	}
 
 	return s.db.RunInTransaction(func(tx *Tx) (err error) {
-		if data.RefreshToken != "" {
-			if err = s.saveRefresh(tx, data.RefreshToken, data.AccessToken); err != nil {
-				log.Printf("save refresh error %s", err)
-				return
+		db := s.wrap(tx)
+		code := authorizeData.Code
+		if code == "" && prev != "" {
+			// a refreshed token carries the code of its chain, a reuse of the code revokes it too
+			_, err = db.QueryOne(ormScan(&code), "SELECT authorize_code FROM oauth.access WHERE access_token = ?", storage.SavedKey(prev))
+			if err != nil && !errors.Is(err, dbErrNoRows) {
+				return err
 			}
 		}
-
-		if data.Client == nil {
-			log.Print("access.client is nil")
-			return errNilClient
-		}
-
-		_, err = tx.Exec("INSERT INTO oauth.access (client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-			data.Client.GetId(), authorizeData.Code, prev, data.AccessToken, data.RefreshToken, data.ExpiresIn, data.Scope, data.RedirectUri, data.CreatedAt, extra)
+		res, err := db.Exec("INSERT INTO oauth.access (client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (access_token) DO NOTHING",
+			data.Client.GetId(), code, storage.SavedKey(prev), storage.SavedKey(data.AccessToken),
+			storage.SavedKey(data.RefreshToken), data.ExpiresIn, data.Scope, data.RedirectUri, data.CreatedAt, extra)
 		if err != nil {
-			log.Printf("insert error %s", err)
+			s.log.Error("save access failed", "token", data.AccessToken, "err", err)
 			return err
 		}
-		log.Print("save access OK")
+		// saved already, with its refresh token
+		if res.RowsAffected() == 0 {
+			return nil
+		}
+		s.log.Debug("saved access", "token", data.AccessToken, "client_id", data.Client.GetId())
 
-		return
+		if data.RefreshToken != "" {
+			if err = s.saveRefresh(db, data); err != nil {
+				s.log.Error("save refresh failed", "token", data.AccessToken, "err", err)
+				return err
+			}
+		}
+
+		return s.enqueue(db, outbox.TokenIssued(data))
 	})
 
 }
 
 // LoadAccess retrieves access data by token. Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
-// Optionally can return error if expired.
-func (s *dbStore) LoadAccess(code string) (*osin.AccessData, error) {
+// Returns an ErrExpired if expired and the expiry policy is enforced.
+func (s *dbStore) LoadAccess(code string) (_ *osin.AccessData, err error) {
+	s, done := s.op("LoadAccess", tracing.Token(code))
+	defer func() { err = done(err) }()
+	return s.loadAccess(storage.TokenKey(code), code)
+}
+
+// loadSaved loads a token by the key saved in a chain or a refresh token, traced as LoadAccess
+func (s *dbStore) loadSaved(key string) (_ *osin.AccessData, err error) {
+	s, done := s.op("LoadAccess", tracing.Token(key))
+	defer func() { err = done(err) }()
+	return s.loadAccess(key, key)
+}
+
+// loadAccess loads the token by its key, the previous tokens are loaded by the keys saved and carry them
+func (s *dbStore) loadAccess(key, code string) (*osin.AccessData, error) {
 	var cid, prevAccessToken, authorizeCode string
-	var result osin.AccessData
+	result := osin.AccessData{AccessToken: code}
 	var extra JSONKV
+	var frozen bool
 
 	sc := ormScan(
 		&cid,
 		&authorizeCode,
 		&prevAccessToken,
-		&result.AccessToken,
+		&key,
 		&result.RefreshToken,
 		&result.ExpiresIn,
 		&result.Scope,
 		&result.RedirectUri,
 		&result.CreatedAt,
 		&extra,
+		&frozen,
 	)
-	_, err := s.db.QueryOne(sc,
-		"SELECT client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra FROM oauth.access WHERE access_token=? LIMIT 1",
-		code,
+	_, err := s.conn.QueryOne(sc,
+		"SELECT client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra, is_frozen FROM oauth.access WHERE access_token=? LIMIT 1",
+		key,
 	)
-	if err == dbErrNoRows {
-		return nil, errNotFound
-	} else if err != nil {
-		return nil, errDatabase
+	if err != nil {
+		return nil, err
 	}
+	if frozen {
+		return nil, storage.ErrFrozen
+	}
+	if err = s.expiry.CheckAccess(&result); err != nil {
+		return nil, err
+	}
+	s = s.lax()
 
 	result.UserData = extra
 	client, err := s.GetClient(cid)
@@ -255,43 +384,128 @@ func (s *dbStore) LoadAccess(code string) (*osin.AccessData, error) {
 
 	result.Client = client
 	result.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
-	prevAccess, _ := s.LoadAccess(prevAccessToken)
+	prevAccess, _ := s.loadSaved(prevAccessToken)
 	result.AccessData = prevAccess
 	return &result, nil
 }
 
 // RemoveAccess revokes or deletes an AccessData.
 func (s *dbStore) RemoveAccess(code string) (err error) {
-	_, err = s.db.Exec("DELETE FROM oauth.access WHERE access_token=?", code)
-	return
+	s, done := s.op("RemoveAccess", tracing.Token(code))
+	defer func() { err = done(err) }()
+	return s.db.RunInTransaction(func(tx *Tx) error {
+		db := s.wrap(tx)
+		res, err := db.Exec("DELETE FROM oauth.access WHERE access_token=?", storage.SavedKey(code))
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() > 0 {
+			return s.enqueue(db, outbox.TokenRevoked(code))
+		}
+		return nil
+	})
 }
 
 // LoadRefresh retrieves refresh AccessData. Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
-// Optionally can return error if expired.
-func (s *dbStore) LoadRefresh(code string) (*osin.AccessData, error) {
-	var access string
-	_, err := s.db.QueryOne(ormScan(&access), "SELECT access FROM oauth.refresh WHERE token=? LIMIT 1", code)
-	if err == dbErrNoRows {
-		return nil, errNotFound
-	} else if err != nil {
+// Returns an ErrExpired if expired by the refresh policy, the access token may be expired.
+func (s *dbStore) LoadRefresh(code string) (_ *osin.AccessData, err error) {
+	s, done := s.op("LoadRefresh", tracing.Token(code))
+	defer func() { err = done(err) }()
+	var (
+		access string
+		r      storage.RefreshToken
+	)
+	_, err = s.conn.QueryOne(ormScan(&access, &r.Created, &r.Started, &r.ExpiresAt),
+		"SELECT access, created, started, expires_at FROM oauth.refresh WHERE token=? LIMIT 1", storage.TokenKey(code))
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.lax().loadSaved(access)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.expiry.CheckRefreshToken(a, r); err != nil {
 		return nil, err
 	}
-	return s.LoadAccess(access)
+	return a, nil
+}
+
+// lax returns a copy of s without the expiry policy, for the nested and internal loads
+func (s *dbStore) lax() *dbStore {
+	if !s.expiry.Enforce {
+		return s
+	}
+	c := *s
+	c.expiry.Enforce = false
+	return &c
 }
 
 // RemoveRefresh revokes or deletes refresh AccessData.
-func (s *dbStore) RemoveRefresh(code string) error {
-	_, err := s.db.Exec("DELETE FROM oauth.refresh WHERE token=?", code)
-	return err
+func (s *dbStore) RemoveRefresh(code string) (err error) {
+	s, done := s.op("RemoveRefresh", tracing.Token(code))
+	defer func() { err = done(err) }()
+	return s.db.RunInTransaction(func(tx *Tx) error {
+		db := s.wrap(tx)
+		res, err := db.Exec("DELETE FROM oauth.refresh WHERE token=?", storage.SavedKey(code))
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() > 0 {
+			return s.enqueue(db, outbox.RefreshRevoked(code))
+		}
+		return nil
+	})
+}
+
+// saveRefresh writes the refresh token of data, in the rotation chain of the previous token
+func (s *dbStore) saveRefresh(tx ormDB, data *osin.AccessData) (err error) {
+	token, access := storage.SavedKey(data.RefreshToken), storage.SavedKey(data.AccessToken)
+	if storage.RefreshReused(data) {
+		// kept on refresh, with the lifetime of its first issue
+		var r storage.RefreshToken
+		_, err = tx.QueryOne(ormScan(&r.Created, &r.Started), "SELECT created, started FROM oauth.refresh WHERE token = ?", token)
+		if err == nil {
+			r = s.expiry.ReuseRefreshToken(r)
+			_, err = tx.Exec("UPDATE oauth.refresh SET access = ?, created = ? WHERE token = ?",
+				access, r.Created, token)
+			return
+		}
+		if !errors.Is(err, dbErrNoRows) {
+			return
+		}
+	}
+	var started time.Time
+	if prev := data.AccessData; prev != nil {
+		_, err = tx.QueryOne(ormScan(&started), "SELECT started FROM oauth.refresh WHERE access = ?", storage.SavedKey(prev.AccessToken))
+		if err != nil && !errors.Is(err, dbErrNoRows) {
+			return
+		}
+		// the previous refresh token may be removed already, its access token is in the chain
+		if started.IsZero() {
+			started = prev.CreatedAt
+		}
+	}
+	r := s.expiry.NewRefreshToken(data, started)
+	_, err = tx.Exec("INSERT INTO oauth.refresh (token, access, created, started, expires_at) VALUES (?, ?, ?, ?, ?)",
+		token, access, r.Created, r.Started, pg.NullTime{Time: r.ExpiresAt})
+	return
 }
 
-func (s *dbStore) saveRefresh(tx *Tx, refresh, access string) (err error) {
-	_, err = tx.Exec("INSERT INTO oauth.refresh (token, access) VALUES (?, ?)", refresh, access)
+// CountActive counts the clients, the codes and tokens not expired, and the refresh tokens
+func (s *dbStore) CountActive() (c storage.Counts, err error) {
+	s, done := s.op("CountActive")
+	defer func() { err = done(err) }()
+	_, err = s.conn.QueryOne(ormScan(&c.Clients, &c.Codes, &c.Tokens, &c.Refreshes), `SELECT (SELECT COUNT(*) FROM oauth.client),
+		(SELECT COUNT(*) FROM oauth.authorize WHERE created + expires_in * interval '1 second' > now()),
+		(SELECT COUNT(*) FROM oauth.access WHERE created + expires_in * interval '1 second' > now()),
+		(SELECT COUNT(*) FROM oauth.refresh)`)
 	return
 }
 
 func (s *dbStore) AllClients() (data []Client, err error) {
-	err = s.db.Model(&data).Select()
+	s, done := s.op("AllClients")
+	defer func() { err = done(err) }()
+	_, err = s.conn.Query(&data, "SELECT id, secret, redirect_uri, meta, created, version, updated FROM oauth.client")
 	return
 }
@@ -1,10 +1,12 @@
 package pg
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	// "reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,8 +15,12 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
+	"github.com/liut/osin-storage/storage/tracing"
 )
 
 var _ = fmt.Sprintf
@@ -70,6 +76,16 @@ func envOr(key, dft string) string {
 	return v
 }
 
+func TestRemoveAuthorizeError(t *testing.T) {
+	down := pg.Connect(&pg.Options{Addr: "localhost:1", User: "sso", Database: "ssotest"})
+	defer down.Close()
+	err := New(down).RemoveAuthorize("code")
+	assert.ErrorIs(t, err, storage.ErrDatabase)
+	var se *storage.Error
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, "RemoveAuthorize", se.Op)
+}
+
 func TestClientOperations(t *testing.T) {
 	create := &Client{ID: "1", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
 	createClient(t, store, create)
@@ -288,22 +304,37 @@ func TestRefreshOperations(t *testing.T) {
 }
 
 func TestErrors(t *testing.T) {
-	client := &Client{ID: "dupe", Meta: clientMetaEmpty}
+	client := &Client{ID: "dupe", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
 	assert.Nil(t, store.SaveClient(client))
 	// assert.NotNil(t, store.SaveClient(client))
-	assert.NotNil(t, store.SaveClient(&Client{ID: "", Meta: clientMetaEmpty}))
+	assert.ErrorIs(t, store.SaveClient(&Client{ID: "", Meta: clientMetaEmpty}), storage.ErrInvalidClient)
+	assert.ErrorIs(t, store.SaveClient(&Client{ID: "dupe", Meta: clientMetaEmpty}), storage.ErrInvalidClient)
+	assert.ErrorIs(t, store.SaveClient(&Client{ID: "public", Secret: "secret", RedirectURI: "http://localhost/",
+		Meta: ClientMeta{TokenEndpointAuthMethod: oauth.AuthNone}}), storage.ErrInvalidClient)
 	assert.NotNil(t, store.SaveAccess(&osin.AccessData{AccessToken: "", AccessData: &osin.AccessData{}, AuthorizeData: &osin.AuthorizeData{}}))
 	assert.Nil(t, store.SaveAuthorize(&osin.AuthorizeData{Code: "a", Client: client, UserData: userDataMock}))
 	assert.NotNil(t, store.SaveAuthorize(&osin.AuthorizeData{Code: "a", Client: client}))
 	assert.NotNil(t, store.SaveAuthorize(&osin.AuthorizeData{Code: "b", Client: client}))
 	_, err := store.LoadAccess("")
-	assert.Equal(t, errNotFound, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
 	_, err = store.LoadAuthorize("")
-	assert.Equal(t, errNotFound, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
 	_, err = store.LoadRefresh("")
-	assert.Equal(t, errNotFound, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
 	_, err = store.GetClient("")
-	assert.Equal(t, errNotFound, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	_, err = db.Exec("UPDATE oauth.access SET is_frozen = true WHERE access_token = ?", access.AccessToken)
+	require.Nil(t, err)
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.ErrorIs(t, err, storage.ErrFrozen)
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, storage.ErrFrozen)
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+	require.Nil(t, store.RemoveRefresh(access.RefreshToken))
 }
 
 func getClient(t *testing.T, store storage.Storage, set storage.Client) {
@@ -327,3 +358,205 @@ func updateClient(t *testing.T, store storage.Storage, set storage.Client) {
 func removeClient(t *testing.T, store storage.Storage, set storage.Client) {
 	require.Nil(t, store.RemoveClient(set.GetId()))
 }
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	traced := New(db, WithTracerProvider(tp))
+
+	client := &Client{ID: "traced", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, traced.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, traced.SaveAccess(access))
+	defer store.RemoveAccess(access.AccessToken)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	_, err := traced.WithContext(ctx).LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	parent.End()
+
+	var load sdktrace.ReadOnlySpan
+	for _, span := range rec.Ended() {
+		if span.Name() == "pg.LoadAccess" && span.Parent().SpanID() == parent.SpanContext().SpanID() {
+			load = span
+		}
+	}
+	require.NotNil(t, load)
+	assert.Contains(t, load.Attributes(), tracing.Token(access.AccessToken))
+
+	var children []string
+	for _, span := range rec.Ended() {
+		if span.Parent().SpanID() != load.SpanContext().SpanID() {
+			continue
+		}
+		children = append(children, span.Name())
+		for _, kv := range span.Attributes() {
+			assert.NotContains(t, kv.Value.Emit(), access.AccessToken)
+		}
+		if span.Name() == "SELECT" {
+			assert.Contains(t, span.Attributes(), tracing.SystemKey.String("postgresql"))
+		}
+	}
+	assert.Subset(t, children, []string{"SELECT", "pg.GetClient", "pg.LoadAuthorize", "pg.LoadAccess"})
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now().Round(time.Second)
+	s := New(db, WithExpiry(storage.Expiry{Enforce: true, Skew: time.Minute, Refresh: storage.RefreshPolicy{TTL: time.Hour},
+		Now: func() time.Time { return now }}))
+
+	client := &Client{ID: "expiry", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, s.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60,
+		CreatedAt: now.Add(-90 * time.Second), UserData: userDataMock}
+	require.Nil(t, s.SaveAuthorize(authorize))
+	defer store.RemoveAuthorize(authorize.Code)
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: now.Add(-30 * time.Minute), UserData: userDataMock}
+	require.Nil(t, s.SaveAccess(access))
+	require.Nil(t, s.SaveAccess(access))
+	defer store.RemoveAccess(access.AccessToken)
+
+	_, err := s.LoadAuthorize(authorize.Code)
+	assert.Nil(t, err)
+	_, err = s.LoadAccess(access.AccessToken)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	_, err = s.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+
+	now = now.Add(2 * time.Hour)
+	_, err = s.LoadAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	_, err = s.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.Nil(t, err)
+}
+
+func TestConsumeAuthorize(t *testing.T) {
+	s := New(db)
+	consumer := s.(storage.AuthorizeConsumer)
+
+	client := &Client{ID: "consume", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, s.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, s.SaveAuthorize(authorize))
+	defer store.RemoveAuthorize(authorize.Code)
+
+	// a lookup never consumes the code
+	_, err := s.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	_, err = consumer.ConsumeAuthorize(authorize.Code)
+	require.Nil(t, err)
+	_, err = s.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, s.SaveAccess(access))
+	refreshed := &osin.AccessData{Client: client, AccessData: access, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, s.SaveAccess(refreshed))
+
+	// a reuse revokes the tokens issued with the code
+	_, err = consumer.ConsumeAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, storage.ErrReused)
+	for _, token := range []string{access.AccessToken, refreshed.AccessToken} {
+		_, err = store.LoadAccess(token)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	}
+	_, err = store.LoadRefresh(refreshed.RefreshToken)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// an empty code revokes not the tokens issued without one
+	credentials := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, s.SaveAccess(credentials))
+	defer store.RemoveAccess(credentials.AccessToken)
+	_, err = consumer.ConsumeAuthorize("")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.LoadAccess(credentials.AccessToken)
+	assert.Nil(t, err)
+}
+
+func TestConsumeAuthorizeRefreshed(t *testing.T) {
+	client := &Client{ID: "consume-refreshed", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, store.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	_, err := store.(storage.AuthorizeConsumer).ConsumeAuthorize(authorize.Code)
+	require.Nil(t, err)
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	require.Nil(t, store.RemoveAuthorize(authorize.Code))
+
+	// the refresh grant of osin: a token without the code, then the previous one is removed
+	refreshed := &osin.AccessData{Client: client, AccessData: access, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(refreshed))
+	require.Nil(t, store.RemoveRefresh(access.RefreshToken))
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+
+	// a reuse of the code revokes the refreshed token
+	_, err = store.(storage.AuthorizeConsumer).ConsumeAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, storage.ErrReused)
+	_, err = store.LoadAccess(refreshed.AccessToken)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.LoadRefresh(refreshed.RefreshToken)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestSaveAccessConcurrently(t *testing.T) {
+	client := &Client{ID: "concurrent", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, store.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	defer store.RemoveAccess(access.AccessToken)
+	defer store.RemoveRefresh(access.RefreshToken)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.SaveAccess(access)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+
+	// a failed refresh rolls the access token back
+	other := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: access.RefreshToken,
+		ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	assert.ErrorIs(t, store.SaveAccess(other), storage.ErrConflict)
+	_, err := store.LoadAccess(other.AccessToken)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	a, err := store.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.AccessToken, a.AccessToken)
+}
+
+func TestUpdateClient(t *testing.T) {
+	client := &Client{ID: "versioned", Secret: "secret", RedirectURI: "http://localhost/", Meta: clientMetaEmpty}
+	require.Nil(t, store.SaveClient(client))
+	defer store.RemoveClient(client.ID)
+	assert.Equal(t, 1, client.Version)
+
+	update := *client
+	update.RedirectURI = "http://localhost/update"
+	require.Nil(t, store.UpdateClient(&update, 1))
+	assert.Equal(t, 2, update.Version)
+	assert.ErrorIs(t, store.UpdateClient(client, 1), storage.ErrConflict)
+	assert.ErrorIs(t, store.UpdateClient(NewClient("unknown", "secret", "http://localhost/"), 1), storage.ErrNotFound)
+}
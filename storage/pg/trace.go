@@ -0,0 +1,140 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/tracing"
+)
+
+// WithTracerProvider traces the storage methods and their statements with the tracers of tp,
+// nil for the global provider. The spans are children of the context given by WithContext.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *dbStore) {
+		s.tracer = tracing.Tracer(tp)
+	}
+}
+
+// WithContext returns a copy of the storage, whose spans are children of ctx
+func (s *dbStore) WithContext(ctx context.Context) Storage {
+	c := *s
+	c.ctx = ctx
+	c.conn = c.wrap(s.db)
+	return &c
+}
+
+// op starts a storage method, and returns a copy of s in its span, the nested methods and statements
+// of the copy are children of the span. done ends the span and returns err as a storage.Error of the method.
+func (s *dbStore) op(method string, attrs ...attribute.KeyValue) (_ *dbStore, done func(error) error) {
+	if s.tracer == nil {
+		return s, func(err error) error { return storage.AsError(method, err, errKind) }
+	}
+	ctx, span := s.tracer.Start(s.ctx, "pg."+method, trace.WithAttributes(attrs...))
+	c := *s
+	c.ctx = ctx
+	c.conn = c.wrap(s.db)
+	return &c, func(err error) error {
+		err = storage.AsError(method, err, errKind)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// wrap returns db or tx, traced in the context of s
+func (s *dbStore) wrap(db ormDB) ormDB {
+	if s.tracer == nil {
+		return db
+	}
+	return tracedDB{db, s.ctx, s.tracer}
+}
+
+// tracedDB is an ormDB with a span by statement
+type tracedDB struct {
+	ormDB
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func (db tracedDB) start(query interface{}) trace.Span {
+	str, ok := query.(string)
+	if !ok {
+		str = fmt.Sprint(query)
+	}
+	_, span := db.tracer.Start(db.ctx, tracing.Operation(str),
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(tracing.Statement("postgresql", str)...))
+	return span
+}
+
+// startModel starts the span of an operation of a model
+func (db tracedDB) startModel(op string, model interface{}) trace.Span {
+	_, span := db.tracer.Start(db.ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		tracing.SystemKey.String("postgresql"),
+		tracing.OperationKey.String(op),
+		attribute.String("db.model", fmt.Sprintf("%T", model)),
+	))
+	return span
+}
+
+func (db tracedDB) Select(model interface{}) (err error) {
+	span := db.startModel("SELECT", model)
+	err = db.ormDB.Select(model)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) Insert(model ...interface{}) (err error) {
+	var m interface{}
+	if len(model) > 0 {
+		m = model[0]
+	}
+	span := db.startModel("INSERT", m)
+	err = db.ormDB.Insert(model...)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) Update(model interface{}) (err error) {
+	span := db.startModel("UPDATE", model)
+	err = db.ormDB.Update(model)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) Delete(model interface{}) (err error) {
+	span := db.startModel("DELETE", model)
+	err = db.ormDB.Delete(model)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) Exec(query interface{}, params ...interface{}) (r Result, err error) {
+	span := db.start(query)
+	r, err = db.ormDB.Exec(query, params...)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) ExecOne(query interface{}, params ...interface{}) (r Result, err error) {
+	span := db.start(query)
+	r, err = db.ormDB.ExecOne(query, params...)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) Query(model, query interface{}, params ...interface{}) (r Result, err error) {
+	span := db.start(query)
+	r, err = db.ormDB.Query(model, query, params...)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) QueryOne(model, query interface{}, params ...interface{}) (r Result, err error) {
+	span := db.start(query)
+	r, err = db.ormDB.QueryOne(model, query, params...)
+	tracing.End(span, err)
+	return
+}
@@ -0,0 +1,33 @@
+package pgxstore
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// errors, the methods return a storage.Error of the kinds of package storage
+var (
+	ErrNotFound     = storage.ErrNotFound
+	ErrInvalidValue = storage.ErrInvalidValue
+)
+
+// errKind classifies an error of the database
+func errKind(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	var pe *pgconn.PgError
+	if errors.As(err, &pe) && pe.Code == "23505" {
+		return storage.ErrConflict
+	}
+	return storage.ErrDatabase
+}
+
+// wrap sets *err to a storage.Error of the method op
+func wrap(op string, err *error) {
+	*err = storage.AsError(op, *err, errKind)
+}
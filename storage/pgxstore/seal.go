@@ -0,0 +1,71 @@
+package pgxstore
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+const resealBatch = 100
+
+// sealedColumns are the JSON columns sealed by oauth.SetKeyring, with the key column of their table
+var sealedColumns = []struct{ table, key, column string }{
+	{"oauth.client", "id", "meta"},
+	{"oauth.authorize", "code", "extra"},
+	{"oauth.access", "access_token", "extra"},
+}
+
+type sealedRow struct {
+	key  string
+	data []byte
+}
+
+// Reseal seals the JSON columns again with the primary key of k, after a key rotation
+// or to encrypt existing rows, and returns the number of rows updated.
+// The old keys must still be in k.
+func (s *Store) Reseal(ctx context.Context, k *oauth.Keyring) (n int, err error) {
+	defer wrap("Reseal", &err)
+	for _, sc := range sealedColumns {
+		var last string
+		for {
+			rows, err := s.db.Query(ctx,
+				"SELECT "+sc.key+", "+sc.column+" FROM "+sc.table+" WHERE "+sc.key+" > $1 ORDER BY "+sc.key+" LIMIT $2",
+				last, resealBatch)
+			if err != nil {
+				return n, err
+			}
+			batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (r sealedRow, err error) {
+				err = row.Scan(&r.key, &r.data)
+				return
+			})
+			if err != nil {
+				return n, err
+			}
+
+			b := &pgx.Batch{}
+			for _, r := range batch {
+				out, changed, err := k.Reseal(r.data)
+				if err != nil {
+					return n, err
+				}
+				if changed {
+					b.Queue("UPDATE "+sc.table+" SET "+sc.column+" = $1 WHERE "+sc.key+" = $2", string(out), r.key)
+				}
+			}
+			if b.Len() > 0 {
+				if err = s.db.SendBatch(ctx, b).Close(); err != nil {
+					return n, err
+				}
+				n += b.Len()
+			}
+
+			if len(batch) < resealBatch {
+				break
+			}
+			last = batch[len(batch)-1].key
+		}
+	}
+	return
+}
@@ -0,0 +1,531 @@
+// Package pgxstore is a osin storage implementation for postgres on a pgx connection pool.
+package pgxstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/logging"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var (
+	_ oauth.Store           = (*Store)(nil)
+	_ storage.ClientUpdater = (*Store)(nil)
+	_ storage.ActiveCounter = (*Store)(nil)
+)
+
+// maxChain limits the previous tokens loaded with LoadAccess
+const maxChain = 32
+
+// Store implements oauth.Store on pgx, with the schema of storage/database/oauth_schema.sql.
+// Use oauth.AsStorage for a storage.Storage.
+type Store struct {
+	db  DB
+	opt Options
+	log *slog.Logger
+}
+
+// Options of the Store
+type Options struct {
+	// Expiry is the policy on load
+	Expiry storage.Expiry
+	// Logger is the handler of the logs, default is the handler of slog.Default().
+	// Codes and tokens are logged as hashes, and user data is never logged.
+	Logger slog.Handler
+}
+
+// New returns a new pgx storage instance, db is usually a *pgxpool.Pool
+func New(db DB, opts ...Options) *Store {
+	s := &Store{db: db}
+	if len(opts) > 0 {
+		s.opt = opts[0]
+	}
+	s.log = logging.New(s.opt.Logger, "pgxstore")
+	return s
+}
+
+// Clone the storage
+func (s *Store) Clone() osin.Storage {
+	return s
+}
+
+// Close the storage, the pool is owned by the caller
+func (s *Store) Close() {
+}
+
+// GetClient loads the client by id
+func (s *Store) GetClient(id string) (_ osin.Client, err error) {
+	defer wrap("GetClient", &err)
+	c, err := s.LoadClient(id)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadClient loads the client by id
+func (s *Store) LoadClient(id string) (_ *oauth.Client, err error) {
+	defer wrap("LoadClient", &err)
+	c := new(oauth.Client)
+	err = s.db.QueryRow(context.Background(),
+		"SELECT id, secret, redirect_uri, meta, created, version, updated FROM oauth.client WHERE id = $1", id).
+		Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var clientOrders = map[string]string{
+	"id":       "id",
+	"-id":      "id DESC",
+	"created":  "created",
+	"-created": "created DESC",
+}
+
+// LoadClients returns clients paged and ordered by spec, order by created by default
+func (s *Store) LoadClients(spec *oauth.ClientSpec) (clients []oauth.Client, err error) {
+	defer wrap("LoadClients", &err)
+	ctx := context.Background()
+	if spec == nil {
+		spec = &oauth.ClientSpec{}
+	}
+	spec.Total = int(s.CountClients())
+	if spec.CountOnly || spec.Total == 0 {
+		return
+	}
+	orders := make([]string, 0, len(spec.Orders))
+	for _, o := range spec.Orders {
+		if ob, ok := clientOrders[o]; ok {
+			orders = append(orders, ob)
+		}
+	}
+	if len(orders) == 0 {
+		orders = append(orders, "created")
+	}
+	str := "SELECT id, secret, redirect_uri, meta, created, version, updated FROM oauth.client ORDER BY " + strings.Join(orders, ", ")
+	if spec.Limit > 0 {
+		str += fmt.Sprintf(" LIMIT %d", spec.Limit)
+		if spec.Page > 1 {
+			str += fmt.Sprintf(" OFFSET %d", (spec.Page-1)*spec.Limit)
+		}
+	}
+	rows, err := s.db.Query(ctx, str)
+	if err != nil {
+		s.log.Error("load clients failed", "sql", str, "err", err)
+		return
+	}
+	defer rows.Close()
+	clients = make([]oauth.Client, 0)
+	for rows.Next() {
+		var c oauth.Client
+		if err = rows.Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt); err != nil {
+			return
+		}
+		clients = append(clients, c)
+	}
+	err = rows.Err()
+	return
+}
+
+// CountClients returns the number of clients
+func (s *Store) CountClients() (n uint) {
+	err := s.db.QueryRow(context.Background(), "SELECT COUNT(id) FROM oauth.client").Scan(&n)
+	if err != nil {
+		s.log.Error("count clients failed", "err", err)
+	}
+	return
+}
+
+// CountActive counts the clients, the codes and tokens not expired, and the refresh tokens
+func (s *Store) CountActive() (c storage.Counts, err error) {
+	defer wrap("CountActive", &err)
+	err = s.db.QueryRow(context.Background(), `SELECT (SELECT COUNT(*) FROM oauth.client),
+		(SELECT COUNT(*) FROM oauth.authorize WHERE created + expires_in * interval '1 second' > $1),
+		(SELECT COUNT(*) FROM oauth.access WHERE created + expires_in * interval '1 second' > $1),
+		(SELECT COUNT(*) FROM oauth.refresh)`, time.Now()).Scan(&c.Clients, &c.Codes, &c.Tokens, &c.Refreshes)
+	return
+}
+
+// SaveClient creates or updates the client, an update increments its version
+func (s *Store) SaveClient(c *oauth.Client) (err error) {
+	defer wrap("SaveClient", &err)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return s.db.QueryRow(context.Background(),
+		`INSERT INTO oauth.client AS c (id, secret, redirect_uri, meta) VALUES($1, $2, $3, $4)
+		 ON CONFLICT (id) DO UPDATE SET secret = EXCLUDED.secret, redirect_uri = EXCLUDED.redirect_uri, meta = EXCLUDED.meta,
+		  version = c.version + 1, updated = now()
+		 RETURNING created, version, updated`,
+		c.ID, c.Secret, c.RedirectURI, c.Meta).Scan(&c.CreatedAt, &c.Version, &c.UpdatedAt)
+}
+
+// UpdateClient updates the client if its stored version is version, and increments the version.
+// It returns a storage.ErrConflict if the client is updated since.
+func (s *Store) UpdateClient(client storage.Client, version int) (err error) {
+	defer wrap("UpdateClient", &err)
+	c := oauth.ClientOf(client)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	err = s.db.QueryRow(ctx,
+		`UPDATE oauth.client SET secret = $2, redirect_uri = $3, meta = $4, version = version + 1, updated = now()
+		 WHERE id = $1 AND version = $5 RETURNING created, version, updated`,
+		c.ID, c.Secret, c.RedirectURI, c.Meta, version).Scan(&c.CreatedAt, &c.Version, &c.UpdatedAt)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	var stored int
+	if err = s.db.QueryRow(ctx, "SELECT version FROM oauth.client WHERE id = $1", c.ID).Scan(&stored); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: client %s of version %d, not %d", storage.ErrConflict, c.ID, stored, version)
+}
+
+// RemoveClient removes the client by id
+func (s *Store) RemoveClient(id string) (err error) {
+	defer wrap("RemoveClient", &err)
+	_, err = s.db.Exec(context.Background(), "DELETE FROM oauth.client WHERE id = $1", id)
+	return err
+}
+
+// SaveAuthorize saves authorize data
+func (s *Store) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	defer wrap("SaveAuthorize", &err)
+	extra, err := oauth.ToJSONKV(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid authorize userdata", "code", data.Code, "err", err)
+		return err
+	}
+	if data.Client == nil {
+		return storage.ErrInvalidClient
+	}
+	_, err = s.db.Exec(context.Background(),
+		`INSERT INTO oauth.authorize(code, client_id, extra, redirect_uri, expires_in, scopes, state, created)
+		 VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		data.Code, data.Client.GetId(), extra, data.RedirectUri, data.ExpiresIn, data.Scope, data.State, data.CreatedAt)
+	return err
+}
+
+const selectAuthorize = `SELECT a.code, a.redirect_uri, a.expires_in, a.scopes, a.state, a.extra, a.created,
+	c.id, c.secret, c.redirect_uri, c.meta, c.created, c.version, c.updated
+	FROM oauth.authorize a JOIN oauth.client c ON c.id = a.client_id `
+
+func scanAuthorize(row pgx.Row) (*osin.AuthorizeData, error) {
+	var (
+		a     = new(osin.AuthorizeData)
+		c     = new(oauth.Client)
+		extra oauth.JSONKV
+	)
+	err := row.Scan(&a.Code, &a.RedirectUri, &a.ExpiresIn, &a.Scope, &a.State, &extra, &a.CreatedAt,
+		&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.Client = c
+	a.UserData = extra
+	return a, nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code, with its client in one query
+func (s *Store) LoadAuthorize(code string) (_ *osin.AuthorizeData, err error) {
+	defer wrap("LoadAuthorize", &err)
+	a, err := scanAuthorize(s.db.QueryRow(context.Background(), selectAuthorize+"WHERE a.code = $1", code))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAuthorize(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// RemoveAuthorize revokes the authorization code
+func (s *Store) RemoveAuthorize(code string) (err error) {
+	defer wrap("RemoveAuthorize", &err)
+	_, err = s.db.Exec(context.Background(), "DELETE FROM oauth.authorize WHERE code = $1", code)
+	return err
+}
+
+// SaveAccess writes AccessData and its refresh token in one transaction,
+// saving a token again is a no-op.
+func (s *Store) SaveAccess(data *osin.AccessData) (err error) {
+	defer wrap("SaveAccess", &err)
+	ctx := context.Background()
+	extra, err := oauth.ToJSONKV(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid access userdata", "token", data.AccessToken, "err", err)
+		return err
+	}
+	if data.AccessToken == "" || data.Client == nil {
+		return ErrInvalidValue
+	}
+	var authorizeCode, prev string
+	if data.AuthorizeData != nil {
+		authorizeCode = data.AuthorizeData.Code
+	}
+	if data.AccessData != nil {
+		prev = data.AccessData.AccessToken
+	}
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx,
+			`INSERT INTO oauth.access(client_id, authorize_code, previous, access_token, refresh_token,
+			  expires_in, scopes, redirect_uri, created, extra)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (access_token) DO NOTHING`,
+			data.Client.GetId(), authorizeCode, storage.SavedKey(prev), storage.SavedKey(data.AccessToken),
+			storage.SavedKey(data.RefreshToken), data.ExpiresIn, data.Scope, data.RedirectUri, data.CreatedAt, extra)
+		if err != nil || tag.RowsAffected() == 0 || data.RefreshToken == "" {
+			return err
+		}
+		return s.saveRefresh(ctx, tx, data)
+	})
+}
+
+// saveRefresh writes the refresh token of data, in the rotation chain of the previous token
+func (s *Store) saveRefresh(ctx context.Context, tx pgx.Tx, data *osin.AccessData) error {
+	token, access := storage.SavedKey(data.RefreshToken), storage.SavedKey(data.AccessToken)
+	if storage.RefreshReused(data) {
+		// kept on refresh, with the lifetime of its first issue
+		var r storage.RefreshToken
+		err := tx.QueryRow(ctx, "SELECT created, started FROM oauth.refresh WHERE token = $1", token).
+			Scan(&r.Created, &r.Started)
+		if err == nil {
+			r = s.opt.Expiry.ReuseRefreshToken(r)
+			_, err = tx.Exec(ctx, "UPDATE oauth.refresh SET access = $1, created = $2 WHERE token = $3",
+				access, r.Created, token)
+			return err
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+	}
+	var started time.Time
+	if prev := data.AccessData; prev != nil {
+		err := tx.QueryRow(ctx, "SELECT started FROM oauth.refresh WHERE access = $1", storage.SavedKey(prev.AccessToken)).Scan(&started)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		// the previous refresh token may be removed already, its access token is in the chain
+		if started.IsZero() {
+			started = prev.CreatedAt
+		}
+	}
+	r := s.opt.Expiry.NewRefreshToken(data, started)
+	var expiresAt *time.Time
+	if !r.ExpiresAt.IsZero() {
+		expiresAt = &r.ExpiresAt
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO oauth.refresh(token, access, created, started, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		token, access, r.Created, r.Started, expiresAt)
+	return err
+}
+
+type accessRow struct {
+	clientID, authorizeCode, previous string
+	frozen                            bool
+	data                              *osin.AccessData
+}
+
+// LoadAccess retrieves access data by token, with client, authorize data and the chain of previous tokens.
+// The chain is loaded with a recursive query, the clients and codes with one batch.
+func (s *Store) LoadAccess(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadAccess", &err)
+	a, err := s.loadAccess(storage.TokenKey(token), token)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAccess(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadAccess loads the token by its key, with its codes and previous tokens whether they are expired or not,
+// the previous tokens carry their keys
+func (s *Store) loadAccess(key, token string) (*osin.AccessData, error) {
+	ctx := context.Background()
+	rows, err := s.db.Query(ctx, `WITH RECURSIVE chain AS (
+		  SELECT 0 AS depth, a.* FROM oauth.access a WHERE a.access_token = $1
+		  UNION ALL
+		  SELECT chain.depth + 1, a.* FROM oauth.access a JOIN chain ON a.access_token = chain.previous
+		   WHERE chain.previous <> '' AND chain.depth < $2
+		) SELECT client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes,
+		  redirect_uri, created, extra, is_frozen FROM chain ORDER BY depth`, key, maxChain)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (r accessRow, err error) {
+		var extra oauth.JSONKV
+		r.data = new(osin.AccessData)
+		err = row.Scan(&r.clientID, &r.authorizeCode, &r.previous, &r.data.AccessToken, &r.data.RefreshToken,
+			&r.data.ExpiresIn, &r.data.Scope, &r.data.RedirectUri, &r.data.CreatedAt, &extra, &r.frozen)
+		r.data.UserData = extra
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, ErrNotFound
+	}
+	if chain[0].frozen {
+		return nil, storage.ErrFrozen
+	}
+
+	var cids, codes []string
+	for _, r := range chain {
+		cids = append(cids, r.clientID)
+		if r.authorizeCode != "" {
+			codes = append(codes, r.authorizeCode)
+		}
+	}
+	batch := &pgx.Batch{}
+	batch.Queue("SELECT id, secret, redirect_uri, meta, created, version, updated FROM oauth.client WHERE id = ANY($1)", cids)
+	batch.Queue(selectAuthorize+"WHERE a.code = ANY($1)", codes)
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	clients := make(map[string]*oauth.Client)
+	rows, err = br.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := new(oauth.Client)
+		if err = rows.Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		clients[c.ID] = c
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	authorizes := make(map[string]*osin.AuthorizeData)
+	rows, err = br.Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		a, err := scanAuthorize(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		authorizes[a.Code] = a
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// link the chain from the oldest token, a frozen token or a token without client ends it
+	var prev *osin.AccessData
+	for i := len(chain) - 1; i >= 0; i-- {
+		r := chain[i]
+		c, ok := clients[r.clientID]
+		if !ok || r.frozen {
+			if i == 0 {
+				return nil, ErrNotFound
+			}
+			prev = nil
+			continue
+		}
+		r.data.Client = c
+		r.data.AuthorizeData = authorizes[r.authorizeCode]
+		if r.previous != "" {
+			r.data.AccessData = prev
+		}
+		prev = r.data
+	}
+	// the key of a long token is saved
+	chain[0].data.AccessToken = token
+	return chain[0].data, nil
+}
+
+// RemoveAccess revokes the access token
+func (s *Store) RemoveAccess(token string) (err error) {
+	defer wrap("RemoveAccess", &err)
+	_, err = s.db.Exec(context.Background(), "DELETE FROM oauth.access WHERE access_token = $1", storage.SavedKey(token))
+	return err
+}
+
+// LoadRefresh retrieves the access data of a refresh token
+func (s *Store) LoadRefresh(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadRefresh", &err)
+	var (
+		access    string
+		r         storage.RefreshToken
+		expiresAt *time.Time
+	)
+	err = s.db.QueryRow(context.Background(), "SELECT access, created, started, expires_at FROM oauth.refresh WHERE token = $1",
+		storage.TokenKey(token)).Scan(&access, &r.Created, &r.Started, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.loadAccess(access, access)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt != nil {
+		r.ExpiresAt = *expiresAt
+	}
+	if err = s.opt.Expiry.CheckRefreshToken(a, r); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// RemoveRefresh revokes the refresh token
+func (s *Store) RemoveRefresh(token string) (err error) {
+	defer wrap("RemoveRefresh", &err)
+	_, err = s.db.Exec(context.Background(), "DELETE FROM oauth.refresh WHERE token = $1", storage.SavedKey(token))
+	return err
+}
+
+// LoadScopes returns all scopes
+func (s *Store) LoadScopes() (scopes []oauth.Scope, err error) {
+	defer wrap("LoadScopes", &err)
+	rows, err := s.db.Query(context.Background(), "SELECT name, label, description, is_default FROM oauth.scopes")
+	if err != nil {
+		return
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (scope oauth.Scope, err error) {
+		err = row.Scan(&scope.Name, &scope.Label, &scope.Description, &scope.IsDefault)
+		return
+	})
+}
+
+// IsAuthorized returns true if the user has authorized the client
+func (s *Store) IsAuthorized(clientID, username string) bool {
+	var ok bool
+	err := s.db.QueryRow(context.Background(),
+		"SELECT EXISTS(SELECT 1 FROM oauth.client_user_authorized WHERE client_id = $1 AND username = $2)",
+		clientID, username).Scan(&ok)
+	if err != nil {
+		s.log.Error("load authorized failed", "client_id", clientID, "err", err)
+	}
+	return ok
+}
+
+// SaveAuthorized remembers the authorization of the user to the client
+func (s *Store) SaveAuthorized(clientID, username string) (err error) {
+	defer wrap("SaveAuthorized", &err)
+	_, err = s.db.Exec(context.Background(),
+		"INSERT INTO oauth.client_user_authorized(client_id, username) VALUES($1, $2) ON CONFLICT DO NOTHING",
+		clientID, username)
+	return err
+}
@@ -0,0 +1,255 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/jwt"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+// AssertionType is the client_assertion_type of the JWT assertions of RFC 7523
+const AssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// DefaultJWKSTTL keeps the keys fetched from a jwks_uri this long
+const DefaultJWKSTTL = time.Hour
+
+// DefaultJWKSRefetch is the minimum interval between two fetches of the jwks_uri of a client,
+// so the assertions of unknown keys do not fetch it for each request
+const DefaultJWKSRefetch = time.Minute
+
+// MaxJWKSSize limits the size of a jwks_uri document
+const MaxJWKSSize = 1 << 20
+
+// ErrConfig is returned by an AssertionVerifier without Clients, Audience or Replay
+var ErrConfig = fmt.Errorf("%w: assertion verifier", storage.ErrInvalidValue)
+
+// defaultHTTP fetches jwks_uri without AssertionVerifier.HTTP
+var defaultHTTP = &http.Client{Timeout: 10 * time.Second}
+
+// ClientGetter loads the clients, e.g. an osin.Storage
+type ClientGetter interface {
+	GetClient(id string) (osin.Client, error)
+}
+
+// AssertionVerifier authenticates the clients of private_key_jwt with their signed client_assertion,
+// against the jwks or jwks_uri of their meta. The ids of the assertions are saved in Replay, so each is used once.
+type AssertionVerifier struct {
+	Clients  ClientGetter        // required
+	Audience string              // the URL of the token endpoint, required
+	Replay   storage.ReplayCache // required
+	Leeway   time.Duration       // for the clock skew
+	JWKSTTL  time.Duration       // default DefaultJWKSTTL
+	Refetch  time.Duration       // the minimum interval between two fetches for a client, default DefaultJWKSRefetch
+	HTTP     *http.Client        // fetches jwks_uri, default a client with a timeout of 10s
+	Now      func() time.Time
+
+	mu      sync.Mutex
+	jwks    map[string]cachedJWKS
+	fetches map[string]time.Time // the last fetch of a client
+}
+
+type cachedJWKS struct {
+	keys    *jwt.JWKS
+	fetched time.Time
+}
+
+func (v *AssertionVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+func invalidClient(format string, args ...interface{}) error {
+	return &Error{osin.E_INVALID_CLIENT, fmt.Sprintf(format, args...)}
+}
+
+// VerifyRequest verifies the client_assertion of a token request, its client_id is optional
+func (v *AssertionVerifier) VerifyRequest(r *http.Request) (osin.Client, error) {
+	if t := r.PostFormValue("client_assertion_type"); t != AssertionType {
+		return nil, &Error{osin.E_INVALID_REQUEST, fmt.Sprintf("client_assertion_type %q", t)}
+	}
+	c, err := v.Verify(r.PostFormValue("client_assertion"))
+	if err != nil {
+		return nil, err
+	}
+	if id := r.PostFormValue("client_id"); id != "" && id != c.GetId() {
+		return nil, invalidClient("client_id %s is not the issuer of the assertion", id)
+	}
+	return c, nil
+}
+
+// Validate returns an ErrConfig if a required field is not set
+func (v *AssertionVerifier) Validate() error {
+	switch {
+	case v.Clients == nil:
+		return fmt.Errorf("%w: Clients is required", ErrConfig)
+	case v.Audience == "":
+		return fmt.Errorf("%w: Audience is required", ErrConfig)
+	case v.Replay == nil:
+		return fmt.Errorf("%w: Replay is required", ErrConfig)
+	}
+	return nil
+}
+
+// Verify verifies the assertion: its issuer and subject are the client of private_key_jwt,
+// its audience is Audience, it expires, is signed by a key of the client, and is not used yet.
+// It returns an ErrConfig if the verifier is not valid.
+func (v *AssertionVerifier) Verify(assertion string) (osin.Client, error) {
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+	t, err := jwt.Parse(assertion)
+	if err != nil {
+		return nil, invalidClient("client_assertion: %s", err)
+	}
+	cl := t.Claims
+	if cl.Issuer == "" || cl.Subject != cl.Issuer {
+		return nil, invalidClient("client_assertion: iss and sub must be the client_id")
+	}
+	if !cl.Audience.Contains(v.Audience) {
+		return nil, invalidClient("client_assertion: aud must be %s", v.Audience)
+	}
+	if cl.ExpiresAt == 0 || cl.ID == "" {
+		return nil, invalidClient("client_assertion: exp and jti are required")
+	}
+	if err = cl.Valid(v.now(), v.Leeway); err != nil {
+		return nil, invalidClient("client_assertion: %s", err)
+	}
+	c, err := v.Clients.GetClient(cl.Issuer)
+	if err != nil {
+		return nil, invalidClient("client %s: %s", cl.Issuer, err)
+	}
+	m, _ := oauth.MetaOf(c)
+	if m.TokenEndpointAuthMethod != oauth.AuthPrivateKeyJWT {
+		return nil, invalidClient("client %s does not authenticate with private_key_jwt", cl.Issuer)
+	}
+	if err = v.verifySignature(t, cl.Issuer, m); err != nil {
+		return nil, invalidClient("client_assertion: %s", err)
+	}
+	exp := time.Unix(cl.ExpiresAt, 0).Add(v.Leeway)
+	if err = v.Replay.SaveJTI(cl.Issuer, cl.ID, exp); err != nil {
+		if errors.Is(err, storage.ErrReused) {
+			return nil, invalidClient("client_assertion: jti %s is used", cl.ID)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// verifySignature verifies with the jwks of m, or the keys of its jwks_uri, fetched again for an unknown kid
+func (v *AssertionVerifier) verifySignature(t *jwt.Token, client string, m oauth.ClientMeta) error {
+	if m.JWKS != nil {
+		return t.Verify(m.JWKS)
+	}
+	if m.JWKSURI == "" {
+		return fmt.Errorf("%w: no jwks", jwt.ErrUnknownKey)
+	}
+	keys, err := v.fetchJWKS(client, m.JWKSURI, false)
+	if err != nil {
+		return err
+	}
+	if err = t.Verify(keys); errors.Is(err, jwt.ErrUnknownKey) {
+		if keys, err = v.fetchJWKS(client, m.JWKSURI, true); err == nil {
+			err = t.Verify(keys)
+		}
+	}
+	return err
+}
+
+// fetchJWKS returns the cached keys of uri, or fetches them, at most once by Refetch for a client
+func (v *AssertionVerifier) fetchJWKS(client, uri string, force bool) (*jwt.JWKS, error) {
+	ttl := v.JWKSTTL
+	if ttl == 0 {
+		ttl = DefaultJWKSTTL
+	}
+	refetch := v.Refetch
+	if refetch == 0 {
+		refetch = DefaultJWKSRefetch
+	}
+	now := v.now()
+	v.mu.Lock()
+	c, ok := v.jwks[uri]
+	if ok && !force && now.Sub(c.fetched) < ttl {
+		v.mu.Unlock()
+		return c.keys, nil
+	}
+	if last, seen := v.fetches[client]; seen && now.Sub(last) < refetch {
+		v.mu.Unlock()
+		if ok {
+			return c.keys, nil
+		}
+		return nil, fmt.Errorf("%w: jwks_uri %s of %s fetched at %s", jwt.ErrUnknownKey, uri, client, last.Format(time.RFC3339))
+	}
+	if v.fetches == nil {
+		v.fetches = make(map[string]time.Time)
+	}
+	v.fetches[client] = now
+	v.mu.Unlock()
+
+	hc := v.HTTP
+	if hc == nil {
+		hc = defaultHTTP
+	}
+	res, err := hc.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks_uri %s: %s", uri, res.Status)
+	}
+	keys := new(jwt.JWKS)
+	if err = json.NewDecoder(io.LimitReader(res.Body, MaxJWKSSize)).Decode(keys); err != nil {
+		return nil, fmt.Errorf("jwks_uri %s: %w", uri, err)
+	}
+	v.mu.Lock()
+	if v.jwks == nil {
+		v.jwks = make(map[string]cachedJWKS)
+	}
+	v.jwks[uri] = cachedJWKS{keys: keys, fetched: now}
+	v.mu.Unlock()
+	return keys, nil
+}
+
+// MemoryReplayCache is a storage.ReplayCache in memory, for a single server
+type MemoryReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	Now  func() time.Time
+}
+
+// NewMemoryReplayCache returns an empty MemoryReplayCache
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{seen: make(map[string]time.Time)}
+}
+
+// SaveJTI storage.ReplayCache, the expired ids are purged
+func (c *MemoryReplayCache) SaveJTI(issuer, jti string, exp time.Time) error {
+	now := time.Now()
+	if c.Now != nil {
+		now = c.Now()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, at := range c.seen {
+		if at.Before(now) {
+			delete(c.seen, k)
+		}
+	}
+	key := issuer + "\x00" + jti
+	if _, ok := c.seen[key]; ok {
+		return storage.ErrReused
+	}
+	c.seen[key] = exp
+	return nil
+}
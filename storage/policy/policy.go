@@ -0,0 +1,198 @@
+// Package policy enforces the grant types, response types and scopes allowed for the clients
+// during the flows of an osin.Server, see oauth.ClientMeta.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+// Error is an OAuth error of a request not allowed for its client
+type Error struct {
+	ID          string // one of osin.E_*
+	Description string
+}
+
+func (e *Error) Error() string {
+	return e.ID + ": " + e.Description
+}
+
+// grantTyped, responseTyped and scoped are the clients restricting their requests, e.g. oauth.Client.
+// An empty list allows any, as the clients saved before.
+type grantTyped interface {
+	GetGrantTypes() []string
+}
+
+type responseTyped interface {
+	GetResponseTypes() []string
+}
+
+type scoped interface {
+	GetScopes() []string
+}
+
+// CheckAuthorize returns an *Error if the client of ar may not use its response type,
+// request its scopes, or requires PKCE without a code challenge, as the public clients do.
+func CheckAuthorize(ar *osin.AuthorizeRequest) error {
+	if c, ok := ar.Client.(responseTyped); ok && !allowed(c.GetResponseTypes(), string(ar.Type)) {
+		return &Error{osin.E_UNAUTHORIZED_CLIENT, fmt.Sprintf("response type %s is not allowed", ar.Type)}
+	}
+	if err := checkScope(ar.Client, ar.Scope); err != nil {
+		return err
+	}
+	if m, _ := oauth.MetaOf(ar.Client); (m.PKCERequired || m.IsPublic()) && ar.CodeChallenge == "" {
+		return &Error{osin.E_INVALID_REQUEST, "code_challenge is required"}
+	}
+	return nil
+}
+
+// CheckAccess returns an *Error if the client of ar authenticates not with its token_endpoint_auth_method,
+// or may not use its grant type or request its scopes
+func CheckAccess(ar *osin.AccessRequest) error {
+	if err := checkAuthMethod(ar); err != nil {
+		return err
+	}
+	if c, ok := ar.Client.(grantTyped); ok && !allowed(c.GetGrantTypes(), string(ar.Type)) {
+		return &Error{osin.E_UNAUTHORIZED_CLIENT, fmt.Sprintf("grant type %s is not allowed", ar.Type)}
+	}
+	return checkScope(ar.Client, ar.Scope)
+}
+
+// checkAuthMethod checks how the secret is sent, osin has checked the secret,
+// the other methods are left to their verifiers.
+func checkAuthMethod(ar *osin.AccessRequest) error {
+	m, ok := oauth.MetaOf(ar.Client)
+	if !ok || ar.HttpRequest == nil {
+		return nil
+	}
+	_, _, basic := ar.HttpRequest.BasicAuth()
+	method := m.TokenEndpointAuthMethod
+	if method == oauth.AuthClientSecretBasic && !basic || method == oauth.AuthClientSecretPost && basic {
+		return &Error{osin.E_INVALID_CLIENT, fmt.Sprintf("client authenticates with %s", method)}
+	}
+	return nil
+}
+
+func checkScope(client osin.Client, scope string) error {
+	c, ok := client.(scoped)
+	if !ok {
+		return nil
+	}
+	for _, s := range strings.Fields(scope) {
+		if !allowed(c.GetScopes(), s) {
+			return &Error{osin.E_INVALID_SCOPE, fmt.Sprintf("scope %s is not allowed", s)}
+		}
+	}
+	return nil
+}
+
+func allowed(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Server is an osin.Server rejecting the requests not allowed for their clients
+type Server struct {
+	*osin.Server
+
+	// Assertions authenticates the clients of private_key_jwt, which are rejected without it
+	Assertions *AssertionVerifier
+
+	// SingleUseCodes consumes the codes with ConsumeCode once osin authenticated the client,
+	// the storage of osin must be a storage.AuthorizeConsumer
+	SingleUseCodes bool
+}
+
+// New wraps the server s, with its storage loading the clients
+func New(s *osin.Server) *Server {
+	return &Server{Server: s}
+}
+
+// HandleAuthorizeRequest handles the request with osin, and rejects it with an OAuth error,
+// redirected with the state, if CheckAuthorize fails.
+func (s *Server) HandleAuthorizeRequest(w *osin.Response, r *http.Request) *osin.AuthorizeRequest {
+	ar := s.Server.HandleAuthorizeRequest(w, r)
+	if ar == nil {
+		return nil
+	}
+	if err := CheckAuthorize(ar); err != nil {
+		reject(w, err, ar.State)
+		return nil
+	}
+	return ar
+}
+
+// HandleAccessRequest handles the request with osin, and rejects it with an OAuth error if CheckAccess fails.
+// A client_assertion is verified first, then its client is authenticated to osin with its stored secret.
+func (s *Server) HandleAccessRequest(w *osin.Response, r *http.Request) *osin.AccessRequest {
+	var asserted osin.Client
+	if r.PostFormValue("client_assertion_type") != "" && s.Assertions != nil {
+		c, err := s.Assertions.VerifyRequest(r)
+		if err != nil {
+			reject(w, err, "")
+			return nil
+		}
+		r.SetBasicAuth(c.GetId(), c.GetSecret())
+		asserted = c
+	}
+	ar := s.Server.HandleAccessRequest(w, r)
+	if ar == nil {
+		return nil
+	}
+	if m, _ := oauth.MetaOf(ar.Client); m.TokenEndpointAuthMethod == oauth.AuthPrivateKeyJWT &&
+		(asserted == nil || asserted.GetId() != ar.Client.GetId()) {
+		reject(w, &Error{osin.E_INVALID_CLIENT, "client authenticates with " + oauth.AuthPrivateKeyJWT}, "")
+		return nil
+	}
+	if err := CheckAccess(ar); err != nil {
+		reject(w, err, "")
+		return nil
+	}
+	if s.SingleUseCodes {
+		if err := ConsumeCode(w.Storage, ar); err != nil {
+			reject(w, err, "")
+			return nil
+		}
+	}
+	return ar
+}
+
+// ConsumeCode consumes the code of an authorization code request with st, the other grants are ignored.
+// A code used already, whose tokens are then revoked by st, or not found is rejected with invalid_grant.
+func ConsumeCode(st osin.Storage, ar *osin.AccessRequest) error {
+	if ar.Type != osin.AUTHORIZATION_CODE {
+		return nil
+	}
+	c, ok := st.(storage.AuthorizeConsumer)
+	if !ok {
+		return fmt.Errorf("%w: %T consumes no code", storage.ErrInvalidValue, st)
+	}
+	_, err := c.ConsumeAuthorize(ar.Code)
+	if errors.Is(err, storage.ErrReused) || errors.Is(err, storage.ErrNotFound) {
+		return &Error{osin.E_INVALID_GRANT, "authorization code is used or unknown"}
+	}
+	return err
+}
+
+func reject(w *osin.Response, err error, state string) {
+	var pe *Error
+	if !errors.As(err, &pe) {
+		pe = &Error{osin.E_SERVER_ERROR, err.Error()}
+	}
+	w.SetErrorState(pe.ID, pe.Description, state)
+	w.InternalError = err
+}
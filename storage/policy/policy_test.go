@@ -0,0 +1,253 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/osin"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/jwt"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+func errorID(t *testing.T, err error) string {
+	require.IsType(t, &Error{}, err)
+	return err.(*Error).ID
+}
+
+func TestCheckAuthorize(t *testing.T) {
+	client := oauth.NewClient("policy", "secret", "http://localhost")
+	client.Meta.ResponseTypes = []string{"code"}
+	client.Meta.Scopes = []string{"basic", "profile"}
+
+	assert.Nil(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client, Scope: "basic profile"}))
+	assert.Equal(t, osin.E_UNAUTHORIZED_CLIENT,
+		errorID(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.TOKEN, Client: client})))
+	assert.Equal(t, osin.E_INVALID_SCOPE,
+		errorID(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client, Scope: "basic admin"})))
+
+	client.Meta.PKCERequired = true
+	assert.Equal(t, osin.E_INVALID_REQUEST,
+		errorID(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client})))
+	assert.Nil(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client, CodeChallenge: "challenge"}))
+
+	// the clients without restrictions are left to osin
+	assert.Nil(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.TOKEN, Client: &osin.DefaultClient{Id: "other"}, Scope: "admin"}))
+}
+
+func TestCheckAccess(t *testing.T) {
+	client := oauth.NewClient("policy", "secret", "http://localhost")
+	client.Meta.GrantTypes = []string{"authorization_code", "refresh_token"}
+	client.Meta.Scopes = []string{"basic"}
+
+	assert.Nil(t, CheckAccess(&osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Client: client, Scope: "basic"}))
+	assert.Nil(t, CheckAccess(&osin.AccessRequest{Type: osin.REFRESH_TOKEN, Client: client}))
+	assert.Equal(t, osin.E_UNAUTHORIZED_CLIENT,
+		errorID(t, CheckAccess(&osin.AccessRequest{Type: osin.PASSWORD, Client: client})))
+	assert.Equal(t, osin.E_INVALID_SCOPE,
+		errorID(t, CheckAccess(&osin.AccessRequest{Type: osin.REFRESH_TOKEN, Client: client, Scope: "basic admin"})))
+
+	client.Meta.GrantTypes = nil
+	assert.Nil(t, CheckAccess(&osin.AccessRequest{Type: osin.CLIENT_CREDENTIALS, Client: client}))
+}
+
+func TestReject(t *testing.T) {
+	w := &osin.Response{Output: make(osin.ResponseData), ErrorStatusCode: 400}
+	reject(w, &Error{osin.E_INVALID_SCOPE, "scope admin is not allowed"}, "xyz")
+	assert.True(t, w.IsError)
+	assert.Equal(t, osin.E_INVALID_SCOPE, w.ErrorId)
+	assert.Equal(t, "xyz", w.Output["state"])
+	assert.Equal(t, 400, w.StatusCode)
+}
+
+func TestPublicClient(t *testing.T) {
+	client := oauth.NewClient("public", "", "http://localhost")
+	client.Meta.TokenEndpointAuthMethod = oauth.AuthNone
+	assert.Equal(t, osin.E_INVALID_REQUEST,
+		errorID(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client})))
+	assert.Nil(t, CheckAuthorize(&osin.AuthorizeRequest{Type: osin.CODE, Client: client, CodeChallenge: "challenge"}))
+
+	form := httptest.NewRequest("POST", "/token", strings.NewReader("client_id=public"))
+	assert.Nil(t, CheckAccess(&osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Client: client, HttpRequest: form}))
+
+	// a confidential client sends its secret with the method it is registered with
+	client = oauth.NewClient("basic", "secret", "http://localhost")
+	client.Meta.TokenEndpointAuthMethod = oauth.AuthClientSecretBasic
+	assert.Equal(t, osin.E_INVALID_CLIENT,
+		errorID(t, CheckAccess(&osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Client: client, HttpRequest: form})))
+	basic := httptest.NewRequest("POST", "/token", nil)
+	basic.SetBasicAuth("basic", "secret")
+	assert.Nil(t, CheckAccess(&osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Client: client, HttpRequest: basic}))
+	client.Meta.TokenEndpointAuthMethod = oauth.AuthClientSecretPost
+	assert.Equal(t, osin.E_INVALID_CLIENT,
+		errorID(t, CheckAccess(&osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Client: client, HttpRequest: basic})))
+}
+
+// consumer is a storage consuming its codes once
+type consumer struct {
+	osin.Storage
+	used map[string]bool
+}
+
+func (c *consumer) ConsumeAuthorize(code string) (*osin.AuthorizeData, error) {
+	if c.used[code] {
+		return nil, storage.ErrReused
+	}
+	c.used[code] = true
+	return &osin.AuthorizeData{Code: code}, nil
+}
+
+func TestConsumeCode(t *testing.T) {
+	st := &consumer{used: map[string]bool{}}
+	ar := &osin.AccessRequest{Type: osin.AUTHORIZATION_CODE, Code: "code"}
+	assert.Nil(t, ConsumeCode(st, ar))
+	assert.Equal(t, osin.E_INVALID_GRANT, errorID(t, ConsumeCode(st, ar)))
+	assert.Nil(t, ConsumeCode(st, &osin.AccessRequest{Type: osin.REFRESH_TOKEN}))
+	assert.ErrorIs(t, ConsumeCode(nil, ar), storage.ErrInvalidValue)
+}
+
+type clientMap map[string]osin.Client
+
+func (m clientMap) GetClient(id string) (osin.Client, error) {
+	if c, ok := m[id]; ok {
+		return c, nil
+	}
+	return nil, errors.New("not found")
+}
+
+const tokenURL = "https://as.example.com/token"
+
+func TestAssertion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwk, err := jwt.NewJWK("k1", "ES256", key.Public())
+	require.Nil(t, err)
+
+	fetched := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		_ = json.NewEncoder(w).Encode(jwt.JWKS{Keys: []jwt.JWK{jwk}})
+	}))
+	defer srv.Close()
+
+	inline := oauth.NewClient("inline", "", "http://localhost")
+	inline.Meta.TokenEndpointAuthMethod = oauth.AuthPrivateKeyJWT
+	inline.Meta.JWKS = &jwt.JWKS{Keys: []jwt.JWK{jwk}}
+	remote := oauth.NewClient("remote", "", "http://localhost")
+	remote.Meta.TokenEndpointAuthMethod = oauth.AuthPrivateKeyJWT
+	remote.Meta.JWKSURI = srv.URL
+	basic := oauth.NewClient("basic", "secret", "http://localhost")
+
+	now := time.Now()
+	v := &AssertionVerifier{
+		Clients:  clientMap{"inline": inline, "remote": remote, "basic": basic},
+		Audience: tokenURL,
+		Replay:   NewMemoryReplayCache(),
+		Now:      func() time.Time { return now },
+	}
+	signed := func(kid, iss, aud string, exp time.Duration) string {
+		s, err := jwt.Sign(jwt.Header{Alg: "ES256", Kid: kid}, jwt.Claims{
+			Issuer: iss, Subject: iss, Audience: jwt.Audience{aud},
+			ExpiresAt: now.Add(exp).Unix(), ID: uuid.New(),
+		}, key)
+		require.Nil(t, err)
+		return s
+	}
+	assertion := func(iss, aud string, exp time.Duration) string {
+		return signed("k1", iss, aud, exp)
+	}
+
+	c, err := v.Verify(assertion("inline", tokenURL, time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, "inline", c.GetId())
+
+	s := assertion("remote", tokenURL, time.Minute)
+	c, err = v.Verify(s)
+	require.Nil(t, err)
+	assert.Equal(t, "remote", c.GetId())
+	assert.Equal(t, 1, fetched)
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(s))), "replayed")
+	_, err = v.Verify(assertion("remote", tokenURL, time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 1, fetched, "cached")
+
+	// an unknown kid fetches the jwks_uri again, at most once by Refetch
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(signed("k2", "remote", tokenURL, time.Hour)))))
+	assert.Equal(t, 1, fetched, "throttled")
+	now = now.Add(DefaultJWKSRefetch)
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(signed("k2", "remote", tokenURL, time.Hour)))))
+	assert.Equal(t, 2, fetched)
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(signed("k2", "remote", tokenURL, time.Hour)))))
+	assert.Equal(t, 2, fetched, "throttled")
+
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(assertion("inline", "https://other", time.Minute)))))
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(assertion("inline", tokenURL, -time.Minute)))))
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(assertion("basic", tokenURL, time.Minute)))))
+
+	// a key not in the jwks
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	forged, err := jwt.Sign(jwt.Header{Alg: "ES256", Kid: "k1"}, jwt.Claims{Issuer: "inline", Subject: "inline",
+		Audience: jwt.Audience{tokenURL}, ExpiresAt: time.Now().Add(time.Minute).Unix(), ID: uuid.New()}, other)
+	require.Nil(t, err)
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.Verify(forged))))
+
+	form := url.Values{
+		"client_id":             {"inline"},
+		"client_assertion_type": {AssertionType},
+		"client_assertion":      {assertion("remote", tokenURL, time.Minute)},
+	}
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, osin.E_INVALID_CLIENT, errorID(t, mustFail(v.VerifyRequest(r))))
+
+	// a verifier without a replay cache or an audience is not valid, not a panic or any audience
+	for _, bad := range []*AssertionVerifier{
+		{Clients: v.Clients, Audience: tokenURL},
+		{Clients: v.Clients, Replay: v.Replay},
+		{Audience: tokenURL, Replay: v.Replay},
+	} {
+		assert.ErrorIs(t, mustFail(bad.Verify(assertion("inline", tokenURL, time.Minute))), ErrConfig)
+	}
+	assert.ErrorIs(t, (&AssertionVerifier{}).Validate(), storage.ErrInvalidValue)
+	assert.Nil(t, v.Validate())
+}
+
+func TestAssertionJWKSSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat(" ", MaxJWKSSize) + `{"keys":[]}`))
+	}))
+	defer srv.Close()
+	v := &AssertionVerifier{}
+	_, err := v.fetchJWKS("remote", srv.URL, false)
+	assert.NotNil(t, err)
+}
+
+func mustFail(_ osin.Client, err error) error {
+	return err
+}
+
+func TestMemoryReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewMemoryReplayCache()
+	c.Now = func() time.Time { return now }
+	require.Nil(t, c.SaveJTI("rp", "1", now.Add(time.Minute)))
+	assert.ErrorIs(t, c.SaveJTI("rp", "1", now.Add(time.Minute)), storage.ErrReused)
+	assert.Nil(t, c.SaveJTI("other", "1", now.Add(time.Minute)))
+
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, c.SaveJTI("rp", "1", now.Add(time.Minute)))
+}
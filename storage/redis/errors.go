@@ -0,0 +1,32 @@
+package redis
+
+import (
+	"errors"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+// errors, the methods return a storage.Error of the kinds of package storage
+var (
+	ErrNotFound     = storage.ErrNotFound
+	ErrExists       = storage.ErrConflict
+	ErrInvalidValue = storage.ErrInvalidValue
+)
+
+// errKind classifies an error of redis
+func errKind(err error) error {
+	if errors.Is(err, goredis.Nil) {
+		return storage.ErrNotFound
+	}
+	if errors.Is(err, goredis.TxFailedErr) {
+		return storage.ErrConflict
+	}
+	return storage.ErrDatabase
+}
+
+// wrap sets *err to a storage.Error of the method op
+func wrap(op string, err *error) {
+	*err = storage.AsError(op, *err, errKind)
+}
@@ -0,0 +1,577 @@
+// Package redis is a osin storage implementation for redis, with native expiry of codes and tokens.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/logging"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var (
+	_ oauth.Store           = (*Store)(nil)
+	_ storage.ClientUpdater = (*Store)(nil)
+
+	_ storage.ReplayCache = (*Store)(nil)
+)
+
+// DefaultPrefix of all keys
+const DefaultPrefix = "oauth:"
+
+// Options of the Store
+type Options struct {
+	// Prefix of all keys, default is DefaultPrefix
+	Prefix string
+	// Expiry is the policy on load, a token with refresh is kept until its refresh token expires by Expiry.Refresh,
+	// or as long as the access token without a refresh policy
+	Expiry storage.Expiry
+	// Logger is the handler of the logs, default is the handler of slog.Default().
+	// Codes and tokens are logged as hashes, and user data is never logged.
+	Logger slog.Handler
+}
+
+// Store implements oauth.Store on redis.
+// Use oauth.AsStorage for a storage.Storage.
+type Store struct {
+	rc  goredis.UniversalClient
+	opt Options
+	log *slog.Logger
+}
+
+// New returns a new redis storage instance.
+func New(rc goredis.UniversalClient, opts ...Options) *Store {
+	s := &Store{rc: rc}
+	if len(opts) > 0 {
+		s.opt = opts[0]
+	}
+	if s.opt.Prefix == "" {
+		s.opt.Prefix = DefaultPrefix
+	}
+	s.log = logging.New(s.opt.Logger, "redis")
+	return s
+}
+
+type authorizeRecord struct {
+	ClientID            string       `json:"client_id"`
+	Code                string       `json:"code"`
+	ExpiresIn           int32        `json:"expires_in"`
+	Scope               string       `json:"scopes,omitempty"`
+	RedirectURI         string       `json:"redirect_uri,omitempty"`
+	State               string       `json:"state,omitempty"`
+	Extra               oauth.JSONKV `json:"extra,omitempty"`
+	CodeChallenge       string       `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string       `json:"code_challenge_method,omitempty"`
+	CreatedAt           time.Time    `json:"created"`
+}
+
+type accessRecord struct {
+	ClientID      string       `json:"client_id"`
+	AuthorizeCode string       `json:"authorize_code,omitempty"`
+	Previous      string       `json:"previous,omitempty"`
+	AccessToken   string       `json:"access_token"`
+	RefreshToken  string       `json:"refresh_token,omitempty"`
+	ExpiresIn     int32        `json:"expires_in"`
+	Scope         string       `json:"scopes,omitempty"`
+	RedirectURI   string       `json:"redirect_uri,omitempty"`
+	Extra         oauth.JSONKV `json:"extra,omitempty"`
+	CreatedAt     time.Time    `json:"created"`
+
+	Refresh *storage.RefreshToken `json:"refresh,omitempty"` // the lifetime of RefreshToken
+}
+
+func (s *Store) key(kind, id string) string {
+	return s.opt.Prefix + kind + ":" + id
+}
+
+func (s *Store) getJSON(ctx context.Context, key string, v interface{}) error {
+	b, err := s.rc.Get(ctx, key).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return ErrNotFound
+	} else if err != nil {
+		// the key holds the code or token, logged as a hash
+		s.log.Error("get failed", "token", key, "err", err)
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ttlOf returns the time to live of data created at created with expiresIn seconds, never zero, which is no expiry
+func ttlOf(created time.Time, expiresIn int32) time.Duration {
+	ttl := time.Until(created.Add(time.Duration(expiresIn) * time.Second))
+	if ttl < time.Second {
+		// already expired, keep it shortly
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// Clone the storage
+func (s *Store) Clone() osin.Storage {
+	return s
+}
+
+// Close the storage, the redis client is owned by the caller
+func (s *Store) Close() {
+}
+
+// GetClient loads the client by id
+func (s *Store) GetClient(id string) (_ osin.Client, err error) {
+	defer wrap("GetClient", &err)
+	c, err := s.LoadClient(id)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadClient loads the client by id
+func (s *Store) LoadClient(id string) (_ *oauth.Client, err error) {
+	defer wrap("LoadClient", &err)
+	c := new(oauth.Client)
+	if err := s.getJSON(context.Background(), s.key("client", id), c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadClients returns clients ordered by creation, paged by spec
+func (s *Store) LoadClients(spec *oauth.ClientSpec) (clients []oauth.Client, err error) {
+	defer wrap("LoadClients", &err)
+	ctx := context.Background()
+	if spec == nil {
+		spec = &oauth.ClientSpec{}
+	}
+	spec.Total = int(s.CountClients())
+	if spec.CountOnly || spec.Total == 0 {
+		return
+	}
+	var start, stop int64 = 0, -1
+	if spec.Limit > 0 {
+		page := spec.Page
+		if page < 1 {
+			page = 1
+		}
+		start = int64((page - 1) * spec.Limit)
+		stop = start + int64(spec.Limit) - 1
+	}
+	ids, err := s.rc.ZRange(ctx, s.key("clients", "index"), start, stop).Result()
+	if err != nil || len(ids) == 0 {
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.key("client", id)
+	}
+	vals, err := s.rc.MGet(ctx, keys...).Result()
+	if err != nil {
+		return
+	}
+	clients = make([]oauth.Client, 0, len(vals))
+	for _, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var c oauth.Client
+		if err = json.Unmarshal([]byte(str), &c); err != nil {
+			s.log.Error("unmarshal client failed", "err", err)
+			return
+		}
+		clients = append(clients, c)
+	}
+	return
+}
+
+// CountClients returns the number of clients
+func (s *Store) CountClients() uint {
+	n, err := s.rc.ZCard(context.Background(), s.key("clients", "index")).Result()
+	if err != nil {
+		s.log.Error("count clients failed", "err", err)
+	}
+	return uint(n)
+}
+
+// SaveClient creates or updates the client, an update increments its version
+func (s *Store) SaveClient(c *oauth.Client) (err error) {
+	defer wrap("SaveClient", &err)
+	return s.saveClient(c, -1)
+}
+
+// UpdateClient updates the client if its stored version is version, and increments the version.
+// It returns a storage.ErrConflict if the client is updated since.
+func (s *Store) UpdateClient(client storage.Client, version int) (err error) {
+	defer wrap("UpdateClient", &err)
+	c := oauth.ClientOf(client)
+	return s.saveClient(c, version)
+}
+
+// saveClient updates the client of the version, or saves it with any version with -1.
+// The client is watched, a concurrent update fails with a conflict.
+func (s *Store) saveClient(c *oauth.Client, version int) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	key := s.key("client", c.ID)
+	err := s.rc.Watch(ctx, func(tx *goredis.Tx) error {
+		var old oauth.Client
+		err := s.getJSON(ctx, key, &old)
+		if err != nil && (!errors.Is(err, ErrNotFound) || version >= 0) {
+			return err
+		}
+		if version >= 0 && old.Version != version {
+			return fmt.Errorf("%w: client %s of version %d, not %d", storage.ErrConflict, c.ID, old.Version, version)
+		}
+		c.UpdatedAt = time.Now()
+		c.Version = old.Version + 1
+		if err == nil {
+			c.CreatedAt = old.CreatedAt
+		}
+		if c.CreatedAt.IsZero() {
+			c.CreatedAt = c.UpdatedAt
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.Set(ctx, key, b, 0)
+			pipe.ZAdd(ctx, s.key("clients", "index"), goredis.Z{Score: float64(c.CreatedAt.Unix()), Member: c.ID})
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, goredis.TxFailedErr) {
+		return fmt.Errorf("%w: client %s is updated concurrently", storage.ErrConflict, c.ID)
+	}
+	return err
+}
+
+// RemoveClient removes the client by id
+func (s *Store) RemoveClient(id string) (err error) {
+	defer wrap("RemoveClient", &err)
+	ctx := context.Background()
+	_, err = s.rc.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, s.key("client", id))
+		pipe.ZRem(ctx, s.key("clients", "index"), id)
+		return nil
+	})
+	return err
+}
+
+// SaveAuthorize saves authorize data, it expires with ExpiresIn
+func (s *Store) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	defer wrap("SaveAuthorize", &err)
+	extra, err := toExtra(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid authorize userdata", "code", data.Code, "err", err)
+		return err
+	}
+	if data.Client == nil {
+		return ErrInvalidValue
+	}
+	b, err := json.Marshal(&authorizeRecord{
+		ClientID:            data.Client.GetId(),
+		Code:                data.Code,
+		ExpiresIn:           data.ExpiresIn,
+		Scope:               data.Scope,
+		RedirectURI:         data.RedirectUri,
+		State:               data.State,
+		Extra:               extra,
+		CodeChallenge:       data.CodeChallenge,
+		CodeChallengeMethod: data.CodeChallengeMethod,
+		CreatedAt:           data.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	ok, err := s.rc.SetNX(context.Background(), s.key("code", data.Code), b, ttlOf(data.CreatedAt, data.ExpiresIn)).Result()
+	if err == nil && !ok {
+		return ErrExists
+	}
+	return err
+}
+
+// LoadAuthorize looks up AuthorizeData by a code
+func (s *Store) LoadAuthorize(code string) (_ *osin.AuthorizeData, err error) {
+	defer wrap("LoadAuthorize", &err)
+	a, err := s.loadAuthorize(code)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAuthorize(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *Store) loadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var r authorizeRecord
+	if err := s.getJSON(context.Background(), s.key("code", code), &r); err != nil {
+		return nil, err
+	}
+	c, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &osin.AuthorizeData{
+		Client:              c,
+		Code:                r.Code,
+		ExpiresIn:           r.ExpiresIn,
+		Scope:               r.Scope,
+		RedirectUri:         r.RedirectURI,
+		State:               r.State,
+		CreatedAt:           r.CreatedAt,
+		UserData:            r.Extra,
+		CodeChallenge:       r.CodeChallenge,
+		CodeChallengeMethod: r.CodeChallengeMethod,
+	}, nil
+}
+
+// RemoveAuthorize revokes the authorization code
+func (s *Store) RemoveAuthorize(code string) (err error) {
+	defer wrap("RemoveAuthorize", &err)
+	return s.rc.Del(context.Background(), s.key("code", code)).Err()
+}
+
+// SaveAccess writes AccessData, it expires with ExpiresIn,
+// or with its refresh token by the TTL of the refresh policy, never without one.
+func (s *Store) SaveAccess(data *osin.AccessData) (err error) {
+	defer wrap("SaveAccess", &err)
+	ctx := context.Background()
+	if data.AccessToken == "" || data.Client == nil {
+		return ErrInvalidValue
+	}
+	extra, err := toExtra(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid access userdata", "token", data.AccessToken, "err", err)
+		return err
+	}
+	r := &accessRecord{
+		ClientID:     data.Client.GetId(),
+		AccessToken:  data.AccessToken,
+		RefreshToken: data.RefreshToken,
+		ExpiresIn:    data.ExpiresIn,
+		Scope:        data.Scope,
+		RedirectURI:  data.RedirectUri,
+		Extra:        extra,
+		CreatedAt:    data.CreatedAt,
+	}
+	if data.AuthorizeData != nil {
+		r.AuthorizeCode = data.AuthorizeData.Code
+	}
+	if data.AccessData != nil {
+		r.Previous = data.AccessData.AccessToken
+	}
+	if r.RefreshToken != "" {
+		var (
+			started time.Time
+			prev    accessRecord
+		)
+		if r.Previous != "" {
+			// the chain starts with the previous token, whether its record is expired or not
+			started = data.AccessData.CreatedAt
+			if s.getJSON(ctx, s.key("access", r.Previous), &prev) == nil && prev.Refresh != nil {
+				started = prev.Refresh.Started
+			}
+		}
+		rt := s.opt.Expiry.NewRefreshToken(data, started)
+		if storage.RefreshReused(data) && prev.Refresh != nil {
+			// kept on refresh, with the lifetime of its first issue
+			rt = s.opt.Expiry.ReuseRefreshToken(*prev.Refresh)
+		}
+		r.Refresh = &rt
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// a token with refresh lives until its refresh token expires, or as long as the access token,
+	// the keys are never written without expiry
+	ttl := ttlOf(data.CreatedAt, data.ExpiresIn)
+	if r.Refresh != nil {
+		if at := s.opt.Expiry.RefreshDeadline(data, *r.Refresh); !at.IsZero() && time.Until(at) > ttl {
+			ttl = time.Until(at)
+		}
+	}
+	// the access and refresh keys are written in one transaction, only if the access key is not saved yet,
+	// so saving the token again, even concurrently, is a no-op and never restores a removed refresh token
+	key := s.key("access", data.AccessToken)
+	err = s.rc.Watch(ctx, func(tx *goredis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.Set(ctx, key, b, ttl)
+			if data.RefreshToken != "" {
+				pipe.Set(ctx, s.key("refresh", data.RefreshToken), data.AccessToken, ttl)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, goredis.TxFailedErr) {
+		// saved concurrently
+		return nil
+	}
+	return err
+}
+
+// LoadAccess retrieves access data by token, with client, authorize data and previous access.
+func (s *Store) LoadAccess(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadAccess", &err)
+	a, err := s.loadAccess(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.opt.Expiry.CheckAccess(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadAccess loads the token, with its code and previous token whether they are expired or not
+func (s *Store) loadAccess(token string) (*osin.AccessData, error) {
+	var r accessRecord
+	if err := s.getJSON(context.Background(), s.key("access", token), &r); err != nil {
+		return nil, err
+	}
+	c, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	a := &osin.AccessData{
+		Client:       c,
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+		ExpiresIn:    r.ExpiresIn,
+		Scope:        r.Scope,
+		RedirectUri:  r.RedirectURI,
+		CreatedAt:    r.CreatedAt,
+		UserData:     r.Extra,
+	}
+	if r.AuthorizeCode != "" {
+		a.AuthorizeData, _ = s.loadAuthorize(r.AuthorizeCode)
+	}
+	if r.Previous != "" {
+		a.AccessData, _ = s.loadAccess(r.Previous)
+	}
+	return a, nil
+}
+
+// RemoveAccess revokes the access token
+func (s *Store) RemoveAccess(token string) (err error) {
+	defer wrap("RemoveAccess", &err)
+	return s.rc.Del(context.Background(), s.key("access", token)).Err()
+}
+
+// LoadRefresh retrieves the access data of a refresh token
+func (s *Store) LoadRefresh(token string) (_ *osin.AccessData, err error) {
+	defer wrap("LoadRefresh", &err)
+	access, err := s.rc.Get(context.Background(), s.key("refresh", token)).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	a, err := s.loadAccess(access)
+	if err != nil {
+		return nil, err
+	}
+	var r accessRecord
+	if err = s.getJSON(context.Background(), s.key("access", access), &r); err != nil {
+		return nil, err
+	}
+	// the records saved before have no lifetime
+	if r.Refresh == nil {
+		err = s.opt.Expiry.CheckRefresh(a)
+	} else {
+		err = s.opt.Expiry.CheckRefreshToken(a, *r.Refresh)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// RemoveRefresh revokes the refresh token
+func (s *Store) RemoveRefresh(token string) (err error) {
+	defer wrap("RemoveRefresh", &err)
+	return s.rc.Del(context.Background(), s.key("refresh", token)).Err()
+}
+
+// LoadScopes returns all scopes
+func (s *Store) LoadScopes() (scopes []oauth.Scope, err error) {
+	defer wrap("LoadScopes", &err)
+	vals, err := s.rc.HVals(context.Background(), s.key("scopes", "all")).Result()
+	if err != nil {
+		return
+	}
+	scopes = make([]oauth.Scope, 0, len(vals))
+	for _, v := range vals {
+		var scope oauth.Scope
+		if err = json.Unmarshal([]byte(v), &scope); err != nil {
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	return
+}
+
+// SaveScope creates or updates a scope by name
+func (s *Store) SaveScope(scope *oauth.Scope) (err error) {
+	defer wrap("SaveScope", &err)
+	b, err := json.Marshal(scope)
+	if err != nil {
+		return err
+	}
+	return s.rc.HSet(context.Background(), s.key("scopes", "all"), scope.Name, b).Err()
+}
+
+// IsAuthorized returns true if the user has authorized the client
+func (s *Store) IsAuthorized(clientID, username string) bool {
+	ok, err := s.rc.SIsMember(context.Background(), s.key("authorized", clientID), username).Result()
+	if err != nil {
+		s.log.Error("load authorized failed", "client_id", clientID, "err", err)
+	}
+	return ok
+}
+
+// SaveAuthorized remembers the authorization of the user to the client
+func (s *Store) SaveAuthorized(clientID, username string) (err error) {
+	defer wrap("SaveAuthorized", &err)
+	return s.rc.SAdd(context.Background(), s.key("authorized", clientID), username).Err()
+}
+
+// SaveJTI storage.ReplayCache, the id expires with the assertion
+func (s *Store) SaveJTI(issuer, jti string, exp time.Time) (err error) {
+	defer wrap("SaveJTI", &err)
+	ttl := time.Until(exp)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	ok, err := s.rc.SetNX(context.Background(), s.key("jti", issuer+":"+jti), 1, ttl).Result()
+	if err == nil && !ok {
+		return storage.ErrReused
+	}
+	return err
+}
+
+func toExtra(data interface{}) (oauth.JSONKV, error) {
+	if data == nil {
+		return oauth.JSONKV{}, nil
+	}
+	return oauth.ToJSONKV(data)
+}
@@ -0,0 +1,314 @@
+package redis
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/openshift/osin"
+	"github.com/pborman/uuid"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var userDataMock = oauth.JSONKV{"name": "foobar"}
+
+func newTestStore(t *testing.T) (*miniredis.Miniredis, *Store) {
+	mr := miniredis.RunT(t)
+	rc := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rc.Close() })
+	return mr, New(rc, Options{Expiry: storage.Expiry{Refresh: storage.RefreshPolicy{TTL: time.Hour}}})
+}
+
+func TestClientOperations(t *testing.T) {
+	_, store := newTestStore(t)
+
+	create := oauth.NewClient("1", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(create))
+	c, err := store.LoadClient("1")
+	require.Nil(t, err)
+	assert.Equal(t, "secret", c.GetSecret())
+	assert.Equal(t, create.Meta, c.Meta)
+
+	update := oauth.NewClient("1", "secret123", "http://www.google.com/")
+	require.Nil(t, store.SaveClient(update))
+	c, err = store.LoadClient("1")
+	require.Nil(t, err)
+	assert.Equal(t, "secret123", c.GetSecret())
+	assert.Equal(t, "http://www.google.com/", c.GetRedirectUri())
+	assert.Equal(t, create.CreatedAt.Unix(), c.CreatedAt.Unix())
+
+	require.Nil(t, store.SaveClient(oauth.NewClient("2", "secret", "http://localhost/")))
+	assert.Equal(t, uint(2), store.CountClients())
+	spec := &oauth.ClientSpec{Page: 2, Limit: 1}
+	clients, err := store.LoadClients(spec)
+	require.Nil(t, err)
+	assert.Equal(t, 2, spec.Total)
+	assert.Len(t, clients, 1)
+
+	require.Nil(t, store.RemoveClient("1"))
+	_, err = store.GetClient("1")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, uint(1), store.CountClients())
+
+	assert.NotNil(t, store.SaveClient(&oauth.Client{ID: ""}))
+}
+
+func TestAuthorizeOperations(t *testing.T) {
+	mr, store := newTestStore(t)
+	client := oauth.NewClient("2", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+
+	authorize := &osin.AuthorizeData{
+		Client:      client,
+		Code:        uuid.New(),
+		ExpiresIn:   int32(600),
+		Scope:       "scope",
+		RedirectUri: "http://localhost/",
+		State:       "state",
+		CreatedAt:   time.Now().Round(time.Second),
+		UserData:    userDataMock,
+	}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	assert.ErrorIs(t, store.SaveAuthorize(authorize), ErrExists)
+
+	result, err := store.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	assert.Equal(t, authorize.Code, result.Code)
+	assert.Equal(t, authorize.ExpiresIn, result.ExpiresIn)
+	assert.Equal(t, authorize.CreatedAt.Unix(), result.CreatedAt.Unix())
+	assert.Equal(t, authorize.Client.GetId(), result.Client.GetId())
+	assert.Equal(t, userDataMock, result.UserData)
+
+	// expires natively
+	mr.FastForward(601 * time.Second)
+	_, err = store.LoadAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	authorize.Code = uuid.New()
+	authorize.CreatedAt = time.Now()
+	require.Nil(t, store.SaveAuthorize(authorize))
+	require.Nil(t, store.RemoveAuthorize(authorize.Code))
+	_, err = store.LoadAuthorize(authorize.Code)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	authorize.UserData = struct{ foo string }{"bar"}
+	assert.NotNil(t, store.SaveAuthorize(authorize))
+}
+
+func TestAccessOperations(t *testing.T) {
+	mr, store := newTestStore(t)
+	client := oauth.NewClient("3", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	authorize := &osin.AuthorizeData{
+		Client:    client,
+		Code:      uuid.New(),
+		ExpiresIn: int32(60),
+		CreatedAt: time.Now(),
+	}
+	nestedAccess := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessToken:   uuid.New(),
+		ExpiresIn:     int32(60),
+		CreatedAt:     time.Now(),
+		UserData:      userDataMock,
+	}
+	access := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessData:    nestedAccess,
+		AccessToken:   uuid.New(),
+		ExpiresIn:     int32(60),
+		CreatedAt:     time.Now(),
+		UserData:      userDataMock,
+	}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	require.Nil(t, store.SaveAccess(nestedAccess))
+	require.Nil(t, store.SaveAccess(access))
+	require.Nil(t, store.SaveAccess(access))
+
+	result, err := store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.CreatedAt.Unix(), result.CreatedAt.Unix())
+	assert.Equal(t, nestedAccess.AccessToken, result.AccessData.AccessToken)
+	assert.Equal(t, authorize.Code, result.AuthorizeData.Code)
+	assert.Equal(t, userDataMock, result.UserData)
+
+	require.Nil(t, store.RemoveAccess(nestedAccess.AccessToken))
+	result, err = store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Nil(t, result.AccessData)
+
+	mr.FastForward(61 * time.Second)
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRefreshOperations(t *testing.T) {
+	mr, store := newTestStore(t)
+	client := oauth.NewClient("4", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	access := &osin.AccessData{
+		Client:       client,
+		AccessToken:  uuid.New(),
+		RefreshToken: uuid.New(),
+		ExpiresIn:    int32(60),
+		CreatedAt:    time.Now(),
+		UserData:     userDataMock,
+	}
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- store.SaveAccess(access) }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		require.Nil(t, <-errs)
+	}
+
+	// a token with refresh lives for the TTL of the refresh policy
+	mr.FastForward(61 * time.Second)
+	result, err := store.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.AccessToken, result.AccessToken)
+
+	require.Nil(t, store.RemoveRefresh(access.RefreshToken))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// saving the token again never restores its removed refresh token
+	require.Nil(t, store.SaveAccess(access))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+	require.Nil(t, store.SaveAccess(access))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+
+	mr.FastForward(time.Hour)
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRefreshKeyTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rc.Close() })
+	client := oauth.NewClient("5", "secret", "http://localhost/")
+
+	// without a refresh policy the keys expire with the access token
+	store := New(rc)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(),
+		ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, store.SaveAccess(access))
+	for _, key := range []string{store.key("access", access.AccessToken), store.key("refresh", access.RefreshToken)} {
+		ttl := mr.TTL(key)
+		assert.True(t, ttl > 0 && ttl <= time.Minute, "%s ttl %s", key, ttl)
+	}
+
+	// an idle timeout or a maximum lifetime bounds the keys, the earliest
+	store = New(rc, Options{Expiry: storage.Expiry{Refresh: storage.RefreshPolicy{Idle: 2 * time.Hour, MaxLifetime: 3 * time.Hour}}})
+	access.AccessToken, access.RefreshToken = uuid.New(), uuid.New()
+	require.Nil(t, store.SaveAccess(access))
+	ttl := mr.TTL(store.key("refresh", access.RefreshToken))
+	assert.True(t, ttl > time.Hour && ttl <= 2*time.Hour, "ttl %s", ttl)
+
+	// an expired access token is kept shortly, never without expiry
+	access.AccessToken, access.RefreshToken, access.ExpiresIn = uuid.New(), "", 0
+	require.Nil(t, store.SaveAccess(access))
+	assert.Equal(t, time.Second, mr.TTL(store.key("access", access.AccessToken)))
+}
+
+func TestAuthorized(t *testing.T) {
+	_, store := newTestStore(t)
+	assert.False(t, store.IsAuthorized("5", "eagle"))
+	require.Nil(t, store.SaveAuthorized("5", "eagle"))
+	assert.True(t, store.IsAuthorized("5", "eagle"))
+
+	require.Nil(t, store.SaveScope(&oauth.Scope{Name: "basic", Label: "Basic", IsDefault: true}))
+	scopes, err := store.LoadScopes()
+	require.Nil(t, err)
+	require.Len(t, scopes, 1)
+	assert.Equal(t, "basic", scopes[0].Name)
+}
+
+func TestAsStorage(t *testing.T) {
+	_, store := newTestStore(t)
+	s := oauth.AsStorage(store)
+	client := oauth.NewClient("6", "secret", "http://localhost/")
+	client.Meta.Name = "six"
+	require.Nil(t, s.SaveClient(client))
+	c, err := s.GetClient("6")
+	require.Nil(t, err)
+	assert.Equal(t, "six", c.(*oauth.Client).GetName())
+
+	u, ok := s.(storage.ClientUpdater)
+	require.True(t, ok)
+	client.Meta.Name = "seven"
+	require.Nil(t, u.UpdateClient(client, 1))
+	assert.Equal(t, 2, client.Version)
+	assert.ErrorIs(t, u.UpdateClient(client, 1), storage.ErrConflict)
+	c, err = s.GetClient("6")
+	require.Nil(t, err)
+	assert.Equal(t, "seven", c.(*oauth.Client).GetName())
+}
+
+func TestSaveJTI(t *testing.T) {
+	mr, store := newTestStore(t)
+	require.Nil(t, store.SaveJTI("rp", "1", time.Now().Add(time.Minute)))
+	assert.ErrorIs(t, store.SaveJTI("rp", "1", time.Now().Add(time.Minute)), storage.ErrReused)
+	assert.Nil(t, store.SaveJTI("other", "1", time.Now().Add(time.Minute)))
+
+	mr.FastForward(2 * time.Minute)
+	assert.Nil(t, store.SaveJTI("rp", "1", time.Now().Add(time.Minute)))
+}
+
+func TestErrors(t *testing.T) {
+	mr, store := newTestStore(t)
+	_, err := store.LoadAccess("none")
+	var se *storage.Error
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, "LoadAccess", se.Op)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// the errors of redis are of the database
+	mr.Close()
+	_, err = store.LoadAccess("none")
+	require.ErrorAs(t, err, &se)
+	assert.ErrorIs(t, err, storage.ErrDatabase)
+	assert.ErrorIs(t, store.SaveClient(oauth.NewClient("1", "secret", "http://localhost/")), storage.ErrDatabase)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	mr := miniredis.RunT(t)
+	rc := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rc.Close() })
+	store := New(rc, Options{Logger: slog.NewTextHandler(&buf, nil)})
+	client := oauth.NewClient("log", "secret", "http://localhost/")
+	require.Nil(t, store.SaveClient(client))
+	token := uuid.New()
+	err := store.SaveAccess(&osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 60,
+		CreatedAt: time.Now(), UserData: "alice@example.com"})
+	assert.NotNil(t, err)
+
+	// a failing get logs the key of the token as a hash
+	mr.Close()
+	_, err = store.LoadAccess(token)
+	assert.NotNil(t, err)
+	assert.Contains(t, buf.String(), "get failed")
+	assert.Contains(t, buf.String(), storage.TokenHash(store.key("access", token)))
+	// the user data is never logged, the tokens are hashed
+	out := buf.String()
+	assert.Contains(t, out, "invalid access userdata")
+	assert.Contains(t, out, "store=redis")
+	assert.NotContains(t, out, "alice")
+	assert.NotContains(t, out, token)
+	assert.Contains(t, out, storage.TokenHash(token))
+}
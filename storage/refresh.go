@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/openshift/osin"
+)
+
+// RefreshPolicy is the lifetime of the refresh tokens, the zero durations never expire
+type RefreshPolicy struct {
+	// TTL expires a refresh token this long after it is issued, saved with the token
+	TTL time.Duration
+	// Idle expires a refresh token not rotated for this long, so a session not used
+	Idle time.Duration
+	// MaxLifetime expires the refresh tokens rotated from the first one of an authorization this long after it
+	MaxLifetime time.Duration
+}
+
+// RefreshPolicer is a client with its own policy of refresh tokens, over the default of the storage
+type RefreshPolicer interface {
+	GetRefreshPolicy() RefreshPolicy
+}
+
+// Merge returns p with its zero durations from d
+func (p RefreshPolicy) Merge(d RefreshPolicy) RefreshPolicy {
+	if p.TTL == 0 {
+		p.TTL = d.TTL
+	}
+	if p.Idle == 0 {
+		p.Idle = d.Idle
+	}
+	if p.MaxLifetime == 0 {
+		p.MaxLifetime = d.MaxLifetime
+	}
+	return p
+}
+
+// RefreshToken is the lifetime of a refresh token, saved with it
+type RefreshToken struct {
+	// Created is when the token is issued
+	Created time.Time `json:"created"`
+	// Started is when the first token of its rotation chain is issued
+	Started time.Time `json:"started"`
+	// ExpiresAt is the expiry of the token by the TTL of the policy, zero never
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// RefreshReused reports whether the refresh token of a is the one of its previous access token,
+// kept on refresh instead of rotated
+func RefreshReused(a *osin.AccessData) bool {
+	return a.RefreshToken != "" && a.AccessData != nil && a.AccessData.RefreshToken == a.RefreshToken
+}
+
+// RefreshPolicy returns the policy of the refresh tokens of the client, its own over the default of e
+func (e Expiry) RefreshPolicy(client osin.Client) RefreshPolicy {
+	if p, ok := client.(RefreshPolicer); ok {
+		return p.GetRefreshPolicy().Merge(e.Refresh)
+	}
+	return e.Refresh
+}
+
+// NewRefreshToken returns the lifetime of the refresh token of a, issued now,
+// of the rotation chain started at started, or now with a zero started.
+func (e Expiry) NewRefreshToken(a *osin.AccessData, started time.Time) RefreshToken {
+	r := RefreshToken{Created: e.now(), Started: started}
+	if r.Started.IsZero() || r.Started.After(r.Created) {
+		r.Started = r.Created
+	}
+	if p := e.RefreshPolicy(a.Client); p.TTL > 0 {
+		r.ExpiresAt = r.Created.Add(p.TTL)
+	}
+	return r
+}
+
+// ReuseRefreshToken returns the lifetime r of a refresh token kept on refresh, issued again now
+func (e Expiry) ReuseRefreshToken(r RefreshToken) RefreshToken {
+	r.Created = e.now()
+	return r
+}
+
+// RefreshDeadline returns when the refresh token r of a expires, the skew included: the earliest of its own expiry,
+// and the idle timeout and maximum lifetime of the policy of the client of a, or zero never
+func (e Expiry) RefreshDeadline(a *osin.AccessData, r RefreshToken) time.Time {
+	at := r.ExpiresAt
+	earlier := func(t time.Time) {
+		if at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	p := e.RefreshPolicy(a.Client)
+	if p.Idle > 0 && !r.Created.IsZero() {
+		earlier(r.Created.Add(p.Idle))
+	}
+	if p.MaxLifetime > 0 && !r.Started.IsZero() {
+		earlier(r.Started.Add(p.MaxLifetime))
+	}
+	if at.IsZero() {
+		return at
+	}
+	return at.Add(e.Skew)
+}
+
+// CheckRefreshToken returns an ErrExpired if the refresh token r of a is expired by its own expiry,
+// or by the idle timeout or maximum lifetime of the policy of the client of a.
+// These are enforced once set, regardless of Enforce.
+func (e Expiry) CheckRefreshToken(a *osin.AccessData, r RefreshToken) error {
+	if !r.ExpiresAt.IsZero() {
+		if err := e.expired("refresh token", r.ExpiresAt, 0); err != nil {
+			return err
+		}
+	}
+	p := e.RefreshPolicy(a.Client)
+	if p.Idle > 0 && !r.Created.IsZero() {
+		if err := e.expired("idle refresh token", r.Created, p.Idle); err != nil {
+			return err
+		}
+	}
+	if p.MaxLifetime > 0 && !r.Started.IsZero() {
+		if err := e.expired("refresh session", r.Started, p.MaxLifetime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
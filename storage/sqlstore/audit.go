@@ -0,0 +1,103 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/liut/osin-storage/storage/audit"
+)
+
+var (
+	_ audit.Sink    = (*DbStorage)(nil)
+	_ audit.Querier = (*DbStorage)(nil)
+)
+
+// WriteEvent writes the audit event into oauth.audit
+func (s *DbStorage) WriteEvent(ev *audit.Event) error {
+	str := `INSERT INTO oauth.audit(action, target, client_id, actor, ip, state_before, state_after, created)
+		 VALUES($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{string(ev.Action), ev.Target, ev.ClientID, ev.Actor, ev.IP,
+		jsonValue(ev.Before), jsonValue(ev.After), ev.Time.UTC()}
+	var err error
+	if s.dialect.Returning() {
+		err = s.db.QueryRow(str+" RETURNING id", args...).Scan(&ev.ID)
+	} else {
+		var r sql.Result
+		if r, err = s.db.Exec(str, args...); err == nil {
+			ev.ID, err = r.LastInsertId()
+		}
+	}
+	if err != nil {
+		s.log.Error("write audit failed", "action", ev.Action, "err", err)
+	}
+	return err
+}
+
+// QueryEvents returns the audit events matching f in time order
+func (s *DbStorage) QueryEvents(f audit.Filter) (events []audit.Event, err error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	cond := func(expr string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, expr+" $"+strconv.Itoa(len(args)))
+	}
+	if f.Target != "" {
+		cond("target =", f.Target)
+	}
+	if f.ClientID != "" {
+		cond("client_id =", f.ClientID)
+	}
+	if !f.Since.IsZero() {
+		cond("created >=", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		cond("created <", f.Until.UTC())
+	}
+	str := `SELECT id, action, target, client_id, actor, ip, state_before, state_after, created FROM oauth.audit`
+	if len(where) > 0 {
+		str += " WHERE " + strings.Join(where, " AND ")
+	}
+	str += " ORDER BY created, id"
+	if f.Limit > 0 {
+		str += " LIMIT " + strconv.Itoa(f.Limit)
+	}
+
+	rows, err := s.db.Query(str, args...)
+	if err != nil {
+		s.log.Error("query audit failed", "err", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ev            audit.Event
+			action        string
+			before, after []byte
+		)
+		if err = rows.Scan(&ev.ID, &action, &ev.Target, &ev.ClientID, &ev.Actor, &ev.IP, &before, &after, &ev.Time); err != nil {
+			return
+		}
+		ev.Action = audit.Action(action)
+		if len(before) > 0 {
+			ev.Before = json.RawMessage(before)
+		}
+		if len(after) > 0 {
+			ev.After = json.RawMessage(after)
+		}
+		events = append(events, ev)
+	}
+	err = rows.Err()
+	return
+}
+
+// jsonValue values JSON as text, nil as NULL
+func jsonValue(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
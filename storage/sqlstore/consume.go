@@ -0,0 +1,110 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/openshift/osin"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/outbox"
+	"github.com/liut/osin-storage/storage/tracing"
+)
+
+var _ storage.AuthorizeConsumer = (*DbStorage)(nil)
+
+// ConsumeAuthorize marks the code used with a conditional update and loads it, only the first call succeeds.
+// The next calls return storage.ErrReused, and revoke the tokens issued with the code and refreshed from them.
+// An empty code is never found. LoadAuthorize never consumes the code, e.g. policy.Server consumes it
+// once osin authenticated the client.
+func (s *DbStorage) ConsumeAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	s, done := s.op("ConsumeAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
+	// the tokens without a code, e.g. of client credentials, are saved with an empty one
+	if code == "" {
+		return nil, storage.ErrNotFound
+	}
+	var reused bool
+	qs := func(tx DBTxer) error {
+		r, err := tx.Exec(`UPDATE oauth.authorize SET used_at = $1 WHERE code = $2 AND used_at IS NULL`, time.Now(), code)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n > 0 {
+			return nil
+		}
+		var used int
+		if err = tx.QueryRow(`SELECT COUNT(*) FROM oauth.authorize WHERE code = $1`, code).Scan(&used); err != nil {
+			return err
+		}
+		tokens, err := issuedTokens(tx, code)
+		if err != nil {
+			return err
+		}
+		// the code may be removed by osin after the tokens are issued
+		if used == 0 && len(tokens) == 0 {
+			return sql.ErrNoRows
+		}
+		reused = true
+		s.log.Warn("authorize code reused", "code", code, "revoked", len(tokens))
+		return s.revokeTokens(tx, tokens)
+	}
+	if err = s.withTxQuery(qs); err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, storage.ErrReused
+	}
+	return s.LoadAuthorize(code)
+}
+
+// issuedTokens returns the access tokens issued with the code, and the tokens refreshed from them:
+// saved with the code of their chain, or previous ones of a chain still saved
+func issuedTokens(tx DBTxer, code string) (tokens []string, err error) {
+	next, err := queryTokens(tx, `SELECT access_token FROM oauth.access WHERE authorize_code = $1`, code)
+	for len(next) > 0 && err == nil {
+		tokens = append(tokens, next...)
+		var refreshed []string
+		for _, token := range next {
+			var ts []string
+			if ts, err = queryTokens(tx, `SELECT access_token FROM oauth.access WHERE previous = $1`, token); err != nil {
+				break
+			}
+			refreshed = append(refreshed, ts...)
+		}
+		next = refreshed
+	}
+	return
+}
+
+func queryTokens(tx DBTxer, query string, arg string) (tokens []string, err error) {
+	rows, err := tx.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// revokeTokens removes the access tokens and their refresh tokens in tx
+func (s *DbStorage) revokeTokens(tx DBTxer, tokens []string) error {
+	for _, token := range tokens {
+		if _, err := tx.Exec(`DELETE FROM oauth.refresh WHERE access = $1`, token); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM oauth.access WHERE access_token = $1`, token); err != nil {
+			return err
+		}
+		if err := s.enqueue(tx, outbox.TokenRevoked(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
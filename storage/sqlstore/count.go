@@ -0,0 +1,28 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+var _ storage.ActiveCounter = (*DbStorage)(nil)
+
+// CountActive counts the clients, the codes and tokens not expired, and the refresh tokens
+func (s *DbStorage) CountActive() (c storage.Counts, err error) {
+	s, done := s.op("CountActive")
+	defer func() { err = done(err) }()
+	now := time.Now()
+	notExpired := " WHERE NOT (" + s.dialect.Expired("created", "expires_in", "$1") + ")"
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM oauth.client").Scan(&c.Clients); err != nil {
+		return
+	}
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM oauth.authorize"+notExpired, now).Scan(&c.Codes); err != nil {
+		return
+	}
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM oauth.access"+notExpired, now).Scan(&c.Tokens); err != nil {
+		return
+	}
+	err = s.db.QueryRow("SELECT COUNT(*) FROM oauth.refresh").Scan(&c.Refreshes)
+	return
+}
@@ -2,7 +2,6 @@ package sqlstore
 
 import (
 	"database/sql"
-	"log"
 	"os"
 )
 
@@ -27,12 +26,12 @@ func (s *DbStorage) withTxQuery(query func(tx DBTxer) error) error {
 
 	tx, err := s.db.Begin()
 	if err == nil {
-		if err = query(tx); err == nil {
+		if err = query(s.txer(tx)); err == nil {
 			return tx.Commit()
 		}
+		tx.Rollback()
 	}
-	tx.Rollback()
-	log.Printf("tx query ERR: %s", err)
+	s.log.Error("transaction failed", "err", err)
 	return err
 }
 
@@ -1,5 +0,0 @@
-package sqlstore
-
-import . "github.com/wealthworks/go-debug"
-
-var debug = Debug("osin:storage")
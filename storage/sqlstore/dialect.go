@@ -0,0 +1,219 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dialect is the flavor of SQL spoken by the database.
+// Queries of DbStorage are written for PostgreSQL, with $n placeholders and oauth. tables,
+// and rewritten for other dialects.
+// JSON columns (jsonb, json or text) are valued as text by JSONKV and ClientMeta.
+type Dialect interface {
+	// Name of the dialect
+	Name() string
+	// Table returns the name of a table in the oauth schema, e.g. oauth.client for "client"
+	Table(name string) string
+	// Placeholder returns the placeholder of the n-th argument, starting from 1.
+	// A dialect returning the same placeholder for all is positional, the arguments are reordered.
+	Placeholder(n int) string
+	// Upsert returns an INSERT of columns into table, which updates the columns update on a conflict of keys,
+	// or ignores the conflict if update is empty. It is written as postgres and rewritten as any query.
+	Upsert(table string, columns, keys, update []string) string
+	// Returning reports whether INSERT/DELETE ... RETURNING is supported.
+	Returning() bool
+	// Expired returns a condition of rows expired at now, which are created plus expiresIn seconds,
+	// the arguments are SQL expressions
+	Expired(created, expiresIn, now string) string
+}
+
+// dialects
+var (
+	Postgres Dialect = postgres{}
+	SQLite   Dialect = sqlite{}
+	MySQL    Dialect = mysql{}
+)
+
+type postgres struct{}
+
+func (postgres) Name() string             { return "postgres" }
+func (postgres) Table(name string) string { return "oauth." + name }
+func (postgres) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+func (postgres) Returning() bool          { return true }
+func (postgres) Upsert(table string, columns, keys, update []string) string {
+	return upsertOnConflict(table, columns, keys, update)
+}
+func (postgres) Expired(created, expiresIn, now string) string {
+	return fmt.Sprintf("%s + %s * interval '1 second' <= %s", created, expiresIn, now)
+}
+
+// sqlite has no schemas, tables are prefixed with oauth_ and JSON is stored as text
+type sqlite struct{}
+
+func (sqlite) Name() string             { return "sqlite3" }
+func (sqlite) Table(name string) string { return "oauth_" + name }
+func (sqlite) Placeholder(n int) string { return "?" + strconv.Itoa(n) }
+func (sqlite) Returning() bool          { return true }
+func (sqlite) Upsert(table string, columns, keys, update []string) string {
+	return upsertOnConflict(table, columns, keys, update)
+}
+
+// Expired compares in UTC, timestamps are stored as text with a zone
+func (sqlite) Expired(created, expiresIn, now string) string {
+	return fmt.Sprintf("datetime(%s, '+' || %s || ' seconds') <= datetime(%s)", created, expiresIn, now)
+}
+
+// mysql (and MariaDB) uses tables prefixed with oauth_ in the current database,
+// timestamps need parseTime=true in the DSN.
+type mysql struct{}
+
+func (mysql) Name() string             { return "mysql" }
+func (mysql) Table(name string) string { return "oauth_" + name }
+func (mysql) Placeholder(n int) string { return "?" }
+func (mysql) Returning() bool          { return false }
+func (mysql) Expired(created, expiresIn, now string) string {
+	return fmt.Sprintf("DATE_ADD(%s, INTERVAL %s SECOND) <= %s", created, expiresIn, now)
+}
+
+// Upsert ignores a conflict with a no-op update of the first key, not INSERT IGNORE which also ignores
+// the other errors, e.g. of a truncated value. A no-op update affects no rows, unless clientFoundRows=true in the DSN.
+func (mysql) Upsert(table string, columns, keys, update []string) string {
+	if len(update) == 0 {
+		return "INSERT INTO " + table + insertValues(columns) + fmt.Sprintf(" ON DUPLICATE KEY UPDATE %s = %s", keys[0], keys[0])
+	}
+	sets := make([]string, len(update))
+	for i, col := range update {
+		sets[i] = fmt.Sprintf("%s = VALUES(%s)", col, col)
+	}
+	return "INSERT INTO " + table + insertValues(columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+func insertValues(columns []string) string {
+	ph := make([]string, len(columns))
+	for i := range columns {
+		ph[i] = "$" + strconv.Itoa(i+1)
+	}
+	return "(" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(ph, ", ") + ")"
+}
+
+func upsertOnConflict(table string, columns, keys, update []string) string {
+	q := "INSERT INTO " + table + insertValues(columns) + " ON CONFLICT (" + strings.Join(keys, ", ") + ")"
+	if len(update) == 0 {
+		return q + " DO NOTHING"
+	}
+	sets := make([]string, len(update))
+	for i, col := range update {
+		sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", col, col)
+	}
+	return q + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+var (
+	reTable       = regexp.MustCompile(`\boauth\.(\w+)`)
+	rePlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+	rebound sync.Map
+)
+
+type reboundKey struct {
+	dialect, query string
+}
+
+type reboundQuery struct {
+	query string
+	order []int // argument indexes of a positional dialect, nil if unchanged
+}
+
+// rebind rewrites a query written for postgres to the dialect d
+func rebind(d Dialect, query string) reboundQuery {
+	key := reboundKey{d.Name(), query}
+	if v, ok := rebound.Load(key); ok {
+		return v.(reboundQuery)
+	}
+	positional := d.Placeholder(1) == d.Placeholder(2)
+	var r reboundQuery
+	q := reTable.ReplaceAllStringFunc(query, func(m string) string {
+		return d.Table(m[len("oauth."):])
+	})
+	q = rePlaceholder.ReplaceAllStringFunc(q, func(m string) string {
+		n, _ := strconv.Atoi(m[1:])
+		if positional {
+			r.order = append(r.order, n-1)
+		}
+		return d.Placeholder(n)
+	})
+	r.query = strings.TrimRight(strings.TrimSpace(q), ";")
+	if isSequence(r.order) {
+		r.order = nil
+	}
+	rebound.Store(key, r)
+	return r
+}
+
+func isSequence(order []int) bool {
+	for i, n := range order {
+		if i != n {
+			return false
+		}
+	}
+	return true
+}
+
+func (r reboundQuery) args(args []interface{}) []interface{} {
+	if r.order == nil {
+		return args
+	}
+	out := make([]interface{}, len(r.order))
+	for i, n := range r.order {
+		if n < len(args) {
+			out[i] = args[n]
+		}
+	}
+	return out
+}
+
+// rebindDB is a DBer speaking a dialect other than postgres
+type rebindDB struct {
+	DBer
+	d Dialect
+}
+
+func (db rebindDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	r := rebind(db.d, query)
+	return db.DBer.Query(r.query, r.args(args)...)
+}
+
+func (db rebindDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	r := rebind(db.d, query)
+	return db.DBer.QueryRow(r.query, r.args(args)...)
+}
+
+func (db rebindDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r := rebind(db.d, query)
+	return db.DBer.Exec(r.query, r.args(args)...)
+}
+
+// rebindTx is a DBTxer speaking a dialect other than postgres
+type rebindTx struct {
+	DBTxer
+	d Dialect
+}
+
+func (tx rebindTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	r := rebind(tx.d, query)
+	return tx.DBTxer.Query(r.query, r.args(args)...)
+}
+
+func (tx rebindTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	r := rebind(tx.d, query)
+	return tx.DBTxer.QueryRow(r.query, r.args(args)...)
+}
+
+func (tx rebindTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r := rebind(tx.d, query)
+	return tx.DBTxer.Exec(r.query, r.args(args)...)
+}
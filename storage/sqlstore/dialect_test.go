@@ -0,0 +1,40 @@
+package sqlstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	q := "SELECT created FROM oauth.client_user_authorized WHERE client_id = $1 AND username = $2;"
+	assert.Equal(t, q, rebind(Postgres, q).query+";")
+	assert.Equal(t, "SELECT created FROM oauth_client_user_authorized WHERE client_id = ?1 AND username = ?2",
+		rebind(SQLite, q).query)
+
+	r := rebind(MySQL, q)
+	assert.Equal(t, "SELECT created FROM oauth_client_user_authorized WHERE client_id = ? AND username = ?", r.query)
+	assert.Nil(t, r.order)
+
+	r = rebind(MySQL, "UPDATE oauth.client SET secret = $2 WHERE id = $1 AND secret <> $2")
+	assert.Equal(t, "UPDATE oauth_client SET secret = ? WHERE id = ? AND secret <> ?", r.query)
+	assert.Equal(t, []interface{}{"s", "id", "s"}, r.args([]interface{}{"id", "s"}))
+}
+
+func TestUpsert(t *testing.T) {
+	cols, keys, update := []string{"id", "secret"}, []string{"id"}, []string{"secret"}
+	assert.Equal(t, "INSERT INTO oauth.client(id, secret) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET secret = EXCLUDED.secret",
+		Postgres.Upsert("oauth.client", cols, keys, update))
+	assert.Equal(t, "INSERT INTO oauth.client(id, secret) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING",
+		SQLite.Upsert("oauth.client", cols, keys, nil))
+	assert.Equal(t, "INSERT INTO oauth_client(id, secret) VALUES (?, ?) ON DUPLICATE KEY UPDATE secret = VALUES(secret)",
+		rebind(MySQL, MySQL.Upsert("oauth.client", cols, keys, update)).query)
+	assert.Equal(t, "INSERT INTO oauth.client(id, secret) VALUES ($1, $2) ON DUPLICATE KEY UPDATE id = id",
+		MySQL.Upsert("oauth.client", cols, keys, nil))
+}
+
+func TestExpired(t *testing.T) {
+	assert.Equal(t, "created + expires_in * interval '1 second' <= $1", Postgres.Expired("created", "expires_in", "$1"))
+	assert.Equal(t, "datetime(created, '+' || expires_in || ' seconds') <= datetime($1)", SQLite.Expired("created", "expires_in", "$1"))
+	assert.Equal(t, "DATE_ADD(created, INTERVAL expires_in SECOND) <= $1", MySQL.Expired("created", "expires_in", "$1"))
+}
@@ -1,12 +1,38 @@
 package sqlstore
 
 import (
+	"database/sql"
 	"errors"
+	"strings"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/oauth"
 )
 
+// errors, the methods return a storage.Error of the kinds of package storage
 var (
-	dbError        = errors.New("database error")
-	ErrNotFound    = errors.New("Not Found")
-	valueError     = errors.New("value error")
-	ErrInvalidJSON = errors.New("Invalid JSON")
+	ErrNotFound    = storage.ErrNotFound
+	ErrInvalidJSON = oauth.ErrInvalidJSON
 )
+
+// errKind classifies an error of the database
+func errKind(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	if isConflict(err) {
+		return storage.ErrConflict
+	}
+	return storage.ErrDatabase
+}
+
+// isConflict reports whether err is a violation of a unique key in postgres, sqlite or mysql
+func isConflict(err error) bool {
+	var se interface{ SQLState() string }
+	if errors.As(err, &se) {
+		return se.SQLState() == "23505"
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "duplicate key") || strings.Contains(msg, "UNIQUE constraint failed") ||
+		strings.Contains(msg, "Duplicate entry")
+}
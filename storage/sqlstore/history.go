@@ -0,0 +1,98 @@
+package sqlstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/audit"
+	"github.com/liut/osin-storage/storage/oauth"
+	"github.com/liut/osin-storage/storage/tracing"
+)
+
+var _ oauth.ClientHistory = (*DbStorage)(nil)
+
+const selectRevision = `SELECT client_id, version, secret, redirect_uri, meta, actor, created, removed FROM oauth.client_revision`
+
+// secretDigest returns the digest of a secret kept in oauth.client_revision, which fits its column,
+// so the revisions compare the secrets without keeping them
+func secretDigest(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:16])
+}
+
+// saveRevision appends the client c to oauth.client_revision in tx, saved by the actor of the context of s.
+// The secret is kept as its digest, a removal is a tombstone of the id and the version.
+func (s *DbStorage) saveRevision(tx DBTxer, c *Client, removed bool) error {
+	actor, _ := audit.FromContext(s.ctx)
+	_, err := tx.Exec(`INSERT INTO oauth.client_revision(client_id, version, secret, redirect_uri, meta, actor, created, removed)
+		 VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		c.ID, c.Version, secretDigest(c.Secret), c.RedirectURI, c.Meta, actor.Name, c.UpdatedAt, removed)
+	if err != nil {
+		s.log.Error("save client revision failed", "client_id", c.ID, "version", c.Version, "err", err)
+	}
+	return err
+}
+
+func scanRevision(row interface{ Scan(...interface{}) error }) (r oauth.ClientRevision, err error) {
+	c := &r.Client
+	err = row.Scan(&c.ID, &c.Version, &c.Secret, &c.RedirectURI, &c.Meta, &r.Actor, &r.Created, &r.Removed)
+	c.UpdatedAt = r.Created
+	return
+}
+
+// ClientRevisions returns the revisions of the client, the latest first
+func (s *DbStorage) ClientRevisions(id string) (revs []oauth.ClientRevision, err error) {
+	s, done := s.op("ClientRevisions", tracing.ClientID(id))
+	defer func() { err = done(err) }()
+	rows, err := s.db.Query(selectRevision+" WHERE client_id = $1 ORDER BY version DESC", id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r oauth.ClientRevision
+		if r, err = scanRevision(rows); err != nil {
+			return
+		}
+		revs = append(revs, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// ClientRevision returns the revision of the client by version
+func (s *DbStorage) ClientRevision(id string, version int) (rev *oauth.ClientRevision, err error) {
+	s, done := s.op("ClientRevision", tracing.ClientID(id))
+	defer func() { err = done(err) }()
+	r, err := scanRevision(s.db.QueryRow(selectRevision+" WHERE client_id = $1 AND version = $2", id, version))
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RestoreClient saves the client of the revision by version again, as a new version with the current secret,
+// so a rotated secret is never restored, nor a removed client
+func (s *DbStorage) RestoreClient(id string, version int) (err error) {
+	s, done := s.op("RestoreClient", tracing.ClientID(id))
+	defer func() { err = done(err) }()
+	r, err := s.ClientRevision(id, version)
+	if err != nil {
+		return
+	}
+	if r.Removed {
+		return fmt.Errorf("%w: version %d of client %s is its removal", storage.ErrInvalidValue, version, id)
+	}
+	current, err := s.GetClientWithCode(id)
+	if err != nil {
+		return
+	}
+	r.Client.Secret = current.Secret
+	s.log.Info("restore client", "client_id", id, "version", version)
+	return s.saveClient(&r.Client, -1)
+}
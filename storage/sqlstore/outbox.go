@@ -0,0 +1,63 @@
+package sqlstore
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liut/osin-storage/storage/outbox"
+)
+
+var _ outbox.Store = (*DbStorage)(nil)
+
+// enqueue writes m into oauth.outbox in tx, if WithOutbox
+func (s *DbStorage) enqueue(tx DBTxer, m *outbox.Message) error {
+	if !s.outbox {
+		return nil
+	}
+	_, err := tx.Exec("INSERT INTO oauth.outbox(aggregate, kind, payload, created) VALUES($1, $2, $3, $4)",
+		m.Aggregate, m.Kind, string(m.Payload), m.Created.UTC())
+	if err != nil {
+		s.log.Error("enqueue failed", "kind", m.Kind, "aggregate", m.Aggregate, "err", err)
+	}
+	return err
+}
+
+// PendingMessages returns the oldest messages of oauth.outbox not delivered
+func (s *DbStorage) PendingMessages(limit int) (msgs []outbox.Message, err error) {
+	rows, err := s.db.Query(`SELECT id, aggregate, kind, payload, created FROM oauth.outbox
+		 WHERE delivered IS NULL ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			m       outbox.Message
+			payload []byte
+		)
+		if err = rows.Scan(&m.ID, &m.Aggregate, &m.Kind, &payload, &m.Created); err != nil {
+			return
+		}
+		m.Payload = json.RawMessage(payload)
+		msgs = append(msgs, m)
+	}
+	err = rows.Err()
+	return
+}
+
+// MarkDelivered marks the messages of oauth.outbox delivered
+func (s *DbStorage) MarkDelivered(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{time.Now().UTC()}
+	ph := make([]string, len(ids))
+	for i, id := range ids {
+		args = append(args, id)
+		ph[i] = "$" + strconv.Itoa(i+2)
+	}
+	_, err := s.db.Exec("UPDATE oauth.outbox SET delivered = $1 WHERE id IN ("+strings.Join(ph, ", ")+")", args...)
+	return err
+}
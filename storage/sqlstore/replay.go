@@ -0,0 +1,29 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/liut/osin-storage/storage"
+)
+
+var _ storage.ReplayCache = (*DbStorage)(nil)
+
+// SaveJTI storage.ReplayCache, the expired ids are deleted first
+func (s *DbStorage) SaveJTI(issuer, jti string, exp time.Time) (err error) {
+	s, done := s.op("SaveJTI")
+	defer func() { err = done(err) }()
+	now := time.Now().UTC()
+	if _, err = s.db.Exec("DELETE FROM oauth.jti WHERE "+s.dialect.Expired("expires", "0", "$1"), now); err != nil {
+		return
+	}
+	r, err := s.db.Exec(s.dialect.Upsert("oauth.jti", []string{"issuer", "jti", "expires"}, []string{"issuer", "jti"}, nil),
+		issuer, jti, exp.UTC())
+	if err != nil {
+		s.log.Error("save jti failed", "issuer", issuer, "err", err)
+		return
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return storage.ErrReused
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package sqlstore
+
+import (
+	"database/sql"
+
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+const resealBatch = 100
+
+// sealedColumns are the JSON columns sealed by oauth.SetKeyring, with the key column of their table
+var sealedColumns = []struct{ table, key, column string }{
+	{"oauth.client", "id", "meta"},
+	{"oauth.authorize", "code", "extra"},
+	{"oauth.access", "access_token", "extra"},
+	{"oauth.signing_key", "kid", "private_key"},
+}
+
+type sealedRow struct {
+	key  string
+	data []byte
+}
+
+// Reseal seals the JSON columns again with the primary key of k, after a key rotation
+// or to encrypt existing rows, and returns the number of rows updated.
+// The old keys must still be in k.
+func (s *DbStorage) Reseal(k *oauth.Keyring) (n int, err error) {
+	s, done := s.op("Reseal")
+	defer func() { err = done(err) }()
+	for _, sc := range sealedColumns {
+		var last string
+		for {
+			var batch []sealedRow
+			if batch, err = s.sealedBatch(sc.table, sc.key, sc.column, last); err != nil {
+				return
+			}
+			for _, r := range batch {
+				out, changed, e := k.Reseal(r.data)
+				if e != nil {
+					s.log.Error("reseal failed", "table", sc.table, sc.key, r.key, "err", e)
+					return n, e
+				}
+				if !changed {
+					continue
+				}
+				if _, err = s.db.Exec("UPDATE "+sc.table+" SET "+sc.column+" = $1 WHERE "+sc.key+" = $2",
+					string(out), r.key); err != nil {
+					s.log.Error("reseal failed", "table", sc.table, sc.key, r.key, "err", err)
+					return
+				}
+				n++
+			}
+			if len(batch) < resealBatch {
+				break
+			}
+			last = batch[len(batch)-1].key
+		}
+	}
+	m, err := s.resealRevisions(k)
+	n += m
+	return
+}
+
+// resealRevisions reseals the meta of oauth.client_revision, keyed by client_id and version
+func (s *DbStorage) resealRevisions(k *oauth.Keyring) (n int, err error) {
+	var (
+		last    string
+		version int
+	)
+	for {
+		var rows *sql.Rows
+		rows, err = s.db.Query(`SELECT client_id, version, meta FROM oauth.client_revision
+			 WHERE client_id > $1 OR (client_id = $1 AND version > $2) ORDER BY client_id, version LIMIT $3`,
+			last, version, resealBatch)
+		if err != nil {
+			return
+		}
+		type revisionRow struct {
+			sealedRow
+			version int
+		}
+		var batch []revisionRow
+		for rows.Next() {
+			var r revisionRow
+			if err = rows.Scan(&r.key, &r.version, &r.data); err != nil {
+				rows.Close()
+				return
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return
+		}
+		for _, r := range batch {
+			out, changed, e := k.Reseal(r.data)
+			if e != nil {
+				s.log.Error("reseal failed", "table", "oauth.client_revision", "client_id", r.key, "version", r.version, "err", e)
+				return n, e
+			}
+			if !changed {
+				continue
+			}
+			if _, err = s.db.Exec("UPDATE oauth.client_revision SET meta = $1 WHERE client_id = $2 AND version = $3",
+				string(out), r.key, r.version); err != nil {
+				s.log.Error("reseal failed", "table", "oauth.client_revision", "client_id", r.key, "version", r.version, "err", err)
+				return
+			}
+			n++
+		}
+		if len(batch) < resealBatch {
+			return
+		}
+		last, version = batch[len(batch)-1].key, batch[len(batch)-1].version
+	}
+}
+
+func (s *DbStorage) sealedBatch(table, key, column, after string) (batch []sealedRow, err error) {
+	rows, err := s.db.Query("SELECT "+key+", "+column+" FROM "+table+" WHERE "+key+" > $1 ORDER BY "+key+" LIMIT $2",
+		after, resealBatch)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r sealedRow
+		if err = rows.Scan(&r.key, &r.data); err != nil {
+			return
+		}
+		batch = append(batch, r)
+	}
+	err = rows.Err()
+	return
+}
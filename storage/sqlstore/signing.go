@@ -0,0 +1,102 @@
+package sqlstore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/jwt"
+	"github.com/liut/osin-storage/storage/oauth"
+)
+
+var _ jwt.KeyStore = (*DbStorage)(nil)
+
+// ErrNoKeyring is returned by SaveSigningKey without a keyring, the private keys are not saved in clear
+var ErrNoKeyring = fmt.Errorf("%w: signing keys are sealed, set a keyring with oauth.SetKeyring", storage.ErrInvalidValue)
+
+// WithPlainSigningKeys allows SaveSigningKey without a keyring, the private keys are then in clear
+// in oauth.signing_key, e.g. for tests
+func WithPlainSigningKeys() Option {
+	return func(s *DbStorage) {
+		s.plainKeys = true
+	}
+}
+
+// privateKey is the JSON of a signing key in oauth.signing_key, sealed by the keyring as the client meta
+type privateKey struct {
+	PKCS8 []byte `json:"pkcs8"`
+}
+
+// SigningKeys jwt.KeyStore
+func (s *DbStorage) SigningKeys() (keys []jwt.SigningKey, err error) {
+	s, done := s.op("SigningKeys")
+	defer func() { err = done(err) }()
+	rows, err := s.db.Query(`SELECT kid, alg, state, private_key, created, updated FROM oauth.signing_key ORDER BY created DESC`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			k     jwt.SigningKey
+			state string
+			data  []byte
+			pk    privateKey
+		)
+		if err = rows.Scan(&k.Kid, &k.Alg, &state, &data, &k.Created, &k.Updated); err != nil {
+			return
+		}
+		if err = oauth.UnmarshalSealed(data, &pk); err != nil {
+			s.log.Error("open signing key failed", "kid", k.Kid, "err", err)
+			return
+		}
+		var key interface{}
+		if key, err = x509.ParsePKCS8PrivateKey(pk.PKCS8); err != nil {
+			return
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: signing key %s", storage.ErrInvalidValue, k.Kid)
+		}
+		k.State, k.Key = jwt.KeyState(state), signer
+		keys = append(keys, k)
+	}
+	err = rows.Err()
+	return
+}
+
+// SaveSigningKey jwt.KeyStore, the private key of a saved key is not updated.
+// It returns ErrNoKeyring without a keyring, unless WithPlainSigningKeys.
+func (s *DbStorage) SaveSigningKey(k *jwt.SigningKey) (err error) {
+	s, done := s.op("SaveSigningKey")
+	defer func() { err = done(err) }()
+	if oauth.CurrentKeyring() == nil {
+		if !s.plainKeys {
+			return ErrNoKeyring
+		}
+		s.log.Warn("signing key saved without a keyring", "kid", k.Kid)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.Key)
+	if err != nil {
+		return fmt.Errorf("%w: %s", storage.ErrInvalidValue, err)
+	}
+	data, err := oauth.MarshalSealed(privateKey{PKCS8: der})
+	if err != nil {
+		return
+	}
+	str := s.dialect.Upsert("oauth.signing_key", []string{"kid", "alg", "state", "private_key", "created", "updated"},
+		[]string{"kid"}, []string{"state", "updated"})
+	if _, err = s.db.Exec(str, k.Kid, k.Alg, string(k.State), string(data), k.Created, k.Updated); err != nil {
+		s.log.Error("save signing key failed", "kid", k.Kid, "err", err)
+	}
+	return
+}
+
+// RemoveSigningKey jwt.KeyStore
+func (s *DbStorage) RemoveSigningKey(kid string) (err error) {
+	s, done := s.op("RemoveSigningKey")
+	defer func() { err = done(err) }()
+	_, err = s.db.Exec(`DELETE FROM oauth.signing_key WHERE kid = $1`, kid)
+	return
+}
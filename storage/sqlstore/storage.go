@@ -1,45 +1,109 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/openshift/osin"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/jwt"
+	"github.com/liut/osin-storage/storage/logging"
 	"github.com/liut/osin-storage/storage/oauth"
+	"github.com/liut/osin-storage/storage/outbox"
+	"github.com/liut/osin-storage/storage/tracing"
 )
 
 var (
-	_ Storage = (*DbStorage)(nil)
+	_ Storage               = (*DbStorage)(nil)
+	_ storage.ClientUpdater = (*DbStorage)(nil)
 )
 
 type Storage interface {
 	storage.Storage
+	storage.ClientUpdater
+	oauth.ClientHistory
+	storage.ReplayCache
+	jwt.KeyStore
 	AllClients(vals url.Values) ([]Client, int, error)
 	GetClientWithCode(code string) (*Client, error)
 	LoadScopes() (scopes []*Scope, err error)
 	IsAuthorized(client_id, username string) bool
 	SaveAuthorized(client_id, username string) error
+	Reseal(k *oauth.Keyring) (int, error)
+	WithContext(ctx context.Context) Storage
 }
 
 type DbStorage struct {
-	db DBer
+	db      DBer
+	base    DBer
+	dialect Dialect
+	outbox  bool
+	tracer  trace.Tracer
+	ctx     context.Context
+	log     *slog.Logger
+	expiry  storage.Expiry
+
+	plainKeys bool
+}
+
+// Option of DbStorage
+type Option func(s *DbStorage)
+
+// WithDialect sets the SQL dialect of the database, default is Postgres
+func WithDialect(d Dialect) Option {
+	return func(s *DbStorage) {
+		s.dialect = d
+	}
+}
+
+// WithOutbox writes the events of client and token mutations into oauth.outbox,
+// in the same transaction, see outbox.NewRelay
+func WithOutbox() Option {
+	return func(s *DbStorage) {
+		s.outbox = true
+	}
+}
+
+// WithLogger logs to the handler h, default is the handler of slog.Default().
+// Codes and tokens are logged as hashes, and secrets are never logged.
+func WithLogger(h slog.Handler) Option {
+	return func(s *DbStorage) {
+		s.log = logging.New(h, "sqlstore")
+	}
+}
+
+// WithExpiry enforces the expiry policy e when codes and tokens are loaded
+func WithExpiry(e storage.Expiry) Option {
+	return func(s *DbStorage) {
+		s.expiry = e
+	}
 }
 
 // New returns a new sql storage instance.
-func New(db DBer) Storage {
-	s := &DbStorage{db: db}
+func New(db DBer, opts ...Option) Storage {
+	s := &DbStorage{base: db, dialect: Postgres, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.log == nil {
+		s.log = logging.New(nil, "sqlstore")
+	}
+	s.db = s.conn(s.ctx)
 
 	return s
 }
 
 func (s *DbStorage) Clone() osin.Storage {
-	return New(s.db)
+	c := *s
+	return &c
 }
 
 func (s *DbStorage) Close() {
@@ -47,34 +111,38 @@ func (s *DbStorage) Close() {
 }
 
 func (s *DbStorage) GetClient(id string) (c osin.Client, err error) {
+	s, done := s.op("GetClient", tracing.ClientID(id))
+	defer func() { err = done(err) }()
 	c, err = s.GetClientWithCode(id)
 	if err != nil {
-		log.Printf("Client %q not found", id)
+		s.log.Debug("client not found", "client_id", id, "err", err)
 	}
 	return
 }
 
-func (s *DbStorage) SaveAuthorize(data *osin.AuthorizeData) error {
-	if _, err := oauth.ToJSONKV(data.UserData); err != nil {
-		log.Printf("SaveAuthorize userdata %+v, ERR %s", data.UserData, err)
+func (s *DbStorage) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	s, done := s.op("SaveAuthorize", tracing.Token(data.Code))
+	defer func() { err = done(err) }()
+	extra, err := oauth.ToJSONKV(data.UserData)
+	if err != nil {
+		s.log.Warn("invalid authorize userdata", "code", data.Code, "err", err)
 		return err
 	}
-	if data.UserData == nil {
-		data.UserData = JSONKV{}
-	}
 
-	r, err := s.db.Exec(`INSERT INTO oauth.authorize(code, client_id, extra, redirect_uri, expires_in, scopes, created)
+	_, err = s.db.Exec(`INSERT INTO oauth.authorize(code, client_id, extra, redirect_uri, expires_in, scopes, created)
 		    VALUES($1, $2, $3, $4, $5, $6, $7);`,
-		data.Code, data.Client.GetId(), data.UserData,
+		data.Code, data.Client.GetId(), extra,
 		data.RedirectUri, data.ExpiresIn, data.Scope, data.CreatedAt)
 	if err != nil {
-		debug("SaveAuthorize: code '%s', extra '%s', result %v, ERR: %s", data.Code, data.UserData, r, err)
+		s.log.Error("save authorize failed", "code", data.Code, "client_id", data.Client.GetId(), "err", err)
 	}
 
 	return err
 }
 
 func (s *DbStorage) LoadAuthorize(code string) (a *osin.AuthorizeData, err error) {
+	s, done := s.op("LoadAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
 	var (
 		client_id string
 		extra     JSONKV
@@ -88,44 +156,48 @@ func (s *DbStorage) LoadAuthorize(code string) (a *osin.AuthorizeData, err error
 		a.UserData = extra
 		a.Client, err = s.GetClientWithCode(client_id)
 
-		debug("loaded authorization '%s' ok, createdAt %s", code, a.CreatedAt)
+		s.log.Debug("loaded authorize", "code", code, "created", a.CreatedAt)
+		if err == nil {
+			err = s.expiry.CheckAuthorize(a)
+		}
 		return
 	}
-	if err == sql.ErrNoRows {
-		err = ErrNotFound
+	if errors.Is(err, sql.ErrNoRows) {
 		return
 	}
-	debug("load authorize '%s' ERR: %s", code, err)
-	log.Printf("Authorize %q not found", code)
+	s.log.Error("load authorize failed", "code", code, "err", err)
 	return
 }
 
-func (s *DbStorage) RemoveAuthorize(code string) error {
+func (s *DbStorage) RemoveAuthorize(code string) (err error) {
+	s, done := s.op("RemoveAuthorize", tracing.Token(code))
+	defer func() { err = done(err) }()
 	if code == "" {
-		log.Print("authorize code is empty")
+		s.log.Warn("authorize code is empty")
 		return nil
 	}
 	qs := func(tx DBTxer) error {
 		sql := `DELETE FROM oauth.authorize WHERE code = $1;`
-		r, err := tx.Exec(sql, code)
+		_, err := tx.Exec(sql, code)
 		if err != nil {
 			return err
 		}
 
-		debug("delete authorizeData code %s OK %v", code, r)
+		s.log.Debug("removed authorize", "code", code)
 
 		return nil
 	}
 	return s.withTxQuery(qs)
 }
 
+// SaveAccess writes the access token and its refresh token in one transaction,
+// saving a token again is a no-op. A token refreshed from a previous one is saved with the code of the previous one.
 func (s *DbStorage) SaveAccess(data *osin.AccessData) (err error) {
-	_, err = s.LoadAccess(data.AccessToken)
-	if err == nil {
-		return nil
-	} else if err != ErrNotFound {
-		log.Printf("load access '%s' ERR %s", data.AccessToken, err)
-		return
+	s, done := s.op("SaveAccess", tracing.Token(data.AccessToken))
+	defer func() { err = done(err) }()
+	if data.Client == nil {
+		s.log.Warn("access client is nil", "token", data.AccessToken)
+		return storage.ErrInvalidClient
 	}
 	prev := ""
 	authorizeData := &osin.AuthorizeData{}
@@ -142,33 +214,61 @@ func (s *DbStorage) SaveAccess(data *osin.AccessData) (err error) {
 		extra JSONKV
 	)
 	if extra, err = oauth.ToJSONKV(data.UserData); err != nil {
-		log.Printf("access.userdata %+v", data.UserData)
+		s.log.Warn("invalid access userdata", "token", data.AccessToken, "err", err)
 		return
 	}
+	str := s.dialect.Upsert("oauth.access", []string{"client_id", "authorize_code", "previous", "access_token",
+		"refresh_token", "expires_in", "scopes", "redirect_uri", "created", "extra"}, []string{"access_token"}, nil)
 	qs := func(tx DBTxer) error {
-		r, err := tx.Exec(`INSERT INTO oauth.access (client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra)
-			    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-			data.Client.GetId(), authorizeData.Code, prev, data.AccessToken, data.RefreshToken,
+		code := authorizeData.Code
+		if code == "" && prev != "" {
+			// a refreshed token carries the code of its chain, a reuse of the code revokes it too
+			err := tx.QueryRow(`SELECT authorize_code FROM oauth.access WHERE access_token = $1`, storage.SavedKey(prev)).Scan(&code)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		r, err := tx.Exec(str,
+			data.Client.GetId(), code, storage.SavedKey(prev), storage.SavedKey(data.AccessToken),
+			storage.SavedKey(data.RefreshToken),
 			data.ExpiresIn, data.Scope, data.RedirectUri, data.CreatedAt, extra)
 		if err != nil {
 			return err
 		}
+		// saved already, with its refresh token
+		if n, _ := r.RowsAffected(); n == 0 {
+			return nil
+		}
 
-		debug("save AccessData token %s OK %v", data.AccessToken, r)
+		s.log.Debug("saved access", "token", data.AccessToken, "client_id", data.Client.GetId())
 
 		if data.RefreshToken != "" {
-			if err = s.saveRefresh(tx, data.RefreshToken, data.AccessToken); err != nil {
-				log.Printf("save refresh error %s", err)
+			if err = s.saveRefresh(tx, data); err != nil {
+				s.log.Error("save refresh failed", "token", data.AccessToken, "err", err)
 				return err
 			}
 		}
 
-		return nil
+		return s.enqueue(tx, outbox.TokenIssued(data))
 	}
 	return s.withTxQuery(qs)
 }
 
 func (s *DbStorage) LoadAccess(code string) (a *osin.AccessData, err error) {
+	s, done := s.op("LoadAccess", tracing.Token(code))
+	defer func() { err = done(err) }()
+	return s.loadAccess(storage.TokenKey(code), code)
+}
+
+// loadSaved loads a token by the key saved in a chain or a refresh token, traced as LoadAccess
+func (s *DbStorage) loadSaved(key string) (a *osin.AccessData, err error) {
+	s, done := s.op("LoadAccess", tracing.Token(key))
+	defer func() { err = done(err) }()
+	return s.loadAccess(key, key)
+}
+
+// loadAccess loads the token by its key, the previous tokens are loaded by the keys saved and carry them
+func (s *DbStorage) loadAccess(key, code string) (a *osin.AccessData, err error) {
 	var (
 		cid, authorizeCode, prevAccessToken string
 		extra                               JSONKV
@@ -179,17 +279,23 @@ func (s *DbStorage) LoadAccess(code string) (a *osin.AccessData, err error) {
 
 	err = s.db.QueryRow(`SELECT id, client_id, authorize_code, previous, access_token, refresh_token, expires_in, scopes, redirect_uri, created, extra, is_frozen
 		   FROM oauth.access WHERE access_token = $1`,
-		code).Scan(&id, &cid, &authorizeCode, &prevAccessToken,
-		&a.AccessToken, &a.RefreshToken, &a.ExpiresIn, &a.Scope,
+		key).Scan(&id, &cid, &authorizeCode, &prevAccessToken,
+		&key, &a.RefreshToken, &a.ExpiresIn, &a.Scope,
 		&a.RedirectUri, &a.CreatedAt, &extra, &is_frozen)
 
-	if err == sql.ErrNoRows {
-		return nil, ErrNotFound
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
 	} else if err != nil {
-		debug("load access '%s' error: %s", code, err)
-		log.Printf("AccessToken %q not found", code)
-		return nil, dbError
+		s.log.Error("load access failed", "token", code, "err", err)
+		return nil, err
+	}
+	if is_frozen {
+		return nil, storage.ErrFrozen
 	}
+	if err = s.expiry.CheckAccess(a); err != nil {
+		return nil, err
+	}
+	s = s.lax()
 
 	a.UserData = extra
 	a.Client, err = s.GetClient(cid)
@@ -197,87 +303,163 @@ func (s *DbStorage) LoadAccess(code string) (a *osin.AccessData, err error) {
 		return
 	}
 	a.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
-	prevAccess, _ := s.LoadAccess(prevAccessToken)
+	prevAccess, _ := s.loadSaved(prevAccessToken)
 	a.AccessData = prevAccess
-	debug("LoadAccess id #%d, code '%s' expires: \n\t%s created \n\t%s expire_at \n\t%s now \n\tis_expired %v",
-		id, code, a.CreatedAt, a.ExpireAt(), time.Now(), a.IsExpired())
+	s.log.Debug("loaded access", "id", id, "token", code, "created", a.CreatedAt,
+		"expire_at", a.ExpireAt(), "expired", a.IsExpired())
 	return
 }
 
-func (s *DbStorage) RemoveAccess(code string) error {
+func (s *DbStorage) RemoveAccess(code string) (err error) {
+	s, done := s.op("RemoveAccess", tracing.Token(code))
+	defer func() { err = done(err) }()
 	qs := func(tx DBTxer) error {
 		str := `DELETE FROM oauth.access WHERE access_token = $1;`
-		r, err := tx.Exec(str, code)
+		r, err := tx.Exec(str, storage.SavedKey(code))
 		if err != nil {
-			debug("RemoveAccess '%s', ERR %s", code, err)
+			s.log.Error("remove access failed", "token", code, "err", err)
 			return err
 		}
 
-		debug("RemoveAccess '%s' OK %v", code, r)
+		s.log.Debug("removed access", "token", code)
 
+		if n, _ := r.RowsAffected(); n > 0 {
+			return s.enqueue(tx, outbox.TokenRevoked(code))
+		}
 		return nil
 	}
 	return s.withTxQuery(qs)
 }
 
-func (s *DbStorage) LoadRefresh(code string) (*osin.AccessData, error) {
-	var access string
-	err := s.db.QueryRow(`SELECT access FROM oauth.refresh WHERE token=$1 LIMIT 1`, code).Scan(&access)
-	if err == sql.ErrNoRows {
-		return nil, ErrNotFound
-		// return nil, fmt.Errorf("RefreshToken %q not found", code)
+func (s *DbStorage) LoadRefresh(code string) (a *osin.AccessData, err error) {
+	s, done := s.op("LoadRefresh", tracing.Token(code))
+	defer func() { err = done(err) }()
+	var (
+		access    string
+		r         storage.RefreshToken
+		expiresAt sql.NullTime
+	)
+	err = s.db.QueryRow(`SELECT access, created, started, expires_at FROM oauth.refresh WHERE token=$1 LIMIT 1`, storage.TokenKey(code)).
+		Scan(&access, &r.Created, &r.Started, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
 	} else if err != nil {
-		debug("LoadRefresh '%s' ERR %s", code, err)
+		s.log.Error("load refresh failed", "token", code, "err", err)
+		return nil, err
+	}
+	if a, err = s.lax().loadSaved(access); err != nil {
+		return nil, err
+	}
+	r.ExpiresAt = expiresAt.Time
+	if err = s.expiry.CheckRefreshToken(a, r); err != nil {
 		return nil, err
 	}
-	return s.LoadAccess(access)
+	return
+}
+
+// lax returns a copy of s without the expiry policy, for the nested and internal loads
+func (s *DbStorage) lax() *DbStorage {
+	if !s.expiry.Enforce {
+		return s
+	}
+	c := *s
+	c.expiry.Enforce = false
+	return &c
 }
 
-func (s *DbStorage) saveRefresh(tx DBTxer, refresh, access string) (err error) {
-	_, err = s.db.Exec("INSERT INTO oauth.refresh (token, access) VALUES ($1, $2)", refresh, access)
+// saveRefresh writes the refresh token of data, in the rotation chain of the previous token
+func (s *DbStorage) saveRefresh(tx DBTxer, data *osin.AccessData) (err error) {
+	token, access := storage.SavedKey(data.RefreshToken), storage.SavedKey(data.AccessToken)
+	if storage.RefreshReused(data) {
+		// kept on refresh, with the lifetime of its first issue
+		var r storage.RefreshToken
+		err = tx.QueryRow("SELECT created, started FROM oauth.refresh WHERE token = $1", token).
+			Scan(&r.Created, &r.Started)
+		if err == nil {
+			r = s.expiry.ReuseRefreshToken(r)
+			_, err = tx.Exec("UPDATE oauth.refresh SET access = $1, created = $2 WHERE token = $3",
+				access, r.Created, token)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+	}
+	var started time.Time
+	if prev := data.AccessData; prev != nil {
+		var st sql.NullTime
+		err = tx.QueryRow("SELECT started FROM oauth.refresh WHERE access = $1", storage.SavedKey(prev.AccessToken)).Scan(&st)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		// the previous refresh token may be removed already, its access token is in the chain
+		if started = st.Time; !st.Valid {
+			started = prev.CreatedAt
+		}
+	}
+	r := s.expiry.NewRefreshToken(data, started)
+	var expiresAt sql.NullTime
+	if !r.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: r.ExpiresAt, Valid: true}
+	}
+	_, err = tx.Exec("INSERT INTO oauth.refresh (token, access, created, started, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		token, access, r.Created, r.Started, expiresAt)
 	return
 }
 
-func (s *DbStorage) RemoveRefresh(code string) error {
-	log.Printf("RemoveRefresh: %s\n", code)
-	_, err := s.db.Exec("DELETE FROM oauth.refresh WHERE token=$1", code)
-	return err
+func (s *DbStorage) RemoveRefresh(code string) (err error) {
+	s, done := s.op("RemoveRefresh", tracing.Token(code))
+	defer func() { err = done(err) }()
+	s.log.Debug("remove refresh", "token", code)
+	return s.withTxQuery(func(tx DBTxer) error {
+		r, err := tx.Exec("DELETE FROM oauth.refresh WHERE token=$1", storage.SavedKey(code))
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n > 0 {
+			return s.enqueue(tx, outbox.RefreshRevoked(code))
+		}
+		return nil
+	})
 }
 
 func (s *DbStorage) GetClientWithCode(code string) (c *Client, err error) {
+	s, done := s.op("GetClientWithCode", tracing.ClientID(code))
+	defer func() { err = done(err) }()
 	c = new(Client)
-	err = s.db.QueryRow("SELECT id, secret, redirect_uri, meta, created FROM oauth.client WHERE id = $1",
-		code).Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt)
-	if err == sql.ErrNoRows {
-		log.Printf("GetClientWithCode '%s', ERR %s", code, err)
-		err = ErrNotFound
+	err = s.db.QueryRow("SELECT id, secret, redirect_uri, meta, created, version, updated FROM oauth.client WHERE id = $1",
+		code).Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.log.Debug("client not found", "client_id", code)
 	} else if err != nil {
-		log.Printf("GetClientWithCode '%s' ERROR: %s", code, err)
+		s.log.Error("load client failed", "client_id", code, "err", err)
 	}
 	return
 }
 
 func (s *DbStorage) AllClients(vals url.Values) (clients []Client, total int, err error) {
+	s, done := s.op("AllClients")
+	defer func() { err = done(err) }()
 	err = s.db.QueryRow("SELECT COUNT(id) FROM oauth.client").Scan(&total)
 	if err != nil || total == 0 {
 		return
 	}
-	str := `SELECT id, secret, redirect_uri, meta, created
+	str := `SELECT id, secret, redirect_uri, meta, created, version, updated
 	   FROM oauth.client `
 
 	clients = make([]Client, 0)
 
 	rows, err := s.db.Query(str)
 	if err != nil {
-		log.Printf("db query error: %s for sql %s", err, str)
+		s.log.Error("query clients failed", "err", err)
 		return
 	}
 	defer rows.Close()
 	for rows.Next() {
 		c := new(Client)
-		err = rows.Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt)
+		err = rows.Scan(&c.ID, &c.Secret, &c.RedirectURI, &c.Meta, &c.CreatedAt, &c.Version, &c.UpdatedAt)
 		if err != nil {
-			log.Printf("rows scan error: %s", err)
+			s.log.Error("scan client failed", "err", err)
 			continue
 		}
 		clients = append(clients, *c)
@@ -288,64 +470,133 @@ func (s *DbStorage) AllClients(vals url.Values) (clients []Client, total int, er
 }
 
 // SaveClient stores the client in the database and returns an error, if something went wrong.
-func (s *DbStorage) SaveClient(client storage.Client) error {
+// An update increments the version of the client.
+func (s *DbStorage) SaveClient(client storage.Client) (err error) {
+	s, done := s.op("SaveClient", tracing.ClientID(client.GetId()))
+	defer func() { err = done(err) }()
+	return s.saveClient(client, -1)
+}
+
+// UpdateClient updates the client if its stored version is version, and increments the version.
+// It returns a storage.ErrConflict if the client is updated since.
+func (s *DbStorage) UpdateClient(client storage.Client, version int) (err error) {
+	s, done := s.op("UpdateClient", tracing.ClientID(client.GetId()))
+	defer func() { err = done(err) }()
+	return s.saveClient(client, version)
+}
+
+// saveClient updates the client of the version, or of any version and inserts it if not found with -1
+func (s *DbStorage) saveClient(client storage.Client, version int) error {
 	c := new(Client)
 	c.CopyFrom(client)
-	if c.ID == "" || c.Secret == "" || c.RedirectURI == "" {
-		return valueError
+	if err := c.Validate(); err != nil {
+		return err
 	}
 
 	qs := func(tx DBTxer) (err error) {
-		var created time.Time
-		err = tx.QueryRow("SELECT created FROM oauth.client WHERE id = $1", c.ID).Scan(&created)
-		if err != nil && err != sql.ErrNoRows {
-			log.Printf("query client %s ERR %s", c.ID, err)
+		now := time.Now()
+		str := `UPDATE oauth.client SET meta = $1, secret = $2, redirect_uri = $3, version = version + 1, updated = $4
+			 WHERE id = $5`
+		args := []interface{}{c.Meta, c.Secret, c.RedirectURI, now, c.ID}
+		if version >= 0 {
+			str += " AND version = $6"
+			args = append(args, version)
+		}
+		r, err := tx.Exec(str, args...)
+		if err != nil {
+			s.log.Error("update client failed", "client_id", c.ID, "err", err)
 			return
 		}
-		if !created.IsZero() {
-			str := `UPDATE oauth.client SET meta = $1, secret = $2, redirect_uri = $3
-			 WHERE id = $4`
-			var r sql.Result
-			r, err = tx.Exec(str, c.Meta, c.Secret, c.RedirectURI, c.ID)
-			log.Printf("UPDATE client result: %v", r)
-		} else {
-			str := `INSERT INTO
-		 oauth.client(id, meta, secret, redirect_uri)
-		 VALUES($1, $2, $3, $4) RETURNING created;`
-			err = tx.QueryRow(str,
-				c.ID,
-				c.Meta,
-				c.Secret,
-				c.RedirectURI).Scan(&created)
-			debug("save new client %s", c)
+		if n, _ := r.RowsAffected(); n == 0 && version >= 0 {
+			return clientConflict(tx, c.ID, version)
+		} else if n == 0 {
+			// a client removed before continues its revisions
+			var last int
+			err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM oauth.client_revision WHERE client_id = $1", c.ID).Scan(&last)
+			if err != nil {
+				return
+			}
+			_, err = tx.Exec(`INSERT INTO oauth.client(id, meta, secret, redirect_uri, version, updated) VALUES($1, $2, $3, $4, $5, $6)`,
+				c.ID, c.Meta, c.Secret, c.RedirectURI, last+1, now)
+			if err != nil {
+				s.log.Error("save client failed", "client_id", c.ID, "err", err)
+				return
+			}
 		}
-		return err
+		err = tx.QueryRow("SELECT created, version, updated FROM oauth.client WHERE id = $1", c.ID).
+			Scan(&c.CreatedAt, &c.Version, &c.UpdatedAt)
+		if err != nil {
+			return
+		}
+		if err = s.saveRevision(tx, c, false); err != nil {
+			return
+		}
+		if oc, ok := client.(*Client); ok {
+			oc.CreatedAt, oc.Version, oc.UpdatedAt = c.CreatedAt, c.Version, c.UpdatedAt
+		}
+		s.log.Debug("saved client", "client_id", c.ID, "version", c.Version)
+		return s.enqueue(tx, outbox.ClientSaved(c))
 	}
 	return s.withTxQuery(qs)
 }
 
+// clientConflict returns the conflict of a client not of the version, or sql.ErrNoRows
+func clientConflict(tx DBTxer, id string, version int) error {
+	var stored int
+	if err := tx.QueryRow("SELECT version FROM oauth.client WHERE id = $1", id).Scan(&stored); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: client %s of version %d, not %d", storage.ErrConflict, id, stored, version)
+}
+
 // RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
+// The revisions of the client are kept, with a tombstone of the removal as its last version.
 func (s *DbStorage) RemoveClient(id string) (err error) {
-	_, err = s.db.Exec("DELETE FROM oauth.client WHERE id = $1", id)
-	return
+	s, done := s.op("RemoveClient", tracing.ClientID(id))
+	defer func() { err = done(err) }()
+	return s.withTxQuery(func(tx DBTxer) error {
+		var version int
+		err := tx.QueryRow("SELECT version FROM oauth.client WHERE id = $1", id).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, err := tx.Exec("DELETE FROM oauth.client WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		// removed concurrently
+		if n, _ := r.RowsAffected(); n == 0 {
+			return nil
+		}
+		if err = s.saveRevision(tx, &Client{ID: id, Version: version + 1, UpdatedAt: time.Now()}, true); err != nil {
+			return err
+		}
+		return s.enqueue(tx, outbox.ClientRemoved(id))
+	})
 }
 
 func (s *DbStorage) LoadScopes() (scopes []*Scope, err error) {
+	s, done := s.op("LoadScopes")
+	defer func() { err = done(err) }()
 	scopes = make([]*Scope, 0)
 
-	rows, err := s.db.Query("SELECT name, label, description, is_default FROM oauth.scope")
+	rows, err := s.db.Query("SELECT name, label, description, is_default FROM oauth.scopes ORDER BY id")
 	if err != nil {
-		log.Printf("load scopes error: %s", err)
+		s.log.Error("load scopes failed", "err", err)
 		return
 	}
 	defer rows.Close()
 	for rows.Next() {
-		s := new(Scope)
-		err = rows.Scan(&s.Name, &s.Label, &s.Description, &s.IsDefault)
+		scope := new(Scope)
+		err = rows.Scan(&scope.Name, &scope.Label, &scope.Description, &scope.IsDefault)
 		if err != nil {
-			log.Printf("rows scan error: %s", err)
+			s.log.Error("scan scope failed", "err", err)
+			return
 		}
-		scopes = append(scopes, s)
+		scopes = append(scopes, scope)
 	}
 	err = rows.Err()
 
@@ -353,14 +604,16 @@ func (s *DbStorage) LoadScopes() (scopes []*Scope, err error) {
 }
 
 func (s *DbStorage) IsAuthorized(client_id, username string) bool {
+	s, done := s.op("IsAuthorized", tracing.ClientID(client_id))
+	defer done(nil)
 	var (
 		created time.Time
 	)
 	err := s.db.QueryRow("SELECT created FROM oauth.client_user_authorized WHERE client_id = $1 AND username = $2",
 		client_id, username).Scan(&created)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Printf("load IsAuthorized(%s, %s) ERROR: %s", client_id, username, err)
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.log.Error("load authorized failed", "client_id", client_id, "username", username, "err", err)
 		}
 		return false
 	}
@@ -368,6 +621,8 @@ func (s *DbStorage) IsAuthorized(client_id, username string) bool {
 }
 
 func (s *DbStorage) SaveAuthorized(client_id, username string) (err error) {
+	s, done := s.op("SaveAuthorized", tracing.ClientID(client_id))
+	defer func() { err = done(err) }()
 	_, err = s.db.Exec("INSERT INTO oauth.client_user_authorized(client_id, username) VALUES($1, $2) ",
 		client_id, username)
 	return
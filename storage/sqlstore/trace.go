@@ -0,0 +1,151 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/liut/osin-storage/storage"
+	"github.com/liut/osin-storage/storage/tracing"
+)
+
+// WithTracerProvider traces the storage methods and their statements with the tracers of tp,
+// nil for the global provider. The spans are children of the context given by WithContext.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *DbStorage) {
+		s.tracer = tracing.Tracer(tp)
+	}
+}
+
+// WithContext returns a copy of the storage, whose spans are children of ctx
+func (s *DbStorage) WithContext(ctx context.Context) Storage {
+	c := *s
+	c.ctx = ctx
+	c.db = c.conn(ctx)
+	return &c
+}
+
+// op starts a storage method, and returns a copy of s in its span, the nested methods and statements
+// of the copy are children of the span. done ends the span and returns err as a storage.Error of the method.
+func (s *DbStorage) op(method string, attrs ...attribute.KeyValue) (_ *DbStorage, done func(error) error) {
+	if s.tracer == nil {
+		return s, func(err error) error { return storage.AsError(method, err, errKind) }
+	}
+	ctx, span := s.tracer.Start(s.ctx, "sqlstore."+method, trace.WithAttributes(attrs...))
+	c := *s
+	c.ctx = ctx
+	c.db = c.conn(ctx)
+	return &c, func(err error) error {
+		err = storage.AsError(method, err, errKind)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// conn returns the DBer of s, traced in ctx
+func (s *DbStorage) conn(ctx context.Context) (db DBer) {
+	db = s.base
+	if s.tracer != nil {
+		db = tracedDB{db, s.statements(ctx)}
+	}
+	if s.dialect != Postgres {
+		db = rebindDB{db, s.dialect}
+	}
+	return
+}
+
+// txer returns the DBTxer of tx, traced in the context of s
+func (s *DbStorage) txer(tx *sql.Tx) (txer DBTxer) {
+	txer = tx
+	if s.tracer != nil {
+		txer = tracedTx{txer, s.statements(s.ctx)}
+	}
+	if s.dialect != Postgres {
+		txer = rebindTx{txer, s.dialect}
+	}
+	return
+}
+
+func (s *DbStorage) statements(ctx context.Context) statementTracer {
+	return statementTracer{ctx: ctx, tracer: s.tracer, system: dbSystem(s.dialect)}
+}
+
+// dbSystem returns the db.system of the dialect
+func dbSystem(d Dialect) string {
+	switch d.Name() {
+	case "postgres":
+		return "postgresql"
+	case "sqlite3":
+		return "sqlite"
+	}
+	return d.Name()
+}
+
+// statementTracer starts a span by statement
+type statementTracer struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	system string
+}
+
+func (st statementTracer) start(query string) trace.Span {
+	_, span := st.tracer.Start(st.ctx, tracing.Operation(query),
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(tracing.Statement(st.system, query)...))
+	return span
+}
+
+// tracedDB is a DBer with a span by statement
+type tracedDB struct {
+	DBer
+	st statementTracer
+}
+
+func (db tracedDB) Query(query string, args ...interface{}) (rows *sql.Rows, err error) {
+	span := db.st.start(query)
+	rows, err = db.DBer.Query(query, args...)
+	tracing.End(span, err)
+	return
+}
+
+func (db tracedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := db.st.start(query)
+	row := db.DBer.QueryRow(query, args...)
+	tracing.End(span, row.Err())
+	return row
+}
+
+func (db tracedDB) Exec(query string, args ...interface{}) (r sql.Result, err error) {
+	span := db.st.start(query)
+	r, err = db.DBer.Exec(query, args...)
+	tracing.End(span, err)
+	return
+}
+
+// tracedTx is a DBTxer with a span by statement
+type tracedTx struct {
+	DBTxer
+	st statementTracer
+}
+
+func (tx tracedTx) Query(query string, args ...interface{}) (rows *sql.Rows, err error) {
+	span := tx.st.start(query)
+	rows, err = tx.DBTxer.Query(query, args...)
+	tracing.End(span, err)
+	return
+}
+
+func (tx tracedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := tx.st.start(query)
+	row := tx.DBTxer.QueryRow(query, args...)
+	tracing.End(span, row.Err())
+	return row
+}
+
+func (tx tracedTx) Exec(query string, args ...interface{}) (r sql.Result, err error) {
+	span := tx.st.start(query)
+	r, err = tx.DBTxer.Exec(query, args...)
+	tracing.End(span, err)
+	return
+}
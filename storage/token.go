@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MaxTokenLen is the length of the token columns of the SQL storages, varchar(240)
+const MaxTokenLen = 240
+
+// tokenKeyPrefix is the namespace of the keys of the long tokens
+const tokenKeyPrefix = "sha256:"
+
+// TokenKey returns the key of a presented code or token in a storage: the token itself if it fits in MaxTokenLen,
+// or the hex SHA-256 of a longer one, e.g. a JWT access token. A token in the namespace of the keys is hashed too,
+// so a key presented as a token never matches the row of its token.
+func TokenKey(token string) string {
+	if len(token) <= MaxTokenLen && !strings.HasPrefix(token, tokenKeyPrefix) {
+		return token
+	}
+	sum := sha256.Sum256([]byte(token))
+	return tokenKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// IsTokenKey reports whether s is the key of a long token
+func IsTokenKey(s string) bool {
+	if len(s) != len(tokenKeyPrefix)+2*sha256.Size || !strings.HasPrefix(s, tokenKeyPrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(s[len(tokenKeyPrefix):])
+	return err == nil
+}
+
+// SavedKey returns the key of a token to save or remove. The previous tokens loaded with a chain
+// carry their keys, which osin removes after a refresh, so a key is kept as is: it revokes, never authenticates.
+func SavedKey(token string) string {
+	if IsTokenKey(token) {
+		return token
+	}
+	return TokenKey(token)
+}
+
+// TokenHash returns the hash of a code or token recorded in clear nowhere, e.g. in the logs and the audit events.
+// A long token and its TokenKey have the same hash.
+func TokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(SavedKey(token)))
+	return tokenKeyPrefix + hex.EncodeToString(sum[:16])
+}
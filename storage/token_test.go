@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenKey(t *testing.T) {
+	assert.Equal(t, "", TokenKey(""))
+	short := strings.Repeat("a", MaxTokenLen)
+	assert.Equal(t, short, TokenKey(short))
+
+	long := strings.Repeat("a", MaxTokenLen+1)
+	key := TokenKey(long)
+	assert.Len(t, key, len("sha256:")+64)
+	assert.NotEqual(t, key, TokenKey(long+"b"))
+
+	// a key presented as a token is hashed again, it is kept only to save or remove
+	assert.True(t, IsTokenKey(key))
+	assert.False(t, IsTokenKey(short))
+	assert.NotEqual(t, key, TokenKey(key))
+	assert.Equal(t, key, SavedKey(key))
+	assert.Equal(t, key, SavedKey(long))
+	assert.Equal(t, short, SavedKey(short))
+	assert.True(t, IsTokenKey(TokenKey("sha256:forged")))
+
+	assert.Equal(t, "", TokenHash(""))
+	assert.Equal(t, TokenHash(long), TokenHash(key))
+	assert.NotEqual(t, TokenHash(short), short)
+	assert.Len(t, TokenHash(short), len("sha256:")+32)
+}
@@ -0,0 +1,72 @@
+// Package tracing holds the OpenTelemetry conventions shared by the SQL storages:
+// a span by storage method and by statement, with redacted tokens.
+package tracing
+
+import (
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/liut/osin-storage/storage/audit"
+)
+
+// InstrumentationName is the name of the tracers
+const InstrumentationName = "github.com/liut/osin-storage/storage"
+
+// attribute keys
+const (
+	ClientIDKey  = attribute.Key("oauth.client_id")
+	TokenKey     = attribute.Key("oauth.token")
+	SystemKey    = attribute.Key("db.system")
+	OperationKey = attribute.Key("db.operation")
+	StatementKey = attribute.Key("db.statement")
+)
+
+// Tracer returns the tracer of tp, or of the global provider if tp is nil
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(InstrumentationName)
+}
+
+// ClientID is the attribute of a client id
+func ClientID(id string) attribute.KeyValue {
+	return ClientIDKey.String(id)
+}
+
+// Token is the attribute of a code or token, redacted as audit.TokenTarget
+func Token(token string) attribute.KeyValue {
+	return TokenKey.String(audit.TokenTarget(token))
+}
+
+// Statement returns the attributes of a SQL statement of the database system,
+// the statement has placeholders only, never the values
+func Statement(system, query string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		SystemKey.String(system),
+		OperationKey.String(Operation(query)),
+		StatementKey.String(query),
+	}
+}
+
+// Operation returns the kind of a SQL statement, e.g. SELECT
+func Operation(query string) string {
+	query = strings.TrimSpace(query)
+	if i := strings.IndexAny(query, " \t\r\n("); i > 0 {
+		query = query[:i]
+	}
+	return strings.ToUpper(query)
+}
+
+// End records err if any and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}